@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"dm-linuxkit/mount"
+)
+
+// Flags shared between subcommands are defined here, in groups, so they're
+// spelled and described the same everywhere.
+
+// commonFlags say where the pool, dotmesh and our settings are, and how to
+// log. Every subcommand but the etcd ones, down and unmount takes them.
+type commonFlags struct {
+	flags           *flag.FlagSet
+	pool            *string
+	dotmeshAddress  *string
+	adminApiKeyFile *string
+	config          *string
+	metadata        *string
+	logging         *logFlags
+}
+
+func addCommonFlags(flags *flag.FlagSet) *commonFlags {
+	return &commonFlags{
+		flags:   flags,
+		logging: addLogFlags(flags),
+		pool: flags.String(
+			"pool-name", "pool",
+			"Name of storage pool to use",
+		),
+		dotmeshAddress: flags.String(
+			"dotmesh-address", dotmeshAddress,
+			"host or host:port of the dotmesh-server API we start",
+		),
+		adminApiKeyFile: flags.String(
+			"admin-api-key-file", "/run/config/dotmesh/admin-api-key",
+			"Initial admin API key for the local dotmesh",
+		),
+		config: flags.String(
+			"config", CONFIG_FILE,
+			"YAML or JSON config file giving any of these flags' values; flags "+
+				"on the command line override it",
+		),
+		metadata: flags.String(
+			"metadata", "",
+			"Read the dotmesh section of raw LinuxKit metadata JSON from this path, "+
+				"or from the cloud's user-data with gcp or aws, instead of the files "+
+				"the metadata package writes under /run/config/dotmesh",
+		),
+	}
+}
+
+// load reads the metadata and config file, filling in flags that weren't
+// given from the config file. Call it once flags are parsed.
+func (c *commonFlags) load() (metadata, *config, error) {
+	var md metadata
+	if *c.metadata != "" {
+		var err error
+		md, err = loadMetadata(*c.metadata)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := md.check(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	configGiven := false
+	c.flags.Visit(func(f *flag.Flag) {
+		configGiven = configGiven || f.Name == "config"
+	})
+	cfg, err := loadConfig(md, *c.config, configGiven)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.applyTo(c.flags); err != nil {
+		return nil, nil, err
+	}
+	if err := c.logging.setup(); err != nil {
+		return nil, nil, err
+	}
+	dotmeshAddress = *c.dotmeshAddress
+	return md, cfg, nil
+}
+
+func (c *commonFlags) adminApiKey(md metadata) (string, error) {
+	adminApiKey, err := md.read("admin-api-key", *c.adminApiKeyFile)
+	return string(adminApiKey), err
+}
+
+// storageFlags say how to set up the pool and etcd's filesystem on it.
+type storageFlags struct {
+	storageDevice   *string
+	allowAddDevices *bool
+	growFiles       *bool
+	etcdDataDir     *string
+	etcdReservation *string
+}
+
+func addStorageFlags(flags *flag.FlagSet) *storageFlags {
+	return &storageFlags{
+		storageDevice: flags.String(
+			"storage-device", "",
+			"block device or file to store data (seperate multiple with commas). "+
+				"Use file:<path>:<size> e.g. file:/var/lib/dm/pool.img:10G to "+
+				"create a sparse image file if it doesn't exist",
+		),
+		allowAddDevices: flags.Bool(
+			"allow-add-devices", false,
+			"Add any -storage-device that isn't already part of an existing pool to it",
+		),
+		growFiles: flags.Bool(
+			"grow-files", false,
+			"Grow file:<path>:<size> storage devices that are smaller than <size>",
+		),
+		etcdDataDir: flags.String(
+			"etcd-data-dir", ETCD_DATA_DIR,
+			"Where to mount the dotmesh-etcd filesystem for etcd's data",
+		),
+		etcdReservation: flags.String(
+			"etcd-reservation", "",
+			"Space to reserve for dotmesh's etcd, so a full pool can't starve it, e.g. 256M",
+		),
+	}
+}
+
+func (s *storageFlags) etcdLimits() spaceLimits {
+	return spaceLimits{Reservation: *s.etcdReservation}
+}
+
+// setupPool creates or imports the pool, growing it if need be, and checks
+// it's healthy enough to use.
+func (s *storageFlags) setupPool(zfs ZFS, pool string) error {
+	if err := s.etcdLimits().validate(); err != nil {
+		return err
+	}
+	storageDevices, err := parseStorageDevices(*s.storageDevice)
+	if err != nil {
+		return err
+	}
+	devicePaths, grownDevices, err := prepareStorageDevices(storageDevices, *s.growFiles)
+	if err != nil {
+		return err
+	}
+	err = setupZFS(zfs, pool, devicePaths, poolOptions{
+		AllowAddDevices: *s.allowAddDevices,
+		GrownDevices:    grownDevices,
+	})
+	if err != nil {
+		return err
+	}
+	return checkPoolUsable(zfs, pool)
+}
+
+// mountFlags say where and how to mount a dot.
+type mountFlags struct {
+	dot         *string
+	branch      *string
+	mountpoint  *string
+	readOnly    *bool
+	propagation *string
+}
+
+func addMountFlags(flags *flag.FlagSet) *mountFlags {
+	return &mountFlags{
+		dot:    addDotFlag(flags),
+		branch: addBranchFlag(flags),
+		mountpoint: flags.String(
+			"mountpoint", "",
+			"Where to mount the datadot on the host",
+		),
+		readOnly: flags.Bool(
+			"ro", false,
+			"Mount the datadot at -mountpoint read-only",
+		),
+		propagation: flags.String(
+			"mount-propagation", string(mountPropagation),
+			"Propagation for mounts we make (rshared, shared, rslave, slave, "+
+				"rprivate or private), should match the container's rootfsPropagation",
+		),
+	}
+}
+
+func addDotFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"dot", "",
+		"Name of dotmesh datadot to use (docs.dotmesh.com/concepts/what-is-a-datadot)",
+	)
+}
+
+func addBranchFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"branch", "master",
+		"Branch of the datadot to use, which must already exist unless it's master",
+	)
+}
+
+// configured are the dots up mounts with these flags and cfg, the dot
+// (if there is one) and the config file's dots.
+func (m *mountFlags) configured(cfg *config) []DaemonMount {
+	var mounts []DaemonMount
+	if *m.dot != "" {
+		mounts = append(mounts, DaemonMount{
+			Dot:        *m.dot,
+			Branch:     branchName(*m.branch),
+			Mountpoint: *m.mountpoint,
+			ReadOnly:   *m.readOnly,
+		})
+	}
+	for _, d := range cfg.Dots {
+		mounts = append(mounts, d.mount())
+	}
+	return mounts
+}
+
+// setPropagation sets the propagation for the mounts we make from
+// -mount-propagation.
+func (m *mountFlags) setPropagation() error {
+	propagation, err := mount.ParsePropagation(*m.propagation)
+	if err != nil {
+		return err
+	}
+	mountPropagation = propagation
+	return nil
+}
+
+func addControlSocketFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"control-socket", CONTROL_SOCKET,
+		"Control API socket of the running up daemon, which does the work when "+
+			"it's there",
+	)
+}
+
+// seedFlags say what to seed a dot from.
+type seedFlags struct {
+	seed            *string
+	seedFile        *string
+	credentialsFile *string
+	stallTimeout    *time.Duration
+}
+
+func addSeedFlags(flags *flag.FlagSet) *seedFlags {
+	return &seedFlags{
+		seed: flags.String(
+			"seed", "",
+			"Address of a datadot to seed from, instead of reading -seed-file",
+		),
+		seedFile: flags.String(
+			"seed-file", "/run/config/dotmesh/seed",
+			"File containing address of a datadot to seed from e.g. dothub.com/justincormack/postgres",
+		),
+		credentialsFile: flags.String(
+			"credentials-file", "/run/config/dotmesh/credentials",
+			"File containing <API username>:<API key> for use with -seed",
+		),
+		stallTimeout: flags.Duration(
+			"transfer-stall-timeout", 10*time.Minute,
+			"Give up seeding if the transfer makes no progress for this long",
+		),
+	}
+}
+
+// source returns what to seed from, or "" if we're not seeding. -seed wins
+// over the seed file.
+func (s *seedFlags) source(md metadata) (string, error) {
+	if *s.seed != "" {
+		return *s.seed, nil
+	}
+	seed, err := md.read("seed", *s.seedFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read seed file at %s, err: %v", *s.seedFile, err)
+	}
+	return string(seed), nil
+}
+
+func (s *seedFlags) credentials(md metadata) (string, error) {
+	credentials, err := md.read("credentials", *s.credentialsFile)
+	if err != nil {
+		return "", fmt.Errorf(
+			"Unable to read credentials file at %s, see the README for how "+
+				"to provide credentials for seeding: %v",
+			*s.credentialsFile, err,
+		)
+	}
+	return string(credentials), nil
+}
@@ -2,16 +2,90 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/rpc/v2/json2"
 )
 
-// TODO deduplicate this wrt dotmesh
+const DOTMESH_PORT = "32607"
+
+// dotmeshAddress is where the local dotmesh-server's API is, as a hostname or
+// host:port (see -dotmesh-address).
+var dotmeshAddress = "localhost"
+
+// doRPC calls method on dotmesh's API, counting it in the metrics.
 func doRPC(hostname, user, apiKey, method string, args interface{}, result interface{}) error {
-	url := fmt.Sprintf("http://%s:32607/rpc", hostname)
+	started := time.Now()
+	err := callDotmesh(hostname, user, apiKey, method, args, result)
+	took := time.Since(started)
+	recordRPC(method, took, err)
+	rpcLogger := logger.with(logFields{"method": method})
+	if !rpcLogger.enabled(levelDebug) {
+		return err
+	}
+	if err != nil {
+		rpcLogger.Debugf("RPC %s failed after %s: %v", redacted(args), took, err)
+	} else {
+		rpcLogger.Debugf("RPC %s took %s, got %s", redacted(args), took, redacted(result))
+	}
+	return err
+}
+
+// redacted is v as JSON for logging, with any API keys, passwords or
+// credentials in it (e.g. a remote's ApiKey in a transfer) replaced.
+func redacted(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("(%T)", v)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return fmt.Sprintf("(%T)", v)
+	}
+	b, _ = json.Marshal(redact(decoded))
+	return string(b)
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isSecret(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	}
+	return v
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range []string{"apikey", "password", "credentials", "token"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// TODO deduplicate this wrt dotmesh
+func callDotmesh(hostname, user, apiKey, method string, args interface{}, result interface{}) error {
+	if _, _, err := net.SplitHostPort(hostname); err != nil {
+		hostname = net.JoinHostPort(hostname, DOTMESH_PORT)
+	}
+	url := fmt.Sprintf("http://%s/rpc", hostname)
 	message, err := json2.EncodeClientRequest(method, args)
 	if err != nil {
 		return err
@@ -28,21 +102,17 @@ func doRPC(hostname, user, apiKey, method string, args interface{}, result inter
 	resp, err := client.Do(req)
 
 	if err != nil {
-		fmt.Printf("Test RPC FAIL: %+v -> %s -> %+v\n", args, method, err)
 		return err
 	}
 
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Test RPC FAIL: %+v -> %s -> %+v\n", args, method, err)
 		return fmt.Errorf("Error reading body: %s", err)
 	}
 	err = json2.DecodeClientResponse(bytes.NewBuffer(b), &result)
 	if err != nil {
-		fmt.Printf("Test RPC FAIL: %+v -> %s -> %+v\n", args, method, err)
 		return fmt.Errorf("Couldn't decode response '%s': %s", string(b), err)
 	}
-	fmt.Printf("Test RPC: %+v -> %s -> %+v\n", args, method, result)
 	return nil
 }
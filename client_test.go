@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	got := redacted(TransferRequest{Peer: "dothub.com", User: "alice", ApiKey: "s3cret", LocalName: "test"})
+	if strings.Contains(got, "s3cret") {
+		t.Errorf("API key not redacted: %s", got)
+	}
+	if !strings.Contains(got, `"ApiKey":"REDACTED"`) || !strings.Contains(got, `"User":"alice"`) {
+		t.Errorf("unexpected redaction: %s", got)
+	}
+	got = redacted([]interface{}{map[string]string{"adminPassword": "pw"}, "plain"})
+	if got != `[{"adminPassword":"REDACTED"},"plain"]` {
+		t.Errorf("unexpected redaction: %s", got)
+	}
+	if got := redacted("id"); got != `"id"` {
+		t.Errorf("expected a plain string as is, got %s", got)
+	}
+}
+
+func TestDoRPCDebugLogRedactsApiKey(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	testLogger, out := newTestLogger("text", levelDebug)
+	saved := logger
+	logger = testLogger
+	defer func() { logger = saved }()
+	defer useFakeDotmesh(h)()
+
+	var id string
+	doRPC(dotmeshAddress, "admin", "apikey", "DotmeshRPC.Transfer", TransferRequest{ApiKey: "s3cret"}, &id)
+	if !strings.Contains(out.String(), "RPC {") || strings.Contains(out.String(), "s3cret") {
+		t.Errorf("expected a debug log of the call without the API key, got:\n%s", out.String())
+	}
+}
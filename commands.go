@@ -0,0 +1,368 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The subcommands other than up, which operators can run on the VM console
+// alongside a running `dm-linuxkit up`. Those that change things go through
+// the daemon's control API when it's running, so it knows about them, and do
+// the work themselves otherwise.
+
+func initCommand(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	storage := addStorageFlags(flags)
+	flags.Parse(args)
+	if _, _, err := common.load(); err != nil {
+		logger.Fatal(err)
+	}
+
+	zfs := newExecZFS()
+	if err := storage.setupPool(zfs, *common.pool); err != nil {
+		logger.Fatalf("Couldn't set up pool %s: %v", *common.pool, err)
+	}
+	if err := setupEtcdFilesystem(zfs, *common.pool, *storage.etcdDataDir); err != nil {
+		logger.Fatalf("Couldn't set up etcd's filesystem: %v", err)
+	}
+	err := applySpaceLimits(zfs, *common.pool+"/dotmesh-etcd", storage.etcdLimits())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	log.Printf("Pool %s is ready", *common.pool)
+}
+
+func seedCommand(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	flagDot := addDotFlag(flags)
+	seedOpts := addSeedFlags(flags)
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	md, _, err := common.load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *flagDot == "" {
+		logger.Fatalf("-dot is required")
+	}
+
+	seed, err := seedOpts.source(md)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if seed == "" {
+		logger.Fatalf("Nothing to seed from, give -seed or -seed-file")
+	}
+	credentials, err := seedOpts.credentials(md)
+	if daemon := dialDaemon(*flagControlSocket); daemon != nil {
+		// The daemon uses its own credentials if we can't find any.
+		var result bool
+		err = daemon.call("Seed", TransferDotRequest{
+			Dot:         *flagDot,
+			Remote:      seed,
+			Credentials: credentials,
+		}, &result)
+	} else {
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var adminApiKey string
+		adminApiKey, err = common.adminApiKey(md)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		err = seedDot(adminApiKey, *flagDot, seed, credentials, *seedOpts.stallTimeout)
+	}
+	if err != nil {
+		logger.Fatalf("Couldn't seed %s from %s: %v", *flagDot, seed, err)
+	}
+	log.Printf("Seeded %s from %s", *flagDot, seed)
+}
+
+func mountCommand(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	mountOpts := addMountFlags(flags)
+	flagReadyDir := addReadyDirFlag(flags)
+	flagCommitSchedule := addCommitScheduleFlag(flags)
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	md, _, err := common.load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *mountOpts.dot == "" || *mountOpts.mountpoint == "" {
+		logger.Fatalf("-dot and -mountpoint are required")
+	}
+	if err := validateBranch(*mountOpts.branch); err != nil {
+		logger.Fatal(err)
+	}
+	if daemon := dialDaemon(*flagControlSocket); daemon != nil {
+		// The daemon's -mount-propagation applies.
+		var result DaemonMount
+		err := daemon.call("AddMount", MountRequest{
+			Dot:            *mountOpts.dot,
+			Branch:         *mountOpts.branch,
+			Mountpoint:     *mountOpts.mountpoint,
+			ReadOnly:       *mountOpts.readOnly,
+			CommitSchedule: *flagCommitSchedule,
+		}, &result)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		log.Printf("Mounted dot %s at %s", *mountOpts.dot, *mountOpts.mountpoint)
+		return
+	}
+	if *flagCommitSchedule != "" {
+		logger.Warnf("-commit-schedule needs the up daemon running to do the commits, ignoring it")
+	}
+	if err := mountOpts.setPropagation(); err != nil {
+		logger.Fatal(err)
+	}
+	adminApiKey, err := common.adminApiKey(md)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if _, err := ensureDot(adminApiKey, *mountOpts.dot); err != nil {
+		logger.Fatal(err)
+	}
+	id, err := lookupDot(adminApiKey, *mountOpts.dot, *mountOpts.branch)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if isMaster(*mountOpts.branch) {
+		if err := tagDotDataset(newExecZFS(), *common.pool, id, "admin", *mountOpts.dot); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	dotMountpoint := calculateMountpoint(*common.pool, id)
+	if err := mountDot(dotMountpoint, *mountOpts.mountpoint, *mountOpts.readOnly); err != nil {
+		logger.Fatal(err)
+	}
+	err = markReady(*flagReadyDir, DaemonMount{
+		Dot:        *mountOpts.dot,
+		Branch:     branchName(*mountOpts.branch),
+		Id:         id,
+		Mountpoint: *mountOpts.mountpoint,
+		ReadOnly:   *mountOpts.readOnly,
+	})
+	if err != nil {
+		// Undo the mount, like the daemon does.
+		if unmountErr := mounter.Unmount(*mountOpts.mountpoint); unmountErr != nil {
+			logger.Errorf("Couldn't unmount %s after failing to mark it ready: %v", *mountOpts.mountpoint, unmountErr)
+		}
+		logger.Fatal(err)
+	}
+	log.Printf("Mounted dot %s at %s", *mountOpts.dot, *mountOpts.mountpoint)
+}
+
+func unmountCommand(args []string) {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	flagMountpoint := flags.String("mountpoint", "", "Where the dot is mounted")
+	flagReadyDir := addReadyDirFlag(flags)
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+	if *flagMountpoint == "" {
+		logger.Fatalf("-mountpoint is required")
+	}
+
+	var err error
+	if daemon := dialDaemon(*flagControlSocket); daemon != nil {
+		var result bool
+		err = daemon.call("RemoveMount", UnmountRequest{Mountpoint: *flagMountpoint}, &result)
+	} else {
+		err = unmountReady(*flagReadyDir, *flagMountpoint)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	log.Printf("Unmounted %s", *flagMountpoint)
+}
+
+func commitCommand(args []string) {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	flagDot := addDotFlag(flags)
+	flagBranch := addBranchFlag(flags)
+	flagMessage := flags.String("m", "Committed by dm-linuxkit", "Commit message")
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	md, _, err := common.load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *flagDot == "" {
+		logger.Fatalf("-dot is required")
+	}
+	if err := validateBranch(*flagBranch); err != nil {
+		logger.Fatal(err)
+	}
+
+	var commitId string
+	if daemon := dialDaemon(*flagControlSocket); daemon != nil {
+		request := CommitRequest{Dot: *flagDot, Branch: *flagBranch, Message: *flagMessage}
+		err = daemon.call("Commit", request, &commitId)
+	} else {
+		var adminApiKey string
+		adminApiKey, err = common.adminApiKey(md)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		commitId, err = commitDot(adminApiKey, *flagDot, *flagBranch, *flagMessage, "cli", nil)
+	}
+	if err != nil {
+		logger.Fatalf("Couldn't commit %s: %v", *flagDot, err)
+	}
+	log.Printf("Committed %s as %s", *flagDot, commitId)
+}
+
+func pushCommand(args []string) {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	flagDot := addDotFlag(flags)
+	flagRemote := flags.String(
+		"remote", "",
+		"Address of the datadot to push to, e.g. dothub.com/justincormack/postgres",
+	)
+	seedOpts := addSeedFlags(flags)
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	md, _, err := common.load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *flagDot == "" || *flagRemote == "" {
+		logger.Fatalf("-dot and -remote are required")
+	}
+
+	credentials, err := seedOpts.credentials(md)
+	if daemon := dialDaemon(*flagControlSocket); daemon != nil {
+		// The daemon uses its own credentials if we can't find any.
+		var result bool
+		err = daemon.call("Push", TransferDotRequest{
+			Dot:         *flagDot,
+			Remote:      *flagRemote,
+			Credentials: credentials,
+		}, &result)
+	} else {
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var adminApiKey string
+		adminApiKey, err = common.adminApiKey(md)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		err = pushDot(adminApiKey, *flagDot, *flagRemote, credentials, *seedOpts.stallTimeout)
+	}
+	if err != nil {
+		logger.Fatalf("Couldn't push %s to %s: %v", *flagDot, *flagRemote, err)
+	}
+	log.Printf("Pushed %s to %s", *flagDot, *flagRemote)
+}
+
+func downCommand(args []string) {
+	flags := flag.NewFlagSet("down", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	flagPidFile := flags.String("pid-file", PID_FILE, "Where the running up daemon wrote its pid")
+	flagTimeout := flags.Duration("timeout", time.Minute, "How long to wait for it to stop")
+	flagControlSocket := addControlSocketFlag(flags)
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+
+	pid, err := stopDaemon(*flagControlSocket, *flagPidFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	log.Printf("Stopping daemon with pid %d...", pid)
+	deadline := time.Now().Add(*flagTimeout)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			logger.Fatalf("Daemon with pid %d still running after %s", pid, *flagTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("Stopped")
+}
+
+// stopDaemon asks the daemon to stop over its control API, or failing that
+// with SIGTERM, returning its pid.
+func stopDaemon(socket, pidFile string) (int, error) {
+	if daemon := dialDaemon(socket); daemon != nil {
+		var status DaemonStatus
+		err := daemon.call("Status", struct{}{}, &status)
+		if err == nil {
+			var result bool
+			err = daemon.call("Shutdown", struct{}{}, &result)
+		}
+		if err == nil {
+			return status.Pid, nil
+		}
+		logger.Warnf("Couldn't stop daemon over %s, trying its pid file: %v", socket, err)
+	}
+
+	pid, err := readPidFile(pidFile)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("No daemon running (no %s)", pidFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return 0, fmt.Errorf("Couldn't stop daemon with pid %d: %v", pid, err)
+	}
+	return pid, nil
+}
+
+func writePidFile(path string) error {
+	if err := makeDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func readPidFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("bad pid file %s: %v", path, err)
+	}
+	return pid, nil
+}
+
+// processRunning reports whether there's a process with this pid, which
+// signal 0 checks for without actually sending anything. A zombie, which has
+// exited but not been reaped by its parent yet, doesn't count.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
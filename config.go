@@ -0,0 +1,489 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dm-linuxkit/mount"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CONFIG_FILE is where LinuxKit's metadata package writes the
+// dotmesh.entries.config metadata entry.
+const CONFIG_FILE = "/run/config/dotmesh/config"
+
+// config is the config file, a YAML (or JSON, which is YAML too) description
+// of everything otherwise given as flags. Each setting fills in the flag named
+// in its comment, unless that flag is given on the command line. Settings are
+// pointers so we can tell which are in the file.
+type config struct {
+	Oneshot *bool `yaml:"oneshot"` // -oneshot
+	Recover *bool `yaml:"recover"` // -recover
+
+	Log struct {
+		Format         *string `yaml:"format"`         // -log-format
+		Level          *string `yaml:"level"`          // -log-level
+		ProcessLogs    *bool   `yaml:"processLogs"`    // -process-logs
+		ProcessLogDir  *string `yaml:"processLogDir"`  // -process-log-dir
+		ProcessLogSize *string `yaml:"processLogSize"` // -process-log-max-size
+		ProcessLogKeep *int    `yaml:"processLogKeep"` // -process-log-keep
+	} `yaml:"log"`
+
+	Pool struct {
+		Name                *string        `yaml:"name"`                // -pool-name
+		Devices             []string       `yaml:"devices"`             // -storage-device
+		AllowAddDevices     *bool          `yaml:"allowAddDevices"`     // -allow-add-devices
+		GrowFiles           *bool          `yaml:"growFiles"`           // -grow-files
+		HealthCheckInterval *time.Duration `yaml:"healthCheckInterval"` // -health-check-interval
+		ScrubInterval       *time.Duration `yaml:"scrubInterval"`       // -scrub-interval
+	} `yaml:"pool"`
+
+	Etcd struct {
+		DataDir        *string        `yaml:"dataDir"`        // -etcd-data-dir
+		Reservation    *string        `yaml:"reservation"`    // -etcd-reservation
+		BackupInterval *time.Duration `yaml:"backupInterval"` // -etcd-backup-interval
+		BackupDir      *string        `yaml:"backupDir"`      // -etcd-backup-dir
+		BackupKeep     *int           `yaml:"backupKeep"`     // -etcd-backup-keep
+		BackupQuota    *string        `yaml:"backupQuota"`    // -etcd-backup-quota
+	} `yaml:"etcd"`
+
+	Dotmesh struct {
+		Address           *string `yaml:"address"`           // -dotmesh-address
+		AdminApiKeyFile   *string `yaml:"adminApiKeyFile"`   // -admin-api-key-file
+		AdminPasswordFile *string `yaml:"adminPasswordFile"` // -admin-password-file
+		MountPropagation  *string `yaml:"mountPropagation"`  // -mount-propagation
+	} `yaml:"dotmesh"`
+
+	Dot struct {
+		Name               *string `yaml:"name"`               // -dot
+		Branch             *string `yaml:"branch"`             // -branch
+		Mountpoint         *string `yaml:"mountpoint"`         // -mountpoint
+		ReadOnly           *bool   `yaml:"readOnly"`           // -ro
+		Commit             *string `yaml:"commit"`             // -commit
+		CommitMountpoint   *string `yaml:"commitMountpoint"`   // -commit-mountpoint
+		ImportExisting     *bool   `yaml:"importExisting"`     // -import-existing
+		Owner              *string `yaml:"owner"`              // -owner
+		Group              *string `yaml:"group"`              // -group
+		Mode               *string `yaml:"mode"`               // -mode
+		EnforcePermissions *bool   `yaml:"enforcePermissions"` // -enforce-permissions
+		Quota              *string `yaml:"quota"`              // -quota
+		Refquota           *string `yaml:"refquota"`           // -refquota
+		CommitSchedule     *string `yaml:"commitSchedule"`     // -commit-schedule
+		// Properties are other ZFS properties to set on the dot's dataset on
+		// every boot, e.g. compression: lz4. There's no flag for these.
+		Properties map[string]string `yaml:"properties"`
+
+		Seed struct {
+			From            *string        `yaml:"from"`            // -seed
+			File            *string        `yaml:"file"`            // -seed-file
+			CredentialsFile *string        `yaml:"credentialsFile"` // -credentials-file
+			StallTimeout    *time.Duration `yaml:"stallTimeout"`    // -transfer-stall-timeout
+		} `yaml:"seed"`
+	} `yaml:"dot"`
+
+	// Dots are more dots for up to mount alongside dot. There are no flags
+	// for these.
+	Dots []dotConfig `yaml:"dots"`
+}
+
+// dotConfig is one of the config file's dots. Unlike dot, these are only
+// created, never seeded or imported into.
+type dotConfig struct {
+	Name           string            `yaml:"name"`
+	Branch         string            `yaml:"branch"`
+	Mountpoint     string            `yaml:"mountpoint"`
+	ReadOnly       bool              `yaml:"readOnly"`
+	Quota          string            `yaml:"quota"`
+	Refquota       string            `yaml:"refquota"`
+	CommitSchedule string            `yaml:"commitSchedule"`
+	Properties     map[string]string `yaml:"properties"`
+}
+
+func (d dotConfig) mount() DaemonMount {
+	return DaemonMount{
+		Dot:            d.Name,
+		Branch:         branchName(d.Branch),
+		Mountpoint:     d.Mountpoint,
+		ReadOnly:       d.ReadOnly,
+		CommitSchedule: d.CommitSchedule,
+	}
+}
+
+// configError is a setting with a value that's wrong.
+type configError struct {
+	setting string // e.g. dot.quota or dots[1].name
+	err     error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %v", e.setting, e.err)
+}
+
+// parseConfig parses a config file strictly: unknown settings and values of
+// the wrong type are errors, which yaml gives line numbers for. We find the
+// lines of settings validate rejects ourselves.
+func parseConfig(data []byte) (*config, error) {
+	c := &config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		if e, ok := err.(*configError); ok {
+			if line := settingLine(data, e.setting); line > 0 {
+				return nil, fmt.Errorf("line %d: %v", line, e)
+			}
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadConfig reads the config file at path, or the config entry of m if we
+// have metadata. A missing file is only an error if required, i.e. someone
+// asked for it with -config.
+func loadConfig(m metadata, path string, required bool) (*config, error) {
+	data, err := m.read("config", path)
+	if os.IsNotExist(err) && !required {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(data)
+	if err != nil {
+		if m != nil {
+			path = "metadata dotmesh.entries.config"
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// validate checks the values yaml can't, returning a configError naming the
+// setting that's wrong.
+func (c *config) validate() error {
+	bad := func(setting string, err error) error {
+		return &configError{setting: setting, err: err}
+	}
+	if c.Pool.Devices != nil {
+		if _, err := parseStorageDevices(strings.Join(c.Pool.Devices, ",")); err != nil {
+			return bad("pool.devices", err)
+		}
+	}
+	// In a slice, not a map, so that the first bad size is always the one
+	// reported.
+	type size struct {
+		name  string
+		value *string
+	}
+	sizes := []size{
+		{"log.processLogSize", c.Log.ProcessLogSize},
+		{"etcd.reservation", c.Etcd.Reservation},
+		{"etcd.backupQuota", c.Etcd.BackupQuota},
+		{"dot.quota", c.Dot.Quota},
+		{"dot.refquota", c.Dot.Refquota},
+	}
+	for i := range c.Dots {
+		sizes = append(
+			sizes,
+			size{fmt.Sprintf("dots[%d].quota", i), &c.Dots[i].Quota},
+			size{fmt.Sprintf("dots[%d].refquota", i), &c.Dots[i].Refquota},
+		)
+	}
+	for _, s := range sizes {
+		if s.value == nil || *s.value == "" || strings.ToLower(*s.value) == "none" {
+			continue
+		}
+		if _, err := parseSize(*s.value); err != nil {
+			return bad(s.name, err)
+		}
+	}
+	if c.Dotmesh.MountPropagation != nil {
+		if _, err := mount.ParsePropagation(*c.Dotmesh.MountPropagation); err != nil {
+			return bad("dotmesh.mountPropagation", err)
+		}
+	}
+	if c.Dot.Branch != nil {
+		if err := validateBranch(*c.Dot.Branch); err != nil {
+			return bad("dot.branch", err)
+		}
+	}
+	if c.Dot.Mode != nil {
+		if _, err := parseMode(*c.Dot.Mode); err != nil {
+			return bad("dot.mode", err)
+		}
+	}
+	if c.Dot.Commit != nil {
+		if err := validateCommitId(*c.Dot.Commit); err != nil {
+			return bad("dot.commit", err)
+		}
+	}
+	if c.Dot.CommitSchedule != nil {
+		if _, err := parseCommitSchedule(*c.Dot.CommitSchedule); err != nil {
+			return bad("dot.commitSchedule", err)
+		}
+	}
+	for name := range c.Dot.Properties {
+		if name == "" || strings.Contains(name, "=") {
+			return bad("dot.properties", fmt.Errorf("bad property name %q", name))
+		}
+	}
+	if err := c.validateDots(); err != nil {
+		return err
+	}
+	if c.Log.Format != nil && *c.Log.Format != "text" && *c.Log.Format != "json" {
+		return bad("log.format", fmt.Errorf("should be text or json, not %q", *c.Log.Format))
+	}
+	if c.Log.Level != nil {
+		if _, err := parseLogLevel(*c.Log.Level); err != nil {
+			return bad("log.level", err)
+		}
+	}
+	if c.Etcd.BackupKeep != nil && *c.Etcd.BackupKeep < 1 {
+		return bad("etcd.backupKeep", fmt.Errorf("must be at least 1"))
+	}
+	return nil
+}
+
+// validateDots checks the dots list. Each needs a name and a mountpoint of
+// its own, and a dot can only be committed on one schedule.
+func (c *config) validateDots() error {
+	mountpoints := map[string]string{}
+	if c.Dot.Mountpoint != nil {
+		mountpoints[*c.Dot.Mountpoint] = "dot.mountpoint"
+	}
+	if c.Dot.CommitMountpoint != nil {
+		mountpoints[*c.Dot.CommitMountpoint] = "dot.commitMountpoint"
+	}
+	scheduled := map[scheduleKey]string{}
+	if c.Dot.Name != nil && c.Dot.CommitSchedule != nil {
+		branch := ""
+		if c.Dot.Branch != nil {
+			branch = *c.Dot.Branch
+		}
+		scheduled[newScheduleKey(*c.Dot.Name, branch)] = "dot.commitSchedule"
+	}
+	for i, d := range c.Dots {
+		setting := fmt.Sprintf("dots[%d]", i)
+		bad := func(name string, err error) error {
+			return &configError{setting: setting + "." + name, err: err}
+		}
+		if d.Name == "" {
+			return &configError{setting: setting, err: fmt.Errorf("name is required")}
+		}
+		if d.Mountpoint == "" {
+			return &configError{setting: setting, err: fmt.Errorf("mountpoint is required")}
+		}
+		if other, ok := mountpoints[d.Mountpoint]; ok {
+			return bad("mountpoint", fmt.Errorf("%s is already %s", d.Mountpoint, other))
+		}
+		mountpoints[d.Mountpoint] = setting + ".mountpoint"
+		if err := validateBranch(d.Branch); err != nil {
+			return bad("branch", err)
+		}
+		if d.CommitSchedule != "" {
+			if _, err := parseCommitSchedule(d.CommitSchedule); err != nil {
+				return bad("commitSchedule", err)
+			}
+			key := newScheduleKey(d.Name, d.Branch)
+			if other, ok := scheduled[key]; ok {
+				return bad("commitSchedule", fmt.Errorf("%s is already committed on %s", key, other))
+			}
+			scheduled[key] = setting + ".commitSchedule"
+		}
+		for name := range d.Properties {
+			if name == "" || strings.Contains(name, "=") {
+				return bad("properties", fmt.Errorf("bad property name %q", name))
+			}
+		}
+	}
+	return nil
+}
+
+// yamlLine is a line of a YAML file that isn't blank or a comment.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+func splitYAMLLines(data []byte) []yamlLine {
+	var lines []yamlLine
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(line) - len(text), text: text})
+	}
+	return lines
+}
+
+// settingLine finds the line of setting, e.g. dots[1].quota, in a config file
+// written as indented YAML, or the line of as much of it as it can. It's 0 if
+// the file's something else, e.g. JSON.
+func settingLine(data []byte, setting string) int {
+	lines := splitYAMLLines(data)
+	number := 0
+	path := strings.FieldsFunc(setting, func(r rune) bool {
+		return r == '.' || r == '[' || r == ']'
+	})
+	for _, part := range path {
+		if len(lines) == 0 {
+			break
+		}
+		indent := lines[0].indent
+		found := -1
+		index, err := strconv.Atoi(part)
+		isItem := err == nil
+		for i, l := range lines {
+			if l.indent != indent {
+				continue
+			}
+			if isItem && (l.text == "-" || strings.HasPrefix(l.text, "- ")) {
+				if index == 0 {
+					found = i
+					break
+				}
+				index--
+			} else if !isItem && yamlKey(l.text) == part {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			break
+		}
+		l := lines[found]
+		number = l.number
+		// What's nested under the line, including a list at the same
+		// indent as its key.
+		end := found + 1
+		for end < len(lines) && (lines[end].indent > l.indent ||
+			!isItem && lines[end].indent == l.indent && strings.HasPrefix(lines[end].text, "- ")) {
+			end++
+		}
+		nested := lines[found+1 : end]
+		if isItem {
+			// The item's first setting is on the same line as its "- ".
+			first := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+			if first != "" {
+				item := yamlLine{number: l.number, indent: l.indent + len(l.text) - len(first), text: first}
+				nested = append([]yamlLine{item}, nested...)
+			}
+		}
+		lines = nested
+	}
+	return number
+}
+
+// yamlKey is the key of a "key: value" line, or "" if it's not one.
+func yamlKey(text string) string {
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.Trim(text[:i], `"'`)
+		}
+	}
+	return ""
+}
+
+// flagValues returns the settings in the file as flag name -> value.
+func (c *config) flagValues() map[string]string {
+	values := map[string]string{}
+	setString := func(name string, v *string) {
+		if v != nil {
+			values[name] = *v
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			values[name] = strconv.FormatBool(*v)
+		}
+	}
+	setDuration := func(name string, v *time.Duration) {
+		if v != nil {
+			values[name] = v.String()
+		}
+	}
+
+	setBool("oneshot", c.Oneshot)
+	setBool("recover", c.Recover)
+
+	setString("log-format", c.Log.Format)
+	setString("log-level", c.Log.Level)
+	setBool("process-logs", c.Log.ProcessLogs)
+	setString("process-log-dir", c.Log.ProcessLogDir)
+	setString("process-log-max-size", c.Log.ProcessLogSize)
+	if c.Log.ProcessLogKeep != nil {
+		values["process-log-keep"] = strconv.Itoa(*c.Log.ProcessLogKeep)
+	}
+
+	setString("pool-name", c.Pool.Name)
+	if c.Pool.Devices != nil {
+		values["storage-device"] = strings.Join(c.Pool.Devices, ",")
+	}
+	setBool("allow-add-devices", c.Pool.AllowAddDevices)
+	setBool("grow-files", c.Pool.GrowFiles)
+	setDuration("health-check-interval", c.Pool.HealthCheckInterval)
+	setDuration("scrub-interval", c.Pool.ScrubInterval)
+
+	setString("etcd-data-dir", c.Etcd.DataDir)
+	setString("etcd-reservation", c.Etcd.Reservation)
+	setDuration("etcd-backup-interval", c.Etcd.BackupInterval)
+	setString("etcd-backup-dir", c.Etcd.BackupDir)
+	if c.Etcd.BackupKeep != nil {
+		values["etcd-backup-keep"] = strconv.Itoa(*c.Etcd.BackupKeep)
+	}
+	setString("etcd-backup-quota", c.Etcd.BackupQuota)
+
+	setString("dotmesh-address", c.Dotmesh.Address)
+	setString("admin-api-key-file", c.Dotmesh.AdminApiKeyFile)
+	setString("admin-password-file", c.Dotmesh.AdminPasswordFile)
+	setString("mount-propagation", c.Dotmesh.MountPropagation)
+
+	setString("dot", c.Dot.Name)
+	setString("branch", c.Dot.Branch)
+	setString("mountpoint", c.Dot.Mountpoint)
+	setBool("ro", c.Dot.ReadOnly)
+	setString("commit", c.Dot.Commit)
+	setString("commit-mountpoint", c.Dot.CommitMountpoint)
+	setBool("import-existing", c.Dot.ImportExisting)
+	setString("owner", c.Dot.Owner)
+	setString("group", c.Dot.Group)
+	setString("mode", c.Dot.Mode)
+	setBool("enforce-permissions", c.Dot.EnforcePermissions)
+	setString("quota", c.Dot.Quota)
+	setString("refquota", c.Dot.Refquota)
+	setString("commit-schedule", c.Dot.CommitSchedule)
+
+	setString("seed", c.Dot.Seed.From)
+	setString("seed-file", c.Dot.Seed.File)
+	setString("credentials-file", c.Dot.Seed.CredentialsFile)
+	setDuration("transfer-stall-timeout", c.Dot.Seed.StallTimeout)
+	return values
+}
+
+// applyTo sets the flags in flags from the config file, except those given
+// on the command line, which win. Settings for flags the subcommand doesn't
+// take are ignored.
+func (c *config) applyTo(flags *flag.FlagSet) error {
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range c.flagValues() {
+		if given[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("can't set -%s from config file: %v", name, err)
+		}
+	}
+	return nil
+}
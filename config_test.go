@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exampleConfig = `
+oneshot: true
+pool:
+  name: dotmesh-pool
+  devices:
+    - /dev/sda
+    - file:/var/lib/dm/pool.img:10G
+  scrubInterval: 720h
+etcd:
+  reservation: 256M
+dot:
+  name: postgres
+  mountpoint: /var/lib/postgres
+  owner: 999
+  mode: 0700
+  quota: 10G
+  commitSchedule: "0 3 * * *"
+  properties:
+    compression: lz4
+  seed:
+    from: dothub.com/justincormack/postgres
+dots:
+  - name: uploads
+    mountpoint: /var/lib/uploads
+    quota: 1G
+  - name: postgres
+    branch: reporting
+    mountpoint: /var/lib/reporting
+    readOnly: true
+`
+
+// testFlags is a FlagSet with some of the flags the config file sets, like a
+// subcommand's.
+func testFlags() (*flag.FlagSet, map[string]interface{}) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := map[string]interface{}{
+		"oneshot":         flags.Bool("oneshot", false, ""),
+		"pool-name":       flags.String("pool-name", "pool", ""),
+		"storage-device":  flags.String("storage-device", "", ""),
+		"scrub-interval":  flags.Duration("scrub-interval", 0, ""),
+		"dot":             flags.String("dot", "", ""),
+		"mountpoint":      flags.String("mountpoint", "", ""),
+		"mode":            flags.String("mode", "", ""),
+		"seed":            flags.String("seed", "", ""),
+		"commit-schedule": flags.String("commit-schedule", "", ""),
+	}
+	return flags, values
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(exampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c.Dot.Mode != "0700" {
+		t.Errorf("expected mode 0700 as written, got %s", *c.Dot.Mode)
+	}
+	if *c.Dot.Owner != "999" {
+		t.Errorf("expected owner 999, got %s", *c.Dot.Owner)
+	}
+	if c.Dot.Properties["compression"] != "lz4" {
+		t.Errorf("expected compression=lz4, got %v", c.Dot.Properties)
+	}
+	expected := []DaemonMount{
+		{Dot: "uploads", Mountpoint: "/var/lib/uploads"},
+		{Dot: "postgres", Branch: "reporting", Mountpoint: "/var/lib/reporting", ReadOnly: true},
+	}
+	if len(c.Dots) != len(expected) {
+		t.Fatalf("expected %d dots, got %v", len(expected), c.Dots)
+	}
+	for i, d := range c.Dots {
+		if d.mount() != expected[i] {
+			t.Errorf("expected dots[%d] to be %+v, got %+v", i, expected[i], d.mount())
+		}
+	}
+
+	flags, values := testFlags()
+	if err := flags.Parse([]string{"-dot=mysql", "-mode=0755"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.applyTo(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !*values["oneshot"].(*bool) {
+		t.Errorf("oneshot not set from config")
+	}
+	if v := *values["storage-device"].(*string); v != "/dev/sda,file:/var/lib/dm/pool.img:10G" {
+		t.Errorf("unexpected storage-device %s", v)
+	}
+	if v := *values["scrub-interval"].(*time.Duration); v != 720*time.Hour {
+		t.Errorf("unexpected scrub-interval %s", v)
+	}
+	if v := *values["seed"].(*string); v != "dothub.com/justincormack/postgres" {
+		t.Errorf("unexpected seed %s", v)
+	}
+	if v := *values["commit-schedule"].(*string); v != "0 3 * * *" {
+		t.Errorf("unexpected commit-schedule %s", v)
+	}
+	// The command line wins.
+	if v := *values["dot"].(*string); v != "mysql" {
+		t.Errorf("expected -dot from the command line, got %s", v)
+	}
+	if v := *values["mode"].(*string); v != "0755" {
+		t.Errorf("expected -mode from the command line, got %s", v)
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	c, err := parseConfig([]byte(`{"pool": {"name": "p", "devices": ["/dev/sdb"]}, "dot": {"name": "d"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := c.flagValues()
+	if values["pool-name"] != "p" || values["storage-device"] != "/dev/sdb" || values["dot"] != "d" {
+		t.Errorf("unexpected values %v", values)
+	}
+	if _, ok := values["oneshot"]; ok {
+		t.Errorf("oneshot set although it's not in the file")
+	}
+
+	// We can't find lines in JSON, so just name the setting.
+	_, err = parseConfig([]byte(`{"dot": {"quota": "lots"}}`))
+	if err == nil || !strings.HasPrefix(err.Error(), "dot.quota: ") {
+		t.Errorf("expected a dot.quota error without a line, got %v", err)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config   string
+		expected string
+	}{
+		{"pool:\n  name: p\n  devcies: [/dev/sda]\n", "line 3: field devcies not found"},
+		{"oneshot: yes please\n", "line 1: cannot unmarshal"},
+		{"pool:\n  scrubInterval: weekly\n", "line 2"},
+		{"pool: [\n", "line 1"},
+		{"dot:\n  quota: lots\n", "line 2: dot.quota"},
+		{"etcd:\n  reservation: lots\ndot:\n  quota: lots\n  refquota: lots\n", "line 2: etcd.reservation"},
+		{"dot:\n  name: d\n  # comment\n\n  mode: rwx\n", "line 5: dot.mode"},
+		{"pool:\n  devices: [\"file:\"]\n", "line 2: pool.devices"},
+		{"dotmesh:\n  mountPropagation: sideways\n", "line 2: dotmesh.mountPropagation"},
+		{"etcd:\n  backupKeep: 0\n", "line 2: etcd.backupKeep"},
+		{"dot:\n  commitSchedule: hourly\n", "line 2: dot.commitSchedule"},
+		{"dot:\n  commit: ../../etc\n", "line 2: dot.commit"},
+		{"dot:\n  branch: -b\n", "line 2: dot.branch"},
+		{"dots:\n- name: a\n  mountpoint: /a\n- name: b\n  mountpoint: /b\n  quota: lots\n", "line 6: dots[1].quota"},
+		{"dots:\n  - name: a\n    mountpoint: /a\n  - mountpoint: /b\n", "line 4: dots[1]: name is required"},
+		{"dots:\n  - name: a\n", "line 2: dots[0]: mountpoint is required"},
+		{"dot:\n  mountpoint: /a\ndots:\n  - name: a\n    mountpoint: /a\n", "line 5: dots[0].mountpoint: /a is already dot.mountpoint"},
+		{"dots:\n  - name: a\n    mountpoint: /a\n    branch: x/y\n", "line 4: dots[0].branch"},
+		{"dot:\n  name: a\n  commitSchedule: \"@daily\"\ndots:\n  - {name: a, mountpoint: /a, commitSchedule: \"@hourly\"}\n", "line 5: dots[0].commitSchedule: a is already committed on dot.commitSchedule"},
+		{"dots:\n  - {name: a, branch: b, mountpoint: /a, commitSchedule: \"@daily\"}\n  - {name: a, branch: b, mountpoint: /b, commitSchedule: \"@hourly\"}\n", "line 3: dots[1].commitSchedule: branch b of a is already committed on dots[0].commitSchedule"},
+	} {
+		_, err := parseConfig([]byte(tc.config))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", tc.config)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected an error containing %q parsing %q, got %v", tc.expected, tc.config, err)
+		}
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	if _, err := loadConfig(nil, dir+"/config", false); err != nil {
+		t.Errorf("a missing default config should be fine, got %v", err)
+	}
+	if _, err := loadConfig(nil, dir+"/config", true); err == nil {
+		t.Errorf("expected an error for a missing config asked for with -config")
+	}
+}
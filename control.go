@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+// CONTROL_SOCKET is where a running `dm-linuxkit up` daemon serves its control
+// API, JSON-RPC over HTTP like dotmesh's own, for the other subcommands and
+// provisioning scripts.
+const CONTROL_SOCKET = "/run/dotmesh/dm-linuxkit.sock"
+
+// The control API's argument and result types are exported because
+// gorilla/rpc only registers methods whose argument types are.
+
+// DaemonStatus is what ControlRPC.Status returns.
+type DaemonStatus struct {
+	Pid        int
+	Started    time.Time
+	Pool       string
+	PoolHealth string // as of the last health check, "" before the first
+	Mounts     []DaemonMount
+	Schedules  []DaemonSchedule
+}
+
+// DaemonMount is a dot the daemon has mounted for ControlRPC.AddMount.
+type DaemonMount struct {
+	Dot            string
+	Branch         string `json:",omitempty"` // "" for master
+	Id             string
+	Mountpoint     string
+	ReadOnly       bool
+	CommitSchedule string `json:",omitempty"`
+}
+
+// MountRequest asks for a dot to be mounted. If CommitSchedule is set, it's
+// committed on that schedule, like up's -commit-schedule, until unmounted.
+type MountRequest struct {
+	Dot            string
+	Branch         string // "" for master
+	Mountpoint     string
+	ReadOnly       bool
+	CommitSchedule string
+}
+
+type UnmountRequest struct {
+	Mountpoint string
+}
+
+// TransferDotRequest asks for a seed (pull) or push of Dot. Remote is like
+// -seed, e.g. dothub.com/justincormack/postgres. Credentials default to the
+// daemon's -credentials-file.
+type TransferDotRequest struct {
+	Dot         string
+	Remote      string
+	Credentials string
+}
+
+type CommitRequest struct {
+	Dot     string
+	Branch  string // "" for master
+	Message string
+}
+
+// controlDaemon is the state the control API works on.
+type controlDaemon struct {
+	zfs          ZFS
+	pool         string
+	adminApiKey  string
+	credentials  func() (string, error)
+	stallTimeout time.Duration
+	monitor      *poolMonitor
+	readyDir     string
+	started      time.Time
+
+	mu        sync.Mutex
+	mounts    map[string]DaemonMount            // by mountpoint
+	mounting  map[string]bool                   // mountpoints AddMount is working on
+	schedules map[scheduleKey]*scheduledCommits // by dot and branch
+
+	shutdown     chan struct{} // closed when asked to shut down
+	shutdownOnce sync.Once
+}
+
+func newControlDaemon(
+	zfs ZFS, pool, adminApiKey string, credentials func() (string, error),
+	stallTimeout time.Duration, monitor *poolMonitor, readyDir string,
+) *controlDaemon {
+	return &controlDaemon{
+		zfs:          zfs,
+		pool:         pool,
+		adminApiKey:  adminApiKey,
+		credentials:  credentials,
+		stallTimeout: stallTimeout,
+		monitor:      monitor,
+		readyDir:     readyDir,
+		started:      time.Now(),
+		mounts:       map[string]DaemonMount{},
+		mounting:     map[string]bool{},
+		schedules:    map[scheduleKey]*scheduledCommits{},
+		shutdown:     make(chan struct{}),
+	}
+}
+
+// adoptMounts makes mounts, which up made when it was -oneshot (the -dot and
+// the config file's dots), the daemon's, as if they'd been mounted with
+// AddMount, so that status, metrics and RemoveMount know about them too.
+func (d *controlDaemon) adoptMounts(mounts []DaemonMount) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range mounts {
+		if m.Id == "" {
+			id, err := lookupDot(d.adminApiKey, m.Dot, m.Branch)
+			if err != nil {
+				logger.Warnf("Couldn't find dot %s mounted at %s: %v", m.Dot, m.Mountpoint, err)
+			}
+			m.Id = id
+		}
+		d.mounts[m.Mountpoint] = m
+	}
+}
+
+// serve serves the control API on a UNIX socket at path until the listener
+// it returns is closed. Only root can connect.
+func (d *controlDaemon) serve(path string) (net.Listener, error) {
+	server := rpc.NewServer()
+	server.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := server.RegisterService(&ControlRPC{d}, "ControlRPC"); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", server)
+
+	if err := makeDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	// A socket left behind by a daemon that didn't exit cleanly would stop
+	// us listening.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Make the socket with the right permissions, rather than chmod it once
+	// it's there and anyone could have connected. The umask is the whole
+	// process's, but it's only changed for as long as Listen takes.
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(listener, mux)
+	log.Printf("Serving control API on %s", path)
+	return listener, nil
+}
+
+// ControlRPC is the control API.
+type ControlRPC struct {
+	d *controlDaemon
+}
+
+func (c *ControlRPC) Status(r *http.Request, args *struct{}, result *DaemonStatus) error {
+	d := c.d
+	*result = DaemonStatus{
+		Pid:        os.Getpid(),
+		Started:    d.started,
+		Pool:       d.pool,
+		PoolHealth: d.monitor.Last().Health,
+		Schedules:  d.scheduleStatuses(),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range d.mounts {
+		result.Mounts = append(result.Mounts, m)
+	}
+	sort.Slice(result.Mounts, func(i, j int) bool {
+		return result.Mounts[i].Mountpoint < result.Mounts[j].Mountpoint
+	})
+	return nil
+}
+
+// AddMount mounts a dot, creating it if need be, like `dm-linuxkit mount`.
+func (c *ControlRPC) AddMount(r *http.Request, args *MountRequest, result *DaemonMount) error {
+	d := c.d
+	if args.Dot == "" || args.Mountpoint == "" {
+		return fmt.Errorf("Dot and Mountpoint are required")
+	}
+	// Reserve the mountpoint, so two requests for it at once can't both mount
+	// something there.
+	d.mu.Lock()
+	existing, ok := d.mounts[args.Mountpoint]
+	mounting := d.mounting[args.Mountpoint]
+	if !ok && !mounting {
+		d.mounting[args.Mountpoint] = true
+	}
+	d.mu.Unlock()
+	if ok {
+		return fmt.Errorf("dot %s is already mounted at %s", existing.Dot, args.Mountpoint)
+	}
+	if mounting {
+		return fmt.Errorf("a dot is already being mounted at %s", args.Mountpoint)
+	}
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.mounting, args.Mountpoint)
+	}()
+
+	var schedule *commitSchedule
+	if args.CommitSchedule != "" {
+		var err error
+		if schedule, err = parseCommitSchedule(args.CommitSchedule); err != nil {
+			return err
+		}
+	}
+
+	if _, err := ensureDot(d.adminApiKey, args.Dot); err != nil {
+		return err
+	}
+	id, err := lookupDot(d.adminApiKey, args.Dot, args.Branch)
+	if err != nil {
+		return err
+	}
+	if isMaster(args.Branch) {
+		if err := tagDotDataset(d.zfs, d.pool, id, "admin", args.Dot); err != nil {
+			return err
+		}
+	}
+	if schedule != nil {
+		if err := d.scheduleCommits(args.Dot, args.Branch, schedule); err != nil {
+			return err
+		}
+	}
+	if err := mountDot(calculateMountpoint(d.pool, id), args.Mountpoint, args.ReadOnly); err != nil {
+		if schedule != nil {
+			d.unscheduleCommits(args.Dot, args.Branch)
+		}
+		return err
+	}
+
+	*result = DaemonMount{
+		Dot:            args.Dot,
+		Branch:         branchName(args.Branch),
+		Id:             id,
+		Mountpoint:     args.Mountpoint,
+		ReadOnly:       args.ReadOnly,
+		CommitSchedule: args.CommitSchedule,
+	}
+	if err := markReady(d.readyDir, *result); err != nil {
+		// Undo the mount, so it can be tried again.
+		if unmountErr := mounter.Unmount(args.Mountpoint); unmountErr != nil {
+			logger.Errorf("Couldn't unmount %s after failing to mark it ready: %v", args.Mountpoint, unmountErr)
+		}
+		if schedule != nil {
+			d.unscheduleCommits(args.Dot, args.Branch)
+		}
+		return err
+	}
+	log.Printf("Mounted dot %s at %s", args.Dot, args.Mountpoint)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mounts[args.Mountpoint] = *result
+	return nil
+}
+
+// RemoveMount unmounts a dot mounted with AddMount.
+func (c *ControlRPC) RemoveMount(r *http.Request, args *UnmountRequest, result *bool) error {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.mounts[args.Mountpoint]
+	if !ok {
+		return fmt.Errorf("no dot mounted at %s", args.Mountpoint)
+	}
+	if err := unmountReady(d.readyDir, args.Mountpoint); err != nil {
+		return err
+	}
+	delete(d.mounts, args.Mountpoint)
+	if m.CommitSchedule != "" {
+		d.unscheduleLocked(newScheduleKey(m.Dot, m.Branch))
+	}
+	log.Printf("Unmounted dot %s from %s", m.Dot, args.Mountpoint)
+	*result = true
+	return nil
+}
+
+// Seed pulls a dot from a remote, returning once the transfer's finished.
+func (c *ControlRPC) Seed(r *http.Request, args *TransferDotRequest, result *bool) error {
+	credentials, err := c.d.transferCredentials(args)
+	if err != nil {
+		return err
+	}
+	err = seedDot(c.d.adminApiKey, args.Dot, args.Remote, credentials, c.d.stallTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Seeded %s from %s", args.Dot, args.Remote)
+	*result = true
+	return nil
+}
+
+// Push pushes a dot to a remote, returning once the transfer's finished.
+func (c *ControlRPC) Push(r *http.Request, args *TransferDotRequest, result *bool) error {
+	credentials, err := c.d.transferCredentials(args)
+	if err != nil {
+		return err
+	}
+	err = pushDot(c.d.adminApiKey, args.Dot, args.Remote, credentials, c.d.stallTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushed %s to %s", args.Dot, args.Remote)
+	*result = true
+	return nil
+}
+
+func (d *controlDaemon) transferCredentials(args *TransferDotRequest) (string, error) {
+	if args.Dot == "" || args.Remote == "" {
+		return "", fmt.Errorf("Dot and Remote are required")
+	}
+	if args.Credentials != "" {
+		return args.Credentials, nil
+	}
+	return d.credentials()
+}
+
+// Commit commits a dot, returning the commit's ID.
+func (c *ControlRPC) Commit(r *http.Request, args *CommitRequest, result *string) error {
+	if args.Dot == "" {
+		return fmt.Errorf("Dot is required")
+	}
+	if err := validateBranch(args.Branch); err != nil {
+		return err
+	}
+	message := args.Message
+	if message == "" {
+		message = "Committed by dm-linuxkit"
+	}
+	commitId, err := commitDot(c.d.adminApiKey, args.Dot, args.Branch, message, "control", nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Committed %s as %s", args.Dot, commitId)
+	*result = commitId
+	return nil
+}
+
+// Shutdown asks the daemon to stop dotmesh and etcd and exit, like
+// `dm-linuxkit down`. It returns straight away.
+func (c *ControlRPC) Shutdown(r *http.Request, args *struct{}, result *bool) error {
+	c.d.shutdownOnce.Do(func() {
+		close(c.d.shutdown)
+	})
+	*result = true
+	return nil
+}
+
+// controlClient talks to a running daemon's control API.
+type controlClient struct {
+	socket string
+	client *http.Client
+}
+
+// dialDaemon returns a client for the daemon's control API at socket, or nil
+// if there's no daemon serving it: the socket isn't there, or nothing's
+// listening on it, as when a daemon was killed and left it behind. If it
+// can't tell (e.g. we're not allowed to connect), it returns a client, so the
+// caller reports the error rather than doing the daemon's work behind its
+// back.
+func dialDaemon(socket string) *controlClient {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err == nil {
+		conn.Close()
+	} else if noDaemon(err) {
+		return nil
+	}
+	return &controlClient{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// noDaemon reports whether err, from dialing the control socket, means
+// there's no daemon listening on it.
+func noDaemon(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if syscallErr, ok := err.(*os.SyscallError); ok {
+		err = syscallErr.Err
+	}
+	return err == syscall.ECONNREFUSED || err == syscall.ENOENT
+}
+
+func (c *controlClient) call(method string, args interface{}, result interface{}) error {
+	message, err := json2.EncodeClientRequest("ControlRPC."+method, args)
+	if err != nil {
+		return err
+	}
+	// The host is ignored, we always dial the socket.
+	resp, err := c.client.Post("http://dm-linuxkit/rpc", "application/json", bytes.NewBuffer(message))
+	if err != nil {
+		return fmt.Errorf("can't reach the daemon at %s: %v", c.socket, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error reading body: %s", err)
+	}
+	return json2.DecodeClientResponse(bytes.NewBuffer(b), result)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"dm-linuxkit/mount"
+)
+
+func TestDialDaemon(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	socket := filepath.Join(dir, "control.sock")
+
+	if daemon := dialDaemon(socket); daemon != nil {
+		t.Errorf("expected no daemon with no socket")
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if daemon := dialDaemon(socket); daemon == nil {
+		t.Errorf("expected a daemon while something's listening")
+	}
+
+	// A daemon that was killed leaves its socket behind.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("expected the socket to be left behind: %v", err)
+	}
+	if daemon := dialDaemon(socket); daemon != nil {
+		t.Errorf("expected no daemon with nothing listening on the socket")
+	}
+}
+
+func newTestControlDaemon(h *harness) (*controlDaemon, *fakeZFS) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = nil
+	monitor := newPoolMonitor(zfs, "pool", time.Minute, 0)
+	d := newControlDaemon(
+		zfs, "pool", "apikey", func() (string, error) { return "", nil },
+		time.Minute, monitor, filepath.Join(h.dir, "ready"),
+	)
+	return d, zfs
+}
+
+func TestAddMountReservesMountpoint(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	d, zfs := newTestControlDaemon(h)
+	c := &ControlRPC{d}
+	mountpoint := filepath.Join(h.dir, "mnt", "test")
+
+	// Another request is part way through mounting there.
+	d.mounting[mountpoint] = true
+	var result DaemonMount
+	err := c.AddMount(nil, &MountRequest{Dot: "test", Mountpoint: mountpoint}, &result)
+	if err == nil || !strings.Contains(err.Error(), "already being mounted") {
+		t.Fatalf("expected an already being mounted error, got %v", err)
+	}
+	if mounts := fakeMounter.Mounts(); len(mounts) != 0 {
+		t.Errorf("expected nothing to be mounted, got %v", mounts)
+	}
+	delete(d.mounting, mountpoint)
+
+	// A failed mount gives the mountpoint up again.
+	zfs.filesystems["pool/dmfs/fs-test"] = true
+	zfs.errors["SetProperty"] = os.ErrPermission
+	err = c.AddMount(nil, &MountRequest{Dot: "test", Mountpoint: mountpoint}, &result)
+	if err == nil {
+		t.Fatal("expected tagging the dataset to fail")
+	}
+	if d.mounting[mountpoint] {
+		t.Errorf("mountpoint still reserved after a failed mount")
+	}
+
+	delete(zfs.errors, "SetProperty")
+	if err := c.AddMount(nil, &MountRequest{Dot: "test", Mountpoint: mountpoint}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fakeMounter.Mounts()[mountpoint]; !ok {
+		t.Errorf("%s wasn't mounted: %v", mountpoint, fakeMounter.Mounts())
+	}
+	if len(d.mounting) != 0 {
+		t.Errorf("expected no reservations once mounted, got %v", d.mounting)
+	}
+}
+
+func TestAddMountUndoneWhenNotMarkedReady(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	d, zfs := newTestControlDaemon(h)
+	zfs.filesystems["pool/dmfs/fs-test"] = true
+	c := &ControlRPC{d}
+	mountpoint := filepath.Join(h.dir, "mnt", "test")
+
+	// A file where the ready directory should be.
+	d.readyDir = filepath.Join(h.dir, "admin-password")
+	var result DaemonMount
+	err := c.AddMount(nil, &MountRequest{Dot: "test", Mountpoint: mountpoint, CommitSchedule: "1h"}, &result)
+	if err == nil || !strings.Contains(err.Error(), "admin-password") {
+		t.Fatalf("expected marking the dot ready to fail, got %v", err)
+	}
+	if mounts := fakeMounter.Mounts(); len(mounts) != 0 {
+		t.Errorf("expected the mount to be undone, got %v", mounts)
+	}
+	if len(d.mounts) != 0 || len(d.schedules) != 0 {
+		t.Errorf("expected no mounts or schedules, got %v and %v", d.mounts, d.schedules)
+	}
+}
+
+func TestRemoveMountKeepsReadyFileWhenUnmountFails(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	d, zfs := newTestControlDaemon(h)
+	zfs.filesystems["pool/dmfs/fs-test"] = true
+	c := &ControlRPC{d}
+	mountpoint := filepath.Join(h.dir, "mnt", "test")
+
+	var mounted DaemonMount
+	if err := c.AddMount(nil, &MountRequest{Dot: "test", Mountpoint: mountpoint}, &mounted); err != nil {
+		t.Fatal(err)
+	}
+	fakeMounter.Fail = syscall.EBUSY
+	var result bool
+	if err := c.RemoveMount(nil, &UnmountRequest{Mountpoint: mountpoint}, &result); err == nil {
+		t.Fatal("expected the unmount to fail")
+	}
+	h.assertReady(mountpoint, mounted)
+	if _, ok := d.mounts[mountpoint]; !ok {
+		t.Errorf("dot forgotten although it's still mounted")
+	}
+
+	if err := c.RemoveMount(nil, &UnmountRequest{Mountpoint: mountpoint}, &result); err != nil {
+		t.Fatal(err)
+	}
+	h.assertNotReady(mountpoint)
+}
+
+func TestServeOnlyForRoot(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	d, _ := newTestControlDaemon(h)
+	socket := filepath.Join(h.dir, "control.sock")
+
+	listener, err := d.serve(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("expected the socket to be 0600, got %o", mode)
+	}
+}
+
+func TestAdoptMounts(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	h.dotmesh.dots["test"] = "fs-test"
+	d, _ := newTestControlDaemon(h)
+	c := &ControlRPC{d}
+	mountpoint := filepath.Join(h.dir, "mnt", "test")
+	missing := filepath.Join(h.dir, "mnt", "missing")
+	// Mounted by up -oneshot.
+	if err := fakeMounter.Bind(calculateMountpoint("pool", "fs-test"), mountpoint, mount.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.adoptMounts([]DaemonMount{
+		{Dot: "test", Branch: "master", Mountpoint: mountpoint},
+		{Dot: "missing", Branch: "nonexistent", Mountpoint: missing},
+	})
+	var status DaemonStatus
+	if err := c.Status(nil, &struct{}{}, &status); err != nil {
+		t.Fatal(err)
+	}
+	expected := []DaemonMount{
+		{Dot: "missing", Branch: "nonexistent", Mountpoint: missing},
+		{Dot: "test", Branch: "master", Id: "fs-test", Mountpoint: mountpoint},
+	}
+	if !reflect.DeepEqual(status.Mounts, expected) {
+		t.Errorf("expected mounts %+v, got %+v", expected, status.Mounts)
+	}
+
+	var mounted DaemonMount
+	err := c.AddMount(nil, &MountRequest{Dot: "other", Mountpoint: mountpoint}, &mounted)
+	if err == nil || !strings.Contains(err.Error(), "already mounted") {
+		t.Errorf("expected an already mounted error, got %v", err)
+	}
+	var result bool
+	if err := c.RemoveMount(nil, &UnmountRequest{Mountpoint: mountpoint}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.mounts[mountpoint]; ok {
+		t.Errorf("%s still in the daemon's mounts after unmounting", mountpoint)
+	}
+}
+
+func TestSchedulesByBranch(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	h.dotmesh.dots["test"] = "fs-test"
+	h.dotmesh.branches = map[string]string{"test@reporting": "fs-reporting"}
+	d, _ := newTestControlDaemon(h)
+	defer d.stopScheduledCommits()
+	c := &ControlRPC{d}
+	reporting := filepath.Join(h.dir, "mnt", "reporting")
+	if err := fakeMounter.Bind(calculateMountpoint("pool", "fs-reporting"), reporting, mount.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	d.adoptMounts([]DaemonMount{
+		{Dot: "test", Branch: "reporting", Mountpoint: reporting, CommitSchedule: "1h"},
+	})
+
+	hourly, _ := parseCommitSchedule("1h")
+	for _, branch := range []string{"master", "reporting"} {
+		if err := d.scheduleCommits("test", branch, hourly); err != nil {
+			t.Fatalf("%s: %v", branch, err)
+		}
+	}
+	err := d.scheduleCommits("test", "reporting", hourly)
+	if err == nil || !strings.Contains(err.Error(), "branch reporting of test is already committed") {
+		t.Errorf("expected an already committed error, got %v", err)
+	}
+
+	// Unmounting the branch only stops its schedule.
+	var result bool
+	if err := c.RemoveMount(nil, &UnmountRequest{Mountpoint: reporting}, &result); err != nil {
+		t.Fatal(err)
+	}
+	statuses := d.scheduleStatuses()
+	if len(statuses) != 1 || statuses[0].Dot != "test" || statuses[0].Branch != "" {
+		t.Errorf("expected only master's schedule left, got %+v", statuses)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// storageDevice is one entry of -storage-device: either a block device (or
+// existing file) used as-is, or "file:<path>[:<size>]", a file-backed vdev
+// which we create as a sparse image if it doesn't exist.
+type storageDevice struct {
+	Path string
+	File bool
+	Size int64 // bytes, 0 if not given
+}
+
+func parseStorageDevices(spec string) ([]storageDevice, error) {
+	var devices []storageDevice
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "file:") {
+			devices = append(devices, storageDevice{Path: s})
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(s, "file:"), ":")
+		if len(parts) > 2 || parts[0] == "" {
+			return nil, fmt.Errorf(
+				"bad storage device %q, expected file:<path> or file:<path>:<size>", s,
+			)
+		}
+		device := storageDevice{Path: parts[0], File: true}
+		if len(parts) == 2 {
+			size, err := parseSize(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad storage device %q: %v", s, err)
+			}
+			device.Size = size
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// parseSize parses sizes like "10G", "512M" or "1073741824", with binary
+// (1024-based) multipliers as zfs and truncate use.
+func parseSize(s string) (int64, error) {
+	multipliers := map[string]int64{
+		"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40,
+	}
+	upper := strings.TrimSuffix(strings.ToUpper(s), "B")
+	multiplier := int64(1)
+	if len(upper) > 0 {
+		if m, ok := multipliers[upper[len(upper)-1:]]; ok {
+			multiplier = m
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 10G", s)
+	}
+	return n * multiplier, nil
+}
+
+// prepareStorageDevices creates any missing file-backed devices as sparse
+// images of the requested size and, if growFiles is set, grows existing ones
+// that are smaller than requested. It returns the paths to give zpool, and
+// those of the files it grew.
+func prepareStorageDevices(devices []storageDevice, growFiles bool) ([]string, []string, error) {
+	var paths, grown []string
+	for _, device := range devices {
+		paths = append(paths, device.Path)
+		if !device.File {
+			continue
+		}
+		info, err := os.Stat(device.Path)
+		if os.IsNotExist(err) {
+			if device.Size == 0 {
+				return nil, nil, fmt.Errorf(
+					"%s doesn't exist, give a size (file:%s:10G) to create it",
+					device.Path, device.Path,
+				)
+			}
+			if err := createSparseFile(device.Path, device.Size); err != nil {
+				return nil, nil, err
+			}
+			log.Printf("Created %d byte sparse image %s", device.Size, device.Path)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if device.Size == 0 || info.Size() == device.Size {
+			continue
+		}
+		if info.Size() > device.Size {
+			logger.Warnf(
+				"%s is %d bytes, bigger than the %d requested; not shrinking it",
+				device.Path, info.Size(), device.Size,
+			)
+			continue
+		}
+		if !growFiles {
+			logger.Warnf(
+				"%s is %d bytes, smaller than the %d requested; pass -grow-files to grow it",
+				device.Path, info.Size(), device.Size,
+			)
+			continue
+		}
+		if err := os.Truncate(device.Path, device.Size); err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Grew %s from %d to %d bytes", device.Path, info.Size(), device.Size)
+		grown = append(grown, device.Path)
+	}
+	return paths, grown, nil
+}
+
+func createSparseFile(path string, size int64) error {
+	if err := makeDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// Truncating up leaves a hole, so no blocks get allocated.
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseStorageDevices(t *testing.T) {
+	devices, err := parseStorageDevices("/dev/sda, file:/var/lib/dm/pool.img:10G,file:/tmp/x.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []storageDevice{
+		{Path: "/dev/sda"},
+		{Path: "/var/lib/dm/pool.img", File: true, Size: 10 << 30},
+		{Path: "/tmp/x.img", File: true},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %+v, got %+v", expected, devices)
+	}
+
+	for _, bad := range []string{"file:", "file:/x:10Q", "file:/x:10G:extra", "file:/x:0"} {
+		if _, err := parseStorageDevices(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestPrepareStorageDevices(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	image := filepath.Join(dir, "dm", "pool.img")
+
+	// Missing, so it's created sparse.
+	paths, grown, err := prepareStorageDevices(
+		[]storageDevice{{Path: "/dev/sda"}, {Path: image, File: true, Size: 64 << 20}}, false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"/dev/sda", image}) || len(grown) != 0 {
+		t.Errorf("unexpected paths %v, grown %v", paths, grown)
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 64<<20 {
+		t.Errorf("expected a 64MiB image, got %d bytes", info.Size())
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks*512 >= 64<<20 {
+		t.Errorf("image isn't sparse, %d blocks allocated", blocks)
+	}
+
+	// Bigger size requested, but growing not allowed.
+	bigger := []storageDevice{{Path: image, File: true, Size: 128 << 20}}
+	_, grown, err = prepareStorageDevices(bigger, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(image); info.Size() != 64<<20 || len(grown) != 0 {
+		t.Errorf("image grown without -grow-files")
+	}
+
+	_, grown, err = prepareStorageDevices(bigger, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(image); info.Size() != 128<<20 || !reflect.DeepEqual(grown, []string{image}) {
+		t.Errorf("image not grown: size %d, grown %v", info.Size(), grown)
+	}
+
+	// Missing without a size is an error.
+	_, _, err = prepareStorageDevices(
+		[]storageDevice{{Path: filepath.Join(dir, "missing.img"), File: true}}, false,
+	)
+	if err == nil {
+		t.Errorf("expected an error for a missing image with no size")
+	}
+}
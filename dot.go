@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+// ensureDot makes sure the dot exists, creating it empty if it doesn't, and
+// returns whether it created it.
+func ensureDot(adminApiKey, dot string) (bool, error) {
+	// see if the dot already exists
+	var id string
+	if err := tryUntilSucceedsN(func() error {
+		return doRPC(
+			dotmeshAddress, "admin", adminApiKey,
+			"DotmeshRPC.Exists",
+			map[string]string{"Name": dot, "Namespace": "admin"},
+			&id,
+		)
+	}, fmt.Sprintf("check if %s exists", dot), 5); err != nil {
+		return false, err
+	}
+	if id != "" {
+		log.Printf("Found existing dot %s!", dot)
+		return false, nil
+	}
+	// create if does not exist
+	var result bool
+	if err := doRPC(
+		dotmeshAddress, "admin", adminApiKey,
+		"DotmeshRPC.Create",
+		map[string]string{"Name": dot, "Namespace": "admin"},
+		&result,
+	); err != nil {
+		return false, err
+	}
+	log.Printf("Created dot %s!", dot)
+	return true, nil
+}
+
+// lookupDot returns the ID of the filesystem of the dot's branch, "" meaning
+// master. Each branch has its own filesystem, and only master's is created
+// with the dot; make other branches with dm checkout -b first.
+func lookupDot(adminApiKey, dot, branch string) (string, error) {
+	var id string
+	err := doRPC(
+		dotmeshAddress, "admin", adminApiKey,
+		"DotmeshRPC.Lookup",
+		map[string]string{"Name": dot, "Namespace": "admin", "Branch": branchName(branch)},
+		&id,
+	)
+	if err != nil && !isMaster(branch) {
+		return "", fmt.Errorf("can't find branch %s of dot %s: %v", branch, dot, err)
+	}
+	return id, err
+}
+
+// isMaster reports whether branch is the master branch, which the API calls
+// "".
+func isMaster(branch string) bool {
+	return branch == "" || branch == "master"
+}
+
+// branchName is branch as the API wants it.
+func branchName(branch string) string {
+	if isMaster(branch) {
+		return ""
+	}
+	return branch
+}
+
+// mountDot bind mounts the dot's filesystem, which dotmesh has mounted at
+// dotMountpoint, at mountpoint.
+func mountDot(dotMountpoint, mountpoint string, readOnly bool) error {
+	// TODO: switch this to running DotmeshRPC.Procure once that yields actual
+	// mount points, rather than symlinks.
+	// Related: https://github.com/dotmesh-io/dotmesh/issues/421
+
+	// Seems like this MOUNT_PREFIX of /var is set in dotmesh utils.go
+	// (unless MOUNT_PREFIX is set, and we're not setting it...)
+	if readOnly {
+		return bindMountFilesystemReadOnly(dotMountpoint, mountpoint)
+	}
+	return bindMountFilesystem(dotMountpoint, mountpoint)
+}
+
+// mountCommit bind mounts commit of dot, whose filesystem dotmesh has mounted
+// at dotMountpoint, read-only at mountpoint.
+func mountCommit(dotMountpoint, dot, commit, mountpoint string) error {
+	if err := validateCommitId(commit); err != nil {
+		return err
+	}
+	snapshotMountpoint := calculateSnapshotMountpoint(dotMountpoint, commit)
+	// Stat'ing the snapshot directory also triggers ZFS to automount
+	// it, which has to happen before we can bind mount it.
+	if _, err := os.Stat(snapshotMountpoint); err != nil {
+		return fmt.Errorf(
+			"can't find commit %s of dot %s at %s: %v",
+			commit, dot, snapshotMountpoint, err,
+		)
+	}
+	if err := bindMountFilesystemReadOnly(snapshotMountpoint, mountpoint); err != nil {
+		return err
+	}
+	log.Printf("Mounted commit %s of dot %s read-only at %s", commit, dot, mountpoint)
+	return nil
+}
+
+var commitIdPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_-]*$`)
+
+// validateCommitId checks commit is a plain commit ID, e.g. a UUID, since it
+// becomes part of a path; "../x" mustn't take us out of the snapshots.
+func validateCommitId(commit string) error {
+	if !commitIdPattern.MatchString(commit) {
+		return fmt.Errorf("invalid commit ID %q", commit)
+	}
+	return nil
+}
+
+var branchPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z_.-]*$`)
+
+func validateBranch(branch string) error {
+	if branch != "" && !branchPattern.MatchString(branch) {
+		return fmt.Errorf("invalid branch name %q", branch)
+	}
+	return nil
+}
+
+// dotCommits returns the commits on branch of dot, oldest first. "" is master.
+func dotCommits(adminApiKey, dot, branch string) ([]dotmeshCommit, error) {
+	var commits []dotmeshCommit
+	err := doRPC(
+		dotmeshAddress, "admin", adminApiKey,
+		"DotmeshRPC.Commits",
+		map[string]string{"Namespace": "admin", "Name": dot, "Branch": branch},
+		&commits,
+	)
+	return commits, err
+}
+
+// commitDot commits the current state of the dot's branch ("" for master)
+// with message, returning the commit's ID. The commit's metadata records this
+// host, what triggered the commit (e.g. "import") and when, plus anything in
+// extra.
+func commitDot(adminApiKey, dot, branch, message, trigger string, extra map[string]string) (string, error) {
+	metadata := map[string]string{
+		"hostname":  hostname(),
+		"trigger":   trigger,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range extra {
+		metadata[k] = v
+	}
+	var commitId string
+	err := doRPC(
+		dotmeshAddress, "admin", adminApiKey,
+		"DotmeshRPC.Commit",
+		map[string]interface{}{
+			"Namespace": "admin",
+			"Name":      dot,
+			"Branch":    branchName(branch),
+			"Message":   message,
+			"Metadata":  metadata,
+		},
+		&commitId,
+	)
+	if err != nil {
+		return "", err
+	}
+	recordSuccess("commit", dot)
+	return commitId, nil
+}
+
+func hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
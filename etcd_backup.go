@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ETCDCTL_BIN = "etcdctl"
+
+// ETCD_BACKUP_DIR is where the etcd backups filesystem is mounted, and so
+// where etcd-backup and periodic backups put snapshots, by default.
+const ETCD_BACKUP_DIR = "/var/dotmesh/etcd-backups"
+
+// ETCD_BACKUP_FILESYSTEM is the filesystem on the pool for etcd backups. The
+// root filesystem is usually small, and on LinuxKit it's gone after a reboot.
+const ETCD_BACKUP_FILESYSTEM = "dm-linuxkit-etcd-backups"
+
+// ETCD_BACKUP_QUOTA is how much of the pool backups may use by default. etcd's
+// own default space quota is 2G, but dotmesh's metadata is usually tiny.
+const ETCD_BACKUP_QUOTA = "5G"
+
+// ETCD_BACKUP_TIME_FORMAT names backup files so they sort oldest first.
+const ETCD_BACKUP_TIME_FORMAT = "20060102T150405Z"
+
+// runEtcdctl runs etcdctl with the v3 API, which etcd 3.3's etcdctl doesn't
+// use unless asked.
+func runEtcdctl(runner Runner, args ...string) (CommandResult, error) {
+	return runChecked(runner, "env", append([]string{"ETCDCTL_API=3", ETCDCTL_BIN}, args...)...)
+}
+
+func addEtcdBackupQuotaFlag(flags *flag.FlagSet, name string) *string {
+	return flags.String(
+		name, ETCD_BACKUP_QUOTA,
+		"ZFS quota for the filesystem etcd backups are kept on, e.g. 5G (or none)",
+	)
+}
+
+// setupEtcdBackupFilesystem creates and mounts the filesystem for etcd backups
+// at dir, limited to quota so backups can't fill the pool.
+func setupEtcdBackupFilesystem(zfs ZFS, pool, dir, quota string) error {
+	limits := spaceLimits{Quota: quota}
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	if err := setupPoolFilesystem(zfs, pool, ETCD_BACKUP_FILESYSTEM, dir); err != nil {
+		return err
+	}
+	return applySpaceLimits(zfs, pool+"/"+ETCD_BACKUP_FILESYSTEM, limits)
+}
+
+// backupEtcd saves a snapshot of the running etcd at endpoint into dir,
+// returning its path. etcd's snapshots are consistent, so etcd and dotmesh can
+// keep running while it's taken.
+func backupEtcd(runner Runner, endpoint, dir string, now time.Time) (string, error) {
+	if err := makeDirectoryIfNotExists(dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "etcd-"+now.UTC().Format(ETCD_BACKUP_TIME_FORMAT)+".db")
+	// Save to a temporary name first so a half-written snapshot never looks
+	// like a backup.
+	partial := path + ".part"
+	_, err := runEtcdctl(runner, "--endpoints", endpoint, "snapshot", "save", partial)
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// etcdBackups returns the backups in dir, oldest first.
+func etcdBackups(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasPrefix(name, "etcd-") && strings.HasSuffix(name, ".db") {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// pruneEtcdBackups deletes all but the newest keep backups in dir.
+func pruneEtcdBackups(dir string, keep int) error {
+	backups, err := etcdBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		log.Printf("Removed old etcd backup %s", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// runEtcdBackups backs up etcd every interval until stop is closed, keeping
+// the newest keep backups.
+func runEtcdBackups(runner Runner, endpoint, dir string, interval time.Duration, keep int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		path, err := backupEtcd(runner, endpoint, dir, time.Now())
+		if err != nil {
+			logger.Alertf("couldn't back up etcd: %v", err)
+			continue
+		}
+		log.Printf("Backed up etcd to %s", path)
+		if err := pruneEtcdBackups(dir, keep); err != nil {
+			logger.Alertf("couldn't remove old etcd backups: %v", err)
+		}
+	}
+}
+
+// etcdRunning reports whether anything's listening on etcd's client port.
+func etcdRunning(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// restoreEtcd replaces etcd's data in dataDir (pool/dotmesh-etcd, which must
+// be mounted there) with the snapshot in backup. etcd must not be running.
+// The current data is snapshotted in ZFS first, so a bad restore can be
+// rolled back with zfs rollback.
+func restoreEtcd(runner Runner, zfs ZFS, pool, dataDir, backup string, now time.Time) error {
+	if _, err := os.Stat(backup); err != nil {
+		return err
+	}
+	snapshot := "pre-restore-" + now.UTC().Format(ETCD_BACKUP_TIME_FORMAT)
+	if err := zfs.Snapshot(pool+"/dotmesh-etcd", snapshot); err != nil {
+		return err
+	}
+	log.Printf("Snapshotted current etcd data as %s/dotmesh-etcd@%s", pool, snapshot)
+
+	// etcdctl restores into a new directory. Keep it on the same filesystem
+	// so it can be renamed into place.
+	restored := filepath.Join(dataDir, "restore-"+snapshot)
+	_, err := runEtcdctl(runner, "snapshot", "restore", backup, "--data-dir", restored)
+	if err != nil {
+		os.RemoveAll(restored)
+		return err
+	}
+	member := filepath.Join(dataDir, "member")
+	if err := os.RemoveAll(member); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(restored, "member"), member); err != nil {
+		return err
+	}
+	return os.RemoveAll(restored)
+}
+
+func etcdBackupCommand(args []string) {
+	flags := flag.NewFlagSet("etcd-backup", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	flagPool := flags.String("pool-name", "pool", "Name of storage pool to keep backups on")
+	flagDir := flags.String("dir", ETCD_BACKUP_DIR, "Where to mount the backups filesystem and save the backup")
+	flagQuota := addEtcdBackupQuotaFlag(flags, "quota")
+	flagKeep := flags.Int("keep", 0, "Delete all but this many of the newest backups (0 keeps them all)")
+	flagEndpoint := flags.String("etcd-endpoint", ETCD_ENDPOINT, "etcd to back up")
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+
+	err := setupEtcdBackupFilesystem(newExecZFS(), *flagPool, *flagDir, *flagQuota)
+	if err != nil {
+		logger.Fatalf("Couldn't set up the backups filesystem: %v", err)
+	}
+	path, err := backupEtcd(newExecRunner(), *flagEndpoint, *flagDir, time.Now())
+	if err != nil {
+		logger.Fatalf("Couldn't back up etcd: %v", err)
+	}
+	log.Printf("Backed up etcd to %s", path)
+	if *flagKeep > 0 {
+		if err := pruneEtcdBackups(*flagDir, *flagKeep); err != nil {
+			logger.Fatalf("Couldn't remove old backups: %v", err)
+		}
+	}
+}
+
+func etcdRestoreCommand(args []string) {
+	flags := flag.NewFlagSet("etcd-restore", flag.ExitOnError)
+	logging := addLogFlags(flags)
+	flagPool := flags.String("pool-name", "pool", "Name of storage pool to use")
+	flagEtcdDataDir := flags.String("etcd-data-dir", ETCD_DATA_DIR, "Directory to mount etcd's filesystem at")
+	flagBackupDir := flags.String("backup-dir", ETCD_BACKUP_DIR, "Where to mount the backups filesystem")
+	flagEndpoint := flags.String("etcd-endpoint", ETCD_ENDPOINT, "Where etcd listens, to check it's stopped")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s etcd-restore [flags] <backup file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if etcdRunning(*flagEndpoint) {
+		logger.Fatalf("etcd is running at %s, stop dm-linuxkit before restoring", *flagEndpoint)
+	}
+	zfs := newExecZFS()
+	if err := setupEtcdFilesystem(zfs, *flagPool, *flagEtcdDataDir); err != nil {
+		logger.Fatalf("Couldn't mount etcd's filesystem: %v", err)
+	}
+	// The backup's probably on the backups filesystem, which won't be mounted
+	// if dm-linuxkit isn't running.
+	err := setupPoolFilesystem(zfs, *flagPool, ETCD_BACKUP_FILESYSTEM, *flagBackupDir)
+	if err != nil {
+		logger.Fatalf("Couldn't mount the backups filesystem: %v", err)
+	}
+	err = restoreEtcd(newExecRunner(), zfs, *flagPool, *flagEtcdDataDir, flags.Arg(0), time.Now())
+	if err != nil {
+		logger.Fatalf("Couldn't restore etcd: %v", err)
+	}
+	log.Printf("Restored etcd from %s", flags.Arg(0))
+}
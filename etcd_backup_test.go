@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// etcdctlRunner pretends to be etcdctl, writing what snapshot save and restore
+// would so the files can be checked.
+type etcdctlRunner struct {
+	ran []string
+}
+
+func (r *etcdctlRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	r.ran = append(r.ran, name+" "+strings.Join(args, " "))
+	last := args[len(args)-1]
+	switch {
+	case strings.Contains(strings.Join(args, " "), "snapshot save"):
+		return CommandResult{}, ioutil.WriteFile(last, []byte("snapshot"), 0600)
+	case strings.Contains(strings.Join(args, " "), "snapshot restore"):
+		if err := os.MkdirAll(filepath.Join(last, "member"), 0700); err != nil {
+			return CommandResult{}, err
+		}
+		return CommandResult{}, ioutil.WriteFile(filepath.Join(last, "member", "restored"), nil, 0600)
+	}
+	return CommandResult{ExitCode: 1}, nil
+}
+
+func TestBackupEtcd(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	backups := filepath.Join(dir, "backups")
+
+	runner := &etcdctlRunner{}
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	path, err := backupEtcd(runner, ETCD_ENDPOINT, backups, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(backups, "etcd-20180701T120000Z.db") {
+		t.Errorf("unexpected backup path %s", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("backup not saved: %v", err)
+	}
+	expected := []string{
+		"env ETCDCTL_API=3 etcdctl --endpoints " + ETCD_ENDPOINT + " snapshot save " + path + ".part",
+	}
+	if !reflect.DeepEqual(runner.ran, expected) {
+		t.Errorf("expected %v, got %v", expected, runner.ran)
+	}
+
+	// A failed backup leaves nothing behind.
+	_, err = backupEtcd(&fakeRunner{result: CommandResult{ExitCode: 1}}, ETCD_ENDPOINT, backups, now.Add(time.Hour))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	found, err := etcdBackups(backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []string{path}) {
+		t.Errorf("expected just %s, got %v", path, found)
+	}
+}
+
+func TestPruneEtcdBackups(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, name := range []string{
+		"etcd-20180703T000000Z.db", "etcd-20180701T000000Z.db",
+		"etcd-20180702T000000Z.db", "notes.txt",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneEtcdBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	found, err := etcdBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(dir, "etcd-20180702T000000Z.db"),
+		filepath.Join(dir, "etcd-20180703T000000Z.db"),
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("pruning removed something that wasn't a backup: %v", err)
+	}
+}
+
+func TestRestoreEtcd(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	dataDir := filepath.Join(dir, "etcd")
+	if err := os.MkdirAll(filepath.Join(dataDir, "member"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "member", "corrupt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "etcd-20180701T120000Z.db")
+	if err := ioutil.WriteFile(backup, []byte("snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	zfs.filesystems["pool/dotmesh-etcd"] = true
+	now := time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC)
+	err := restoreEtcd(&etcdctlRunner{}, zfs, "pool", dataDir, backup, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zfs.callsTo("Snapshot pool/dotmesh-etcd@pre-restore-20180702T000000Z") != 1 {
+		t.Errorf("current data wasn't snapshotted first, calls: %v", zfs.calls)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "member", "restored")); err != nil {
+		t.Errorf("restored data not in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "member", "corrupt")); !os.IsNotExist(err) {
+		t.Errorf("old data still there: %v", err)
+	}
+	files, _ := ioutil.ReadDir(dataDir)
+	if len(files) != 1 {
+		t.Errorf("expected only member/ left in %s, got %d entries", dataDir, len(files))
+	}
+
+	// Without a snapshot to roll back to, nothing's touched.
+	zfs.errors["Snapshot"] = os.ErrPermission
+	err = restoreEtcd(&etcdctlRunner{}, zfs, "pool", dataDir, backup, now)
+	if err == nil {
+		t.Errorf("expected an error when the snapshot fails")
+	}
+}
+
+func TestSetupEtcdBackupFilesystem(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	backups := filepath.Join(dir, "backups")
+
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = nil
+	if err := setupEtcdBackupFilesystem(zfs, "pool", backups, "2G"); err != nil {
+		t.Fatal(err)
+	}
+	dataset := "pool/" + ETCD_BACKUP_FILESYSTEM
+	if !zfs.filesystems[dataset] {
+		t.Errorf("%s wasn't created, calls: %v", dataset, zfs.calls)
+	}
+	if m, ok := fakeMounter.Mounts()[backups]; !ok || m.Source != dataset {
+		t.Errorf("%s wasn't mounted at %s: %v", dataset, backups, fakeMounter.Mounts())
+	}
+	if quota := zfs.properties[dataset]["quota"]; quota != "2G" {
+		t.Errorf("expected a 2G quota, got %q", quota)
+	}
+
+	if err := setupEtcdBackupFilesystem(zfs, "pool", backups, "lots"); err == nil {
+		t.Errorf("expected a bad quota to be rejected")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// poolOptions control what setupZFS may do to an existing pool.
+type poolOptions struct {
+	// AllowAddDevices adds devices which aren't in the pool yet to it.
+	AllowAddDevices bool
+	// GrownDevices are devices we've just grown ourselves (see -grow-files),
+	// which ZFS may not have noticed yet.
+	GrownDevices []string
+}
+
+// growPool makes an existing pool use all the space it's been given: it
+// expands vdevs whose device or file has grown (e.g. a cloud disk resized
+// between boots), and, if allowed, adds any of devices that aren't in the
+// pool yet. Sizes are logged before and after.
+func growPool(zfs ZFS, pool string, devices []string, opts poolOptions) error {
+	before, err := zfs.Pool(pool)
+	if err != nil {
+		return err
+	}
+
+	status, err := zfs.PoolStatus(pool)
+	if err != nil {
+		return err
+	}
+	leaves := leafVdevs(status)
+
+	expandSize, err := poolExpandSize(zfs, pool)
+	if err != nil {
+		return err
+	}
+	expanded := false
+	if expandSize > 0 {
+		log.Printf(
+			"Pool %s can grow by %d bytes, expanding its devices...",
+			pool, expandSize,
+		)
+		for _, vdev := range leaves {
+			if err := zfs.ExpandVdev(pool, vdev); err != nil {
+				return err
+			}
+		}
+		expanded = true
+	} else {
+		for _, device := range opts.GrownDevices {
+			if !deviceInPool(device, leaves) {
+				continue
+			}
+			if err := zfs.ExpandVdev(pool, device); err != nil {
+				return err
+			}
+			expanded = true
+		}
+	}
+
+	var missing []string
+	for _, device := range devices {
+		if device != "" && !deviceInPool(device, leaves) {
+			missing = append(missing, device)
+		}
+	}
+	added := false
+	if len(missing) > 0 {
+		if !opts.AllowAddDevices {
+			logger.Warnf(
+				"Devices %v aren't part of pool %s, pass -allow-add-devices "+
+					"to add them to it", missing, pool,
+			)
+		} else {
+			log.Printf("Adding devices %v to pool %s...", missing, pool)
+			if err := zfs.AddDevices(pool, missing); err != nil {
+				// The pool is still usable without them, so carry on.
+				logger.Alertf(
+					"zpool refused to add %v to pool %s, carrying on "+
+						"without them; check nothing else is using them and "+
+						"add them by hand with zpool add -f if you're sure: %v",
+					missing, pool, err,
+				)
+			} else {
+				added = true
+			}
+		}
+	}
+
+	if !expanded && !added {
+		return nil
+	}
+	after, err := zfs.Pool(pool)
+	if err != nil {
+		return err
+	}
+	log.Printf(
+		"Pool %s grew from %d bytes (%d free) to %d bytes (%d free)",
+		pool, before.Size, before.Free, after.Size, after.Free,
+	)
+	return nil
+}
+
+// poolExpandSize returns how much bigger the pool could be if its vdevs were
+// expanded into the space available on their devices.
+func poolExpandSize(zfs ZFS, pool string) (uint64, error) {
+	properties, err := zfs.PoolProperties(pool, "expandsize")
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range properties {
+		if p.Property == "expandsize" && p.Value != "-" {
+			return strconv.ParseUint(p.Value, 10, 64)
+		}
+	}
+	return 0, nil
+}
+
+// leafVdevs returns the names of the devices and files at the bottom of the
+// pool's vdev tree, i.e. the things that actually store data.
+func leafVdevs(status PoolStatus) []string {
+	var leaves []string
+	for i, vdev := range status.Config {
+		if vdev.Depth == 0 {
+			continue
+		}
+		if i+1 < len(status.Config) && status.Config[i+1].Depth > vdev.Depth {
+			continue
+		}
+		leaves = append(leaves, vdev.Name)
+	}
+	return leaves
+}
+
+// vdevSearchDirs are where zpool finds the devices it shows by their short
+// name in zpool status, e.g. sda in /dev or ata-FOO in /dev/disk/by-id.
+var vdevSearchDirs = []string{
+	"/dev", "/dev/disk/by-id", "/dev/disk/by-path", "/dev/disk/by-uuid",
+	"/dev/disk/by-partuuid", "/dev/mapper",
+}
+
+// deviceInPool reports whether a -storage-device is one of the pool's vdevs.
+// zpool status shows block devices by their short name (sda for /dev/sda, or
+// ata-FOO for /dev/disk/by-id/ata-FOO) and files by their full path. Either
+// side may be a symlink to the same device (by-id paths usually are), and
+// given a whole disk ZFS may put a partition on it and use that instead, so
+// sda1 in the pool counts as /dev/sda.
+func deviceInPool(device string, vdevs []string) bool {
+	devicePaths := []string{device, resolveDevice(device)}
+	for _, vdev := range vdevs {
+		if vdev == device || vdev == filepath.Base(device) {
+			return true
+		}
+		for _, vdevPath := range vdevPaths(vdev) {
+			for _, devicePath := range devicePaths {
+				if vdevPath == devicePath || isPartitionOf(vdevPath, devicePath) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// vdevPaths returns the resolved paths of the devices a vdev name from zpool
+// status might be.
+func vdevPaths(vdev string) []string {
+	if filepath.IsAbs(vdev) {
+		return []string{resolveDevice(vdev)}
+	}
+	var paths []string
+	for _, dir := range vdevSearchDirs {
+		path := filepath.Join(dir, vdev)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, resolveDevice(path))
+		}
+	}
+	return paths
+}
+
+// resolveDevice follows any symlinks to device, returning it as it is if
+// that fails (e.g. it's not there).
+func resolveDevice(device string) string {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return device
+	}
+	return resolved
+}
+
+// isPartitionOf reports whether partition is a partition of disk by name:
+// /dev/sda1 of /dev/sda, or /dev/nvme0n1p1 of /dev/nvme0n1.
+func isPartitionOf(partition, disk string) bool {
+	if disk == "" || !strings.HasPrefix(partition, disk) {
+		return false
+	}
+	number := partition[len(disk):]
+	// The kernel puts a p between a disk name ending in a digit and the
+	// partition number.
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		if !strings.HasPrefix(number, "p") {
+			return false
+		}
+		number = number[1:]
+	}
+	_, err := strconv.ParseUint(number, 10, 32)
+	return err == nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceInPool(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	byId := filepath.Join(dir, "disk", "by-id")
+	if err := os.MkdirAll(byId, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sda", "sda1", "sdb", "nvme0n1", "nvme0n1p1"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	for link, target := range map[string]string{
+		"ata-DISK_A":       "../../sda",
+		"ata-DISK_A-part1": "../../sda1",
+		"nvme-DISK_N":      "../../nvme0n1",
+	} {
+		if err := os.Symlink(target, filepath.Join(byId, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := vdevSearchDirs
+	vdevSearchDirs = []string{dir, byId}
+	defer func() { vdevSearchDirs = previous }()
+
+	for _, c := range []struct {
+		device   string
+		vdevs    []string
+		expected bool
+	}{
+		{filepath.Join(dir, "sda"), []string{"sda"}, true},
+		{filepath.Join(dir, "sda"), []string{"sdb"}, false},
+		// A by-id path given as the device, with the pool showing sda.
+		{filepath.Join(byId, "ata-DISK_A"), []string{"sda"}, true},
+		// The pool made from a by-id path, with the device given as /dev/sda.
+		{filepath.Join(dir, "sda"), []string{"ata-DISK_A"}, true},
+		// ZFS partitioned the whole disk and uses the partition.
+		{filepath.Join(dir, "sda"), []string{"sda1"}, true},
+		{filepath.Join(dir, "sda"), []string{"ata-DISK_A-part1"}, true},
+		{filepath.Join(byId, "nvme-DISK_N"), []string{"nvme0n1p1"}, true},
+		{filepath.Join(dir, "sdb"), []string{"sda", "sda1", "ata-DISK_A"}, false},
+		// Files are shown by their full path.
+		{"/var/dotmesh/pool.img", []string{"/var/dotmesh/pool.img"}, true},
+		{"/var/dotmesh/pool2.img", []string{"/var/dotmesh/pool.img"}, false},
+	} {
+		if actual := deviceInPool(c.device, c.vdevs); actual != c.expected {
+			t.Errorf("deviceInPool(%s, %v): expected %v, got %v", c.device, c.vdevs, c.expected, actual)
+		}
+	}
+}
+
+func TestIsPartitionOf(t *testing.T) {
+	for _, c := range []struct {
+		partition, disk string
+		expected        bool
+	}{
+		{"/dev/sda1", "/dev/sda", true},
+		{"/dev/sda12", "/dev/sda", true},
+		{"/dev/sda", "/dev/sda", false},
+		{"/dev/sdaa", "/dev/sda", false},
+		{"/dev/nvme0n1p1", "/dev/nvme0n1", true},
+		{"/dev/nvme0n12", "/dev/nvme0n1", false},
+		{"/dev/nvme0n1p", "/dev/nvme0n1", false},
+		{"/dev/sda1", "", false},
+	} {
+		if actual := isPartitionOf(c.partition, c.disk); actual != c.expected {
+			t.Errorf("isPartitionOf(%s, %s): expected %v, got %v", c.partition, c.disk, c.expected, actual)
+		}
+	}
+}
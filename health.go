@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ZPOOL_STATUS_TIME_FORMAT is how zpool status prints times in its scan line,
+// e.g. "Sun Jul  1 00:00:01 2018".
+const ZPOOL_STATUS_TIME_FORMAT = "Mon Jan _2 15:04:05 2006"
+
+// unusablePoolHealths are the pool states we won't start dotmesh on, as
+// there's no usable copy of at least some of the data.
+var unusablePoolHealths = map[string]bool{
+	"FAULTED": true,
+	"UNAVAIL": true,
+}
+
+// unhealthyPoolHealths are the pool states worth shouting about.
+var unhealthyPoolHealths = map[string]bool{
+	"DEGRADED":  true,
+	"FAULTED":   true,
+	"UNAVAIL":   true,
+	"SUSPENDED": true,
+	"REMOVED":   true,
+	"OFFLINE":   true,
+}
+
+// scanInfo is what we can tell from the scan line of zpool status.
+type scanInfo struct {
+	Function   string // "scrub", "resilver" or "" if the pool's never been scanned
+	InProgress bool
+	Canceled   bool
+	Finished   time.Time // zero unless a scan has finished
+	Errors     uint64    // errors found by the last finished scan
+}
+
+var scanFinishedRegexp = regexp.MustCompile(
+	`^(scrub|resilver)(?:ed)? .* with (\d+) errors on (.*)$`,
+)
+var scanInProgressRegexp = regexp.MustCompile(`^(scrub|resilver) in progress`)
+var scanCanceledRegexp = regexp.MustCompile(`^(scrub|resilver) canceled`)
+
+func parseScan(scan string) scanInfo {
+	if m := scanInProgressRegexp.FindStringSubmatch(scan); m != nil {
+		return scanInfo{Function: m[1], InProgress: true}
+	}
+	if m := scanCanceledRegexp.FindStringSubmatch(scan); m != nil {
+		return scanInfo{Function: m[1], Canceled: true}
+	}
+	if m := scanFinishedRegexp.FindStringSubmatch(scan); m != nil {
+		info := scanInfo{Function: m[1]}
+		info.Errors, _ = strconv.ParseUint(m[2], 10, 64)
+		// zpool prints local time.
+		info.Finished, _ = time.ParseInLocation(ZPOOL_STATUS_TIME_FORMAT, m[3], time.Local)
+		return info
+	}
+	return scanInfo{}
+}
+
+// poolHealthReport is the result of one health check of the pool.
+type poolHealthReport struct {
+	Checked        time.Time
+	Health         string
+	Status         string
+	ReadErrors     uint64
+	WriteErrors    uint64
+	ChecksumErrors uint64
+	Scan           scanInfo
+	Err            error // set if we couldn't check
+}
+
+// Healthy reports whether there's nothing wrong with the pool.
+func (r poolHealthReport) Healthy() bool {
+	return r.Err == nil && !unhealthyPoolHealths[r.Health] &&
+		r.ReadErrors == 0 && r.WriteErrors == 0 && r.ChecksumErrors == 0
+}
+
+func checkPoolHealth(zfs ZFS, pool string) poolHealthReport {
+	report := poolHealthReport{Checked: time.Now()}
+	status, err := zfs.PoolStatus(pool)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.Health = status.State
+	report.Status = status.Status
+	report.Scan = parseScan(status.Scan)
+	// Sum the errors of the leaf vdevs, the ones with nothing deeper after
+	// them, as each level of the tree reports its own.
+	for i, vdev := range status.Config {
+		if i+1 < len(status.Config) && status.Config[i+1].Depth > vdev.Depth {
+			continue
+		}
+		report.ReadErrors += vdev.Read
+		report.WriteErrors += vdev.Write
+		report.ChecksumErrors += vdev.Checksum
+	}
+	return report
+}
+
+// checkPoolUsable is run at boot, and refuses to go any further on a pool
+// which is FAULTED, as dotmesh would just fail in confusing ways on it.
+func checkPoolUsable(zfs ZFS, pool string) error {
+	report := checkPoolHealth(zfs, pool)
+	if report.Err != nil {
+		return report.Err
+	}
+	logPoolHealth(pool, report)
+	if unusablePoolHealths[report.Health] {
+		return fmt.Errorf(
+			"pool %s is %s, refusing to start dotmesh on it: %s",
+			pool, report.Health, report.Status,
+		)
+	}
+	return nil
+}
+
+func logPoolHealth(pool string, report poolHealthReport) {
+	if report.Err != nil {
+		logger.Alertf("couldn't check health of pool %s: %v", pool, report.Err)
+		return
+	}
+	if report.Healthy() {
+		return
+	}
+	logger.Alertf(
+		"pool %s is %s with %d read, %d write and %d checksum errors: %s",
+		pool, report.Health, report.ReadErrors, report.WriteErrors,
+		report.ChecksumErrors, report.Status,
+	)
+}
+
+// poolMonitor periodically checks the health of the pool in daemon mode, and
+// scrubs it on a schedule.
+type poolMonitor struct {
+	zfs           ZFS
+	pool          string
+	checkInterval time.Duration
+	scrubInterval time.Duration // 0 disables scheduled scrubs
+	started       time.Time     // when we started, for a pool that's never been scanned
+
+	mu   sync.Mutex
+	last poolHealthReport
+}
+
+func newPoolMonitor(zfs ZFS, pool string, checkInterval, scrubInterval time.Duration) *poolMonitor {
+	return &poolMonitor{
+		zfs:           zfs,
+		pool:          pool,
+		checkInterval: checkInterval,
+		scrubInterval: scrubInterval,
+		started:       time.Now(),
+	}
+}
+
+// Last returns the most recent health report.
+func (m *poolMonitor) Last() poolHealthReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// run checks the pool every checkInterval until stop is closed.
+func (m *poolMonitor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check does one health check, reporting anything that's changed, and starts
+// a scrub if one's due.
+func (m *poolMonitor) check() {
+	report := checkPoolHealth(m.zfs, m.pool)
+
+	m.mu.Lock()
+	previous := m.last
+	m.last = report
+	m.mu.Unlock()
+
+	if report.Err != nil || !report.Healthy() {
+		logPoolHealth(m.pool, report)
+	} else if !previous.Checked.IsZero() && !previous.Healthy() {
+		log.Printf("Pool %s is healthy again", m.pool)
+	}
+	if report.Err != nil {
+		return
+	}
+
+	if previous.Scan.InProgress && !report.Scan.InProgress {
+		m.reportScan(report.Scan)
+	}
+
+	if m.scrubDue(report, time.Now()) {
+		log.Printf("Starting scheduled scrub of pool %s", m.pool)
+		if err := m.zfs.Scrub(m.pool); err != nil {
+			logger.Alertf("couldn't start scrub of pool %s: %v", m.pool, err)
+		}
+	}
+}
+
+func (m *poolMonitor) reportScan(scan scanInfo) {
+	switch {
+	case scan.Canceled:
+		logger.Warnf("%s of pool %s was canceled", scan.Function, m.pool)
+	case scan.Errors > 0:
+		logger.Alertf(
+			"%s of pool %s finished with %d errors",
+			scan.Function, m.pool, scan.Errors,
+		)
+	default:
+		log.Printf("%s of pool %s finished with no errors", scan.Function, m.pool)
+	}
+}
+
+// scrubDue decides whether to start a scrub: scrubs are scheduled, nothing
+// else is scanning the pool, and the last scan finished more than
+// scrubInterval ago. A resilver reads and checks everything a scrub would, so
+// it counts. If the pool's never been scanned (or the last scan was canceled)
+// the first interval runs from when we started, rather than scrubbing a new
+// pool straight away on boot.
+func (m *poolMonitor) scrubDue(report poolHealthReport, now time.Time) bool {
+	if m.scrubInterval <= 0 || report.Scan.InProgress {
+		return false
+	}
+	// A suspended pool can't do any I/O, scrubbing would just hang.
+	if report.Health == "SUSPENDED" || unusablePoolHealths[report.Health] {
+		return false
+	}
+	last := report.Scan.Finished
+	if last.IsZero() {
+		last = m.started
+	}
+	return now.Sub(last) >= m.scrubInterval
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScan(t *testing.T) {
+	for _, tc := range []struct {
+		scan     string
+		expected scanInfo
+	}{
+		{"", scanInfo{}},
+		{"none requested", scanInfo{}},
+		{
+			"scrub in progress since Sun Jul  1 00:00:01 2018",
+			scanInfo{Function: "scrub", InProgress: true},
+		},
+		{
+			"scrub canceled on Sun Jul  1 00:00:01 2018",
+			scanInfo{Function: "scrub", Canceled: true},
+		},
+		{
+			"scrub repaired 0B in 0h0m with 2 errors on Sun Jul  1 00:00:01 2018",
+			scanInfo{
+				Function: "scrub",
+				Errors:   2,
+				Finished: time.Date(2018, 7, 1, 0, 0, 1, 0, time.Local),
+			},
+		},
+		{
+			"resilvered 1.5G in 0h1m with 0 errors on Mon Jul  2 10:00:00 2018",
+			scanInfo{
+				Function: "resilver",
+				Finished: time.Date(2018, 7, 2, 10, 0, 0, 0, time.Local),
+			},
+		},
+	} {
+		actual := parseScan(tc.scan)
+		if actual.Function != tc.expected.Function ||
+			actual.InProgress != tc.expected.InProgress ||
+			actual.Canceled != tc.expected.Canceled ||
+			actual.Errors != tc.expected.Errors ||
+			!actual.Finished.Equal(tc.expected.Finished) {
+			t.Errorf("parseScan(%q): expected %+v, got %+v", tc.scan, tc.expected, actual)
+		}
+	}
+}
+
+func TestCheckPoolHealthCountsLeafErrors(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	zfs.health["pool"] = "DEGRADED"
+
+	report := checkPoolHealth(zfs, "pool")
+	if report.Health != "DEGRADED" || report.Healthy() {
+		t.Errorf("expected an unhealthy DEGRADED report, got %+v", report)
+	}
+	if err := checkPoolUsable(zfs, "pool"); err != nil {
+		t.Errorf("a DEGRADED pool should still be usable: %v", err)
+	}
+
+	zfs.health["pool"] = "FAULTED"
+	if err := checkPoolUsable(zfs, "pool"); err == nil {
+		t.Errorf("a FAULTED pool shouldn't be usable")
+	}
+}
+
+func TestPoolMonitorScrubSchedule(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	monitor := newPoolMonitor(zfs, "pool", time.Minute, 24*time.Hour)
+
+	// Never scrubbed, but we've only just started, so not due yet.
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 0 {
+		t.Fatalf("expected no scrub straight after starting, got %d", n)
+	}
+
+	// Never scrubbed, and we started longer ago than the interval, so due.
+	monitor.started = time.Now().Add(-25 * time.Hour)
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 1 {
+		t.Fatalf("expected a scrub, got %d", n)
+	}
+
+	// Don't start another while that one's running.
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 1 {
+		t.Fatalf("expected no new scrub while one is in progress, got %d", n)
+	}
+
+	// Finished recently, so not due.
+	recent := time.Now().Add(-time.Hour).Format(ZPOOL_STATUS_TIME_FORMAT)
+	zfs.scan["pool"] = "scrub repaired 0B in 0h0m with 0 errors on " + recent
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 1 {
+		t.Fatalf("expected no new scrub after a recent one, got %d", n)
+	}
+
+	// Finished long ago, so due again.
+	old := time.Now().Add(-48 * time.Hour).Format(ZPOOL_STATUS_TIME_FORMAT)
+	zfs.scan["pool"] = "scrub repaired 0B in 0h0m with 0 errors on " + old
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 2 {
+		t.Fatalf("expected a second scrub, got %d", n)
+	}
+}
+
+func TestPoolMonitorResilverCountsAsScrub(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	monitor := newPoolMonitor(zfs, "pool", time.Minute, 24*time.Hour)
+	monitor.started = time.Now().Add(-48 * time.Hour)
+
+	recent := time.Now().Add(-time.Hour).Format(ZPOOL_STATUS_TIME_FORMAT)
+	zfs.scan["pool"] = "resilvered 1.5G in 0h1m with 0 errors on " + recent
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 0 {
+		t.Fatalf("expected no scrub after a recent resilver, got %d", n)
+	}
+
+	old := time.Now().Add(-48 * time.Hour).Format(ZPOOL_STATUS_TIME_FORMAT)
+	zfs.scan["pool"] = "resilvered 1.5G in 0h1m with 0 errors on " + old
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 1 {
+		t.Fatalf("expected a scrub after an old resilver, got %d", n)
+	}
+}
+
+func TestPoolMonitorNoScrubsByDefault(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	monitor := newPoolMonitor(zfs, "pool", time.Minute, 0)
+	monitor.check()
+	if n := zfs.callsTo("Scrub"); n != 0 {
+		t.Errorf("expected no scrubs, got %d", n)
+	}
+	if !monitor.Last().Healthy() {
+		t.Errorf("expected a healthy report, got %+v", monitor.Last())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const CP = "cp"
+
+// IMPORTED_PROPERTY is a ZFS user property set on a dot's dataset once
+// importing existing data into it is done, to the import's commit ID or to
+// "none" if there was nothing to import.
+const IMPORTED_PROPERTY = "io.dotmesh.linuxkit:imported"
+
+// importExistingData copies whatever is already in mountpoint into a dot
+// (whose filesystem dotmesh has mounted at dotMountpoint, from dataset) and
+// commits it, so that bind mounting the dot over mountpoint doesn't hide the
+// data that was there before. It's a no-op if mountpoint is missing or empty.
+//
+// It only happens once per dot, going by IMPORTED_PROPERTY, which is set after
+// the commit. An import that was interrupted, e.g. by a crash before
+// committing, is done again on the next boot, but once it's done, files left
+// under mountpoint never replace what's been written to the dot since. Dots
+// with commits made some other way, e.g. seeded ones, are never imported into.
+func importExistingData(zfs ZFS, dataset, adminApiKey, dot, mountpoint, dotMountpoint string) error {
+	properties, err := zfs.DatasetProperties(dataset, IMPORTED_PROPERTY)
+	if err != nil {
+		return err
+	}
+	for _, p := range properties {
+		if p.Property == IMPORTED_PROPERTY && p.Value != "-" {
+			return nil
+		}
+	}
+	commits, err := dotCommits(adminApiKey, dot, "")
+	if err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		return zfs.SetProperty(dataset, IMPORTED_PROPERTY, "none")
+	}
+	hasContents, err := directoryHasContents(mountpoint)
+	if err != nil {
+		return err
+	}
+	if !hasContents {
+		log.Printf("Nothing to import from %s into new dot %s", mountpoint, dot)
+		return zfs.SetProperty(dataset, IMPORTED_PROPERTY, "none")
+	}
+
+	log.Printf("Importing existing contents of %s into dot %s...", mountpoint, dot)
+	// Anything copied before an interrupted import is copied over again.
+	err = copyDirectoryContents(mountpoint, dotMountpoint)
+	if err != nil {
+		return err
+	}
+
+	commitId, err := commitDot(
+		adminApiKey, dot, "",
+		fmt.Sprintf("Imported existing data from %s:%s", hostname(), mountpoint),
+		"import", map[string]string{"source": mountpoint},
+	)
+	if err != nil {
+		return fmt.Errorf("commit of imported data failed: %v", err)
+	}
+	err = zfs.SetProperty(dataset, IMPORTED_PROPERTY, commitId)
+	if err != nil {
+		return err
+	}
+	log.Printf(
+		"Imported %s into dot %s as commit %s. The original files remain "+
+			"underneath the mount and can be removed once you're happy.",
+		mountpoint, dot, commitId,
+	)
+	return nil
+}
+
+// directoryHasContents returns true if directory exists and contains at least
+// one entry.
+func directoryHasContents(directory string) (bool, error) {
+	f, err := os.Open(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyDirectoryContents copies everything inside from into to, preserving
+// ownership, permissions, timestamps, xattrs (and therefore ACLs) and
+// hardlinks, and, with GNU cp, keeping sparse files sparse.
+func copyDirectoryContents(from, to string) error {
+	// -a implies --preserve=all, which covers ownership, xattrs and links.
+	// Copying "from/." rather than "from/*" picks up dotfiles too.
+	args := []string{"-a", from + "/.", to}
+	if gnuCp() {
+		args = append([]string{"--sparse=always"}, args...)
+	}
+	cmd := exec.Command(CP, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cp failed (%v): %s", err, output)
+	}
+	return nil
+}
+
+// gnuCp says whether cp is GNU's, which is the only one with --sparse. Others,
+// e.g. busybox's, still have -a.
+func gnuCp() bool {
+	output, err := exec.Command(CP, "--version").CombinedOutput()
+	return err == nil && strings.Contains(string(output), "GNU")
+}
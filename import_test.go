@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useFakeDotmesh points dotmeshAddress at h's fake dotmesh-server, returning
+// a func to put it back.
+func useFakeDotmesh(h *harness) func() {
+	address := dotmeshAddress
+	dotmeshAddress = strings.TrimPrefix(h.server.URL, "http://")
+	return func() { dotmeshAddress = address }
+}
+
+func TestImportExistingData(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	h.dotmesh.dots["test"] = "fs-test"
+	from := filepath.Join(h.dir, "existing")
+	to := filepath.Join(h.dir, "dot")
+	for _, dir := range []string{filepath.Join(from, "sub"), to} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.writeFile("existing/data", "new")
+	h.writeFile("existing/.hidden", "dotfile")
+	h.writeFile("existing/sub/file", "nested")
+	// Left over from an import that was interrupted before it committed.
+	h.writeFile("dot/data", "old")
+	zfs := newFakeZFS()
+	zfs.filesystems["pool/dmfs/fs-test"] = true
+
+	if err := importExistingData(zfs, "pool/dmfs/fs-test", "apikey", "test", from, to); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"data": "new", ".hidden": "dotfile", "sub/file": "nested",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(to, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", name, expected, content, err)
+		}
+	}
+	commits := h.dotmesh.commits["test"]
+	if len(commits) != 1 || commits[0].Metadata["trigger"] != "import" ||
+		commits[0].Metadata["source"] != from {
+		t.Fatalf("expected one import commit, got %+v", commits)
+	}
+	if marker := zfs.properties["pool/dmfs/fs-test"][IMPORTED_PROPERTY]; marker != commits[0].Id {
+		t.Errorf("expected the import marked done with %s, got %q", commits[0].Id, marker)
+	}
+
+	// Now it's been imported, there's nothing more to import.
+	h.writeFile("existing/later", "later")
+	if err := importExistingData(zfs, "pool/dmfs/fs-test", "apikey", "test", from, to); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(to, "later")); !os.IsNotExist(err) {
+		t.Errorf("imported into a dot with commits: %v", err)
+	}
+	if n := len(h.dotmesh.commits["test"]); n != 1 {
+		t.Errorf("expected no more commits, got %d", n)
+	}
+}
+
+func TestImportExistingDataNothingThere(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	h.dotmesh.dots["test"] = "fs-test"
+	if err := os.Mkdir(filepath.Join(h.dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, from := range []string{"empty", "missing"} {
+		zfs := newFakeZFS()
+		zfs.filesystems["pool/dmfs/fs-test"] = true
+		err := importExistingData(zfs, "pool/dmfs/fs-test", "apikey", "test", filepath.Join(h.dir, from), filepath.Join(h.dir, "dot"))
+		if err != nil {
+			t.Errorf("%s: %v", from, err)
+		}
+		if marker := zfs.properties["pool/dmfs/fs-test"][IMPORTED_PROPERTY]; marker != "none" {
+			t.Errorf("%s: expected the import marked done, got %q", from, marker)
+		}
+	}
+	if n := len(h.dotmesh.commits["test"]); n != 0 {
+		t.Errorf("expected no commits, got %d", n)
+	}
+}
+
+func TestImportExistingDataOnlyOnce(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	defer useFakeDotmesh(h)()
+	h.dotmesh.dots["test"] = "fs-test"
+	from := filepath.Join(h.dir, "existing")
+	to := filepath.Join(h.dir, "dot")
+	for _, dir := range []string{from, to} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zfs := newFakeZFS()
+	zfs.filesystems["pool/dmfs/fs-test"] = true
+	zfs.properties["pool/dmfs/fs-test"] = map[string]string{IMPORTED_PROPERTY: "none"}
+	// Written to the dot since the import, but not yet committed.
+	h.writeFile("dot/data", "newer")
+	h.writeFile("existing/data", "stale")
+
+	if err := importExistingData(zfs, "pool/dmfs/fs-test", "apikey", "test", from, to); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(to, "data"))
+	if err != nil || string(content) != "newer" {
+		t.Errorf("expected the dot's data kept, got %q (%v)", content, err)
+	}
+	if n := len(h.dotmesh.commits["test"]); n != 0 {
+		t.Errorf("expected no commits, got %d", n)
+	}
+}
@@ -0,0 +1,1309 @@
+package main
+
+// Integration tests which run the real main() in a subprocess (this test
+// binary, re-executed) against a fake dotmesh-server API and stub zpool, zfs,
+// etcd and dotmesh-server executables on the PATH. Mounts go to a mount.Fake,
+// which the subprocess dumps as JSON when main() returns.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"dm-linuxkit/mount"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+)
+
+const runMainEnv = "DM_LINUXKIT_TEST_RUN_MAIN"
+const fakeMountsEnv = "DM_LINUXKIT_TEST_FAKE_MOUNTS"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "1" {
+		os.Exit(m.Run())
+	}
+	fake := mount.NewFake()
+	mounter = fake
+	main()
+	mounts, err := json.Marshal(fake.Mounts())
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(os.Getenv(fakeMountsEnv), mounts, 0600)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(0)
+}
+
+// Stub executables. They log their arguments to $STUB_STATE/calls, and keep
+// pools and filesystems as files in $STUB_STATE. The dataset or pool is
+// always the last argument.
+var stubs = map[string]string{
+	"zpool": `#!/bin/sh
+echo "zpool $*" >> "$STUB_STATE/calls"
+for last; do :; done
+case "$1" in
+list)
+	[ -e "$STUB_STATE/pool-$last" ] || { echo "cannot open '$last': no such pool" >&2; exit 1; }
+	printf '%s\t1073741824\t0\t1073741824\t0\t0\tONLINE\t1311768467294899695\n' "$last"
+	;;
+status)
+	# Like ZFS before 0.8, which has no status -p.
+	case "$2" in -*) echo "invalid option '${2#-}'" >&2; exit 2 ;; esac
+	health=ONLINE
+	[ -e "$STUB_STATE/health-$last" ] && health=$(cat "$STUB_STATE/health-$last")
+	printf '  pool: %s\n state: %s\nconfig:\n\n' "$last" "$health"
+	printf '\tNAME STATE READ WRITE CKSUM\n\t%s %s 0 0 0\n\t  disk %s 0 0 0\n\n' "$last" "$health" "$health"
+	printf 'errors: No known data errors\n'
+	;;
+get)
+	printf '%s\t%s\t-\t-\n' "$last" "$4"
+	;;
+create)
+	touch "$STUB_STATE/pool-$3"
+	;;
+esac
+`,
+	"zfs": `#!/bin/sh
+echo "zfs $*" >> "$STUB_STATE/calls"
+for last; do :; done
+f="$STUB_STATE/fs-$(echo "$last" | tr / _)"
+# Dots' datasets are dotmesh-server's business, so pretend they're there.
+case "$last" in */dmfs/*) touch "$f" ;; esac
+case "$1" in
+list)
+	[ -e "$f" ] || { echo "cannot open '$last': dataset does not exist" >&2; exit 1; }
+	printf '%s\t0\t0\t0\tlegacy\n' "$last"
+	case " $* " in *" -r "*)
+		for child in "$f"_*; do
+			[ -e "$child" ] || continue
+			printf '%s\t0\t0\t0\tlegacy\n' "$(basename "$child" | sed 's/^fs-//; s|_|/|g')"
+		done
+	esac
+	;;
+create)
+	touch "$f"
+	;;
+set)
+	echo "$2" >> "$f"
+	;;
+get)
+	for p in $(echo "$6" | tr , ' '); do
+		v=$(grep "^$p=" "$f" 2>/dev/null | tail -n 1 | cut -d= -f2-)
+		printf '%s\t%s\t%s\t-\n' "$last" "$p" "${v:--}"
+	done
+	;;
+esac
+`,
+	"etcd": `#!/bin/sh
+echo "etcd $*" >> "$STUB_STATE/calls"
+echo "etcd is ready to serve client requests"
+exec sleep 600
+`,
+	"dotmesh-server": `#!/bin/sh
+echo "dotmesh-server $*" >> "$STUB_STATE/calls"
+exec sleep 600
+`,
+}
+
+// fakeDotmesh implements enough of dotmesh-server's DotmeshRPC API for
+// dm-linuxkit, recording what it's asked to do.
+type fakeDotmesh struct {
+	mu       sync.Mutex
+	dots     map[string]string // name -> filesystem ID
+	branches map[string]string // name@branch -> filesystem ID, besides master
+	calls    []string
+
+	commits    map[string][]DotmeshCommit // name -> commits, oldest first
+	dirtyBytes map[string]int64           // filesystem ID -> uncommitted bytes
+
+	transfer  TransferRequest
+	transfers []TransferPollResult // successive GetTransfer results, last repeats
+	polls     int
+}
+
+// DotName is exported because gorilla/rpc only registers methods whose
+// argument types are.
+type DotName struct {
+	Namespace string
+	Name      string
+	Branch    string
+}
+
+func (d *fakeDotmesh) record(call string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, call)
+}
+
+func (d *fakeDotmesh) Ping(r *http.Request, args *struct{}, result *bool) error {
+	d.record("Ping")
+	*result = true
+	return nil
+}
+
+func (d *fakeDotmesh) Exists(r *http.Request, args *DotName, result *string) error {
+	d.record("Exists " + args.Name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*result = d.dots[args.Name]
+	return nil
+}
+
+func (d *fakeDotmesh) Create(r *http.Request, args *DotName, result *bool) error {
+	d.record("Create " + args.Name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.dots[args.Name]; ok {
+		return fmt.Errorf("%s already exists", args.Name)
+	}
+	d.dots[args.Name] = "fs-" + args.Name
+	*result = true
+	return nil
+}
+
+func (d *fakeDotmesh) Lookup(r *http.Request, args *DotName, result *string) error {
+	d.record("Lookup " + args.Name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id, ok := d.dots[args.Name]
+	if !ok {
+		return fmt.Errorf("no such dot %s", args.Name)
+	}
+	if args.Branch != "" {
+		if id, ok = d.branches[args.Name+"@"+args.Branch]; !ok {
+			return fmt.Errorf("no such branch %s", args.Branch)
+		}
+	}
+	*result = id
+	return nil
+}
+
+// RegisterFilesystemArgs is exported for gorilla/rpc, like DotName.
+type RegisterFilesystemArgs struct {
+	Namespace              string
+	TopLevelFilesystemName string
+	CloneName              string
+	FilesystemId           string
+}
+
+func (d *fakeDotmesh) RegisterFilesystem(r *http.Request, args *RegisterFilesystemArgs, result *bool) error {
+	d.record("RegisterFilesystem " + args.TopLevelFilesystemName + " " + args.FilesystemId)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.dots[args.TopLevelFilesystemName]; ok {
+		return fmt.Errorf("%s already exists", args.TopLevelFilesystemName)
+	}
+	d.dots[args.TopLevelFilesystemName] = args.FilesystemId
+	*result = true
+	return nil
+}
+
+func (d *fakeDotmesh) Transfer(r *http.Request, args *TransferRequest, result *string) error {
+	d.record("Transfer " + args.LocalName)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.transfer = *args
+	*result = "transfer-1"
+	return nil
+}
+
+func (d *fakeDotmesh) GetTransfer(r *http.Request, args *string, result *TransferPollResult) error {
+	d.record("GetTransfer " + *args)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.polls
+	if i >= len(d.transfers) {
+		i = len(d.transfers) - 1
+	}
+	d.polls++
+	*result = d.transfers[i]
+	if result.Status == "finished" {
+		// A pull creates the dot locally.
+		d.dots[d.transfer.LocalName] = "fs-" + d.transfer.LocalName
+	}
+	return nil
+}
+
+// CommitArgs is exported for gorilla/rpc, like DotName.
+type CommitArgs struct {
+	Namespace string
+	Name      string
+	Branch    string
+	Message   string
+	Metadata  map[string]string
+}
+
+func (d *fakeDotmesh) Commit(r *http.Request, args *CommitArgs, result *string) error {
+	name := args.Name
+	if args.Branch != "" {
+		name += "@" + args.Branch
+	}
+	d.record("Commit " + name + " " + args.Message + " trigger=" + args.Metadata["trigger"])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.commits == nil {
+		d.commits = map[string][]DotmeshCommit{}
+	}
+	*result = fmt.Sprintf("commit-%d", len(d.commits[args.Name])+1)
+	d.commits[args.Name] = append(d.commits[args.Name], DotmeshCommit{Id: *result, Metadata: args.Metadata})
+	// Everything's committed now.
+	delete(d.dirtyBytes, d.dots[args.Name])
+	return nil
+}
+
+// VersionInfo is exported for gorilla/rpc, like DotName.
+type VersionInfo struct {
+	InstalledVersion string
+}
+
+func (d *fakeDotmesh) Version(r *http.Request, args *struct{}, result *VersionInfo) error {
+	d.record("Version")
+	result.InstalledVersion = "0.5.0"
+	return nil
+}
+
+// DotmeshVolume is exported for gorilla/rpc, like DotName.
+type DotmeshVolume struct {
+	Id         string
+	Branch     string
+	DirtyBytes int64
+}
+
+func (d *fakeDotmesh) Get(r *http.Request, args *string, result *DotmeshVolume) error {
+	d.record("Get " + *args)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*result = DotmeshVolume{Id: *args, DirtyBytes: d.dirtyBytes[*args]}
+	return nil
+}
+
+// CommitsArgs is exported for gorilla/rpc, like DotName.
+type CommitsArgs struct {
+	Namespace string
+	Name      string
+	Branch    string
+}
+
+// DotmeshCommit is exported for gorilla/rpc, like DotName.
+type DotmeshCommit struct {
+	Id       string
+	Metadata map[string]string
+}
+
+func (d *fakeDotmesh) Commits(r *http.Request, args *CommitsArgs, result *[]DotmeshCommit) error {
+	d.record("Commits " + args.Name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*result = append([]DotmeshCommit{}, d.commits[args.Name]...)
+	return nil
+}
+
+func (d *fakeDotmesh) called(call string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+// harness is one run of dm-linuxkit against fakes.
+type harness struct {
+	t       *testing.T
+	dir     string
+	state   string
+	dotmesh *fakeDotmesh
+	server  *httptest.Server
+	args    []string
+}
+
+func newHarness(t *testing.T) *harness {
+	dir, err := ioutil.TempDir("", "dm-linuxkit-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		t:       t,
+		dir:     dir,
+		state:   filepath.Join(dir, "state"),
+		dotmesh: &fakeDotmesh{dots: map[string]string{}},
+	}
+
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{bin, h.state} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range stubs {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := rpc.NewServer()
+	server.RegisterCodec(json2.NewCodec(), "application/json")
+	if err := server.RegisterService(h.dotmesh, "DotmeshRPC"); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", server)
+	h.server = httptest.NewServer(mux)
+
+	h.writeFile("admin-password", "password")
+	h.writeFile("admin-api-key", "apikey")
+	h.args = []string{
+		"-dot=test",
+		"-storage-device=" + filepath.Join(dir, "disk.img"),
+		"-mountpoint=" + filepath.Join(dir, "mnt", "test"),
+		"-oneshot",
+		"-pool-name=testpool",
+		"-dotmesh-address=" + strings.TrimPrefix(h.server.URL, "http://"),
+		"-etcd-data-dir=" + filepath.Join(dir, "etcd"),
+		"-admin-password-file=" + filepath.Join(dir, "admin-password"),
+		"-admin-api-key-file=" + filepath.Join(dir, "admin-api-key"),
+		"-seed-file=" + filepath.Join(dir, "seed"),
+		"-credentials-file=" + filepath.Join(dir, "credentials"),
+		"-ready-dir=" + filepath.Join(dir, "ready"),
+	}
+	return h
+}
+
+func (h *harness) close() {
+	h.server.Close()
+	os.RemoveAll(h.dir)
+}
+
+func (h *harness) writeFile(name, content string) {
+	err := ioutil.WriteFile(filepath.Join(h.dir, name), []byte(content), 0600)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// run runs main() in a subprocess with the harness's args for up plus
+// extraArgs, and returns its exit code and output.
+func (h *harness) run(extraArgs ...string) (int, string) {
+	return h.runCommand(append(h.args, extraArgs...)...)
+}
+
+// runCommand runs main() in a subprocess with just args, e.g. a subcommand.
+func (h *harness) runCommand(args ...string) (int, string) {
+	cmd := h.start("output", args...)
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	return h.wait(cmd, "output"), h.output()
+}
+
+// start starts main() in a subprocess with args, its output going to the file
+// outputName.
+func (h *harness) start(outputName string, args ...string) *exec.Cmd {
+	outputFile, err := os.Create(filepath.Join(h.dir, outputName))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer outputFile.Close()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(),
+		runMainEnv+"=1",
+		fakeMountsEnv+"="+filepath.Join(h.dir, h.mountsFile(outputName)),
+		"STUB_STATE="+h.state,
+		"PATH="+filepath.Join(h.dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+	// Output goes to a file rather than a pipe, and everything runs in its
+	// own process group, so that stub etcd and dotmesh-server processes
+	// orphaned by a failed run can't keep us waiting.
+	cmd.Stdout = outputFile
+	cmd.Stderr = outputFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		h.t.Fatalf("couldn't run dm-linuxkit: %v", err)
+	}
+	return cmd
+}
+
+// wait waits up to a minute for a subprocess from start to exit, and returns
+// its exit code.
+func (h *harness) wait(cmd *exec.Cmd, outputName string) int {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		<-done
+		output, _ := ioutil.ReadFile(filepath.Join(h.dir, outputName))
+		h.t.Fatalf("dm-linuxkit didn't exit within a minute, output:\n%s", output)
+	}
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	h.t.Fatalf("couldn't run dm-linuxkit: %v", err)
+	return -1
+}
+
+func (h *harness) output() string {
+	output, err := ioutil.ReadFile(filepath.Join(h.dir, "output"))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return string(output)
+}
+
+func (h *harness) stubCalls() []string {
+	calls, err := ioutil.ReadFile(filepath.Join(h.state, "calls"))
+	if os.IsNotExist(err) {
+		// Nothing's been run yet.
+		return nil
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(calls)), "\n")
+}
+
+func (h *harness) assertStubCalled(prefix string) {
+	for _, c := range h.stubCalls() {
+		if strings.HasPrefix(c, prefix) {
+			return
+		}
+	}
+	h.t.Errorf("expected a call starting %q, got:\n%s", prefix, strings.Join(h.stubCalls(), "\n"))
+}
+
+func (h *harness) assertStubNotCalled(prefix string) {
+	for _, c := range h.stubCalls() {
+		if strings.HasPrefix(c, prefix) {
+			h.t.Errorf("unexpected call %q", c)
+		}
+	}
+}
+
+// mountsFile is where a subprocess from start writes the mounts it made when
+// it exits. A daemon gets its own, so CLI runs exiting after it don't
+// overwrite them.
+func (h *harness) mountsFile(outputName string) string {
+	if outputName == "output" {
+		return "mounts.json"
+	}
+	return outputName + "-mounts.json"
+}
+
+func (h *harness) mounts() map[string]mount.FakeMount {
+	return h.mountsOf("output")
+}
+
+func (h *harness) mountsOf(outputName string) map[string]mount.FakeMount {
+	mounts := map[string]mount.FakeMount{}
+	b, err := ioutil.ReadFile(filepath.Join(h.dir, h.mountsFile(outputName)))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &mounts); err != nil {
+		h.t.Fatal(err)
+	}
+	return mounts
+}
+
+func (h *harness) assertDotMounted(id string) {
+	target := filepath.Join(h.dir, "mnt", "test")
+	m, ok := h.mounts()[target]
+	if !ok {
+		h.t.Fatalf("nothing mounted at %s: %+v", target, h.mounts())
+	}
+	if m.Op != "bind" || m.Source != calculateMountpoint("testpool", id) {
+		h.t.Errorf("wrong mount at %s: %+v", target, m)
+	}
+}
+
+func TestIntegrationCreate(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zpool create -f testpool " + filepath.Join(h.dir, "disk.img"))
+	h.assertStubCalled("zfs create -o mountpoint=legacy testpool/dotmesh-etcd")
+	if !h.dotmesh.called("Create test") {
+		t.Errorf("dot wasn't created, calls: %v", h.dotmesh.calls)
+	}
+	h.assertDotMounted("fs-test")
+	if m := h.mounts()[filepath.Join(h.dir, "etcd")]; m.Source != "testpool/dotmesh-etcd" {
+		t.Errorf("etcd filesystem not mounted: %+v", h.mounts())
+	}
+}
+
+func TestIntegrationSdNotify(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	notify, done := listenNotify(t)
+	defer done()
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	messages := notifications(notify, 100*time.Millisecond)
+	expected := []string{
+		"STATUS=Setting up pool testpool",
+		"STATUS=Starting etcd",
+		"STATUS=Starting dotmesh",
+		"STATUS=Checking for lost dots",
+		"STATUS=Creating test",
+		"STATUS=Mounting test at " + filepath.Join(h.dir, "mnt", "test"),
+		"READY=1",
+		"STATUS=Stopping dotmesh and etcd",
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected notifications:\n%s\ngot:\n%s",
+			strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+}
+
+func TestIntegrationExistingDot(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	// A reboot: the pool, etcd filesystem and dot are all already there.
+	h.writeFile("state/pool-testpool", "")
+	h.writeFile("state/fs-testpool_dotmesh-etcd", "")
+	h.dotmesh.dots["test"] = "fs-existing"
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubNotCalled("zpool create")
+	h.assertStubNotCalled("zfs create")
+	if h.dotmesh.called("Create test") {
+		t.Errorf("existing dot was created again")
+	}
+	h.assertDotMounted("fs-existing")
+}
+
+func TestIntegrationTagsDot(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zfs set " + DOT_NAME_PROPERTY + "=admin/test testpool/dmfs/fs-test")
+}
+
+// lostEtcd sets up a reboot where the pool and the dot's dataset survived but
+// dotmesh's etcd data didn't.
+func (h *harness) lostEtcd() {
+	h.writeFile("state/pool-testpool", "")
+	h.writeFile("state/fs-testpool_dmfs", "")
+	h.writeFile("state/fs-testpool_dmfs_fs-old", DOT_NAME_PROPERTY+"=admin/test\n")
+}
+
+func TestIntegrationRecover(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.lostEtcd()
+
+	code, output := h.run("-recover")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if !h.dotmesh.called("RegisterFilesystem test fs-old") {
+		t.Errorf("dot wasn't registered, calls: %v", h.dotmesh.calls)
+	}
+	if h.dotmesh.called("Create test") {
+		t.Errorf("a new dot was created over the lost one")
+	}
+	h.assertDotMounted("fs-old")
+}
+
+func TestIntegrationLostDotNeedsRecover(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.lostEtcd()
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "WARN  dotmesh doesn't know about dot admin/test in dataset testpool/dmfs/fs-old") ||
+		!strings.Contains(output, "-recover") {
+		t.Errorf("expected a warning naming the dataset and -recover, output:\n%s", output)
+	}
+	if h.dotmesh.called("RegisterFilesystem test fs-old") {
+		t.Errorf("dot was registered without -recover, calls: %v", h.dotmesh.calls)
+	}
+}
+
+func TestIntegrationConfig(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("config.yaml", "dot:\n  quota: 5G\n  properties:\n    compression: lz4\n")
+
+	code, output := h.run("-config="+filepath.Join(h.dir, "config.yaml"), "-refquota=1G")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zfs set quota=5G testpool/dmfs/fs-test")
+	h.assertStubCalled("zfs set refquota=1G testpool/dmfs/fs-test")
+	h.assertStubCalled("zfs set compression=lz4 testpool/dmfs/fs-test")
+}
+
+func TestIntegrationConfigDots(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.dotmesh.branches = map[string]string{"test@reporting": "fs-reporting"}
+	uploads := filepath.Join(h.dir, "mnt", "uploads")
+	reporting := filepath.Join(h.dir, "mnt", "reporting")
+	h.writeFile("config.yaml", fmt.Sprintf(
+		"dots:\n"+
+			"  - name: uploads\n    mountpoint: %s\n    quota: 1G\n"+
+			"  - name: test\n    branch: reporting\n    mountpoint: %s\n    readOnly: true\n",
+		uploads, reporting,
+	))
+
+	code, output := h.run("-config=" + filepath.Join(h.dir, "config.yaml"))
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertDotMounted("fs-test")
+	if !h.dotmesh.called("Create uploads") {
+		t.Errorf("uploads wasn't created, calls: %v", h.dotmesh.calls)
+	}
+	h.assertStubCalled("zfs set quota=1G testpool/dmfs/fs-uploads")
+	h.assertStubCalled("zfs set " + DOT_NAME_PROPERTY + "=admin/uploads testpool/dmfs/fs-uploads")
+	// The branch's filesystem isn't the dot's, for recovery.
+	h.assertStubNotCalled("zfs set " + DOT_NAME_PROPERTY + "=admin/test testpool/dmfs/fs-reporting")
+
+	mounts := h.mounts()
+	if m := mounts[uploads]; m.Source != calculateMountpoint("testpool", "fs-uploads") {
+		t.Errorf("wrong mount at %s: %+v", uploads, mounts)
+	}
+	if m := mounts[reporting]; m.Source != calculateMountpoint("testpool", "fs-reporting") || !m.Options.ReadOnly {
+		t.Errorf("wrong mount at %s: %+v", reporting, mounts)
+	}
+	h.assertReady(uploads, DaemonMount{Dot: "uploads", Id: "fs-uploads", Mountpoint: uploads})
+	h.assertReady(reporting, DaemonMount{
+		Dot: "test", Branch: "reporting", Id: "fs-reporting", Mountpoint: reporting, ReadOnly: true,
+	})
+}
+
+func TestIntegrationMissingBranch(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.run("-branch=nope")
+	if code == 0 {
+		t.Fatalf("expected a failure, output:\n%s", output)
+	}
+	if !strings.Contains(output, "can't find branch nope of dot test") {
+		t.Errorf("expected the missing branch to be named, output:\n%s", output)
+	}
+}
+
+func TestIntegrationBadConfig(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("config.yaml", "dot:\n  qouta: 5G\n")
+
+	code, output := h.run("-config=" + filepath.Join(h.dir, "config.yaml"))
+	if code == 0 {
+		t.Fatalf("expected a failure, output:\n%s", output)
+	}
+	if !strings.Contains(output, "ERROR") || !strings.Contains(output, "line 2: field qouta not found") {
+		t.Errorf("expected a line-numbered error, logged at error level, output:\n%s", output)
+	}
+	h.assertStubNotCalled("zpool")
+}
+
+func TestIntegrationMetadata(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("metadata.json", `{"dotmesh": {"entries": {
+		"admin-api-key": {"content": "apikey"},
+		"admin-password": {"content": "password"},
+		"config": {"content": "dot:\n  quota: 5G\n"}
+	}}}`)
+
+	code, output := h.run("-metadata=" + filepath.Join(h.dir, "metadata.json"))
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "Metadata has admin-api-key, admin-password, config; doesn't have credentials, seed") {
+		t.Errorf("expected a report of the metadata found, output:\n%s", output)
+	}
+	h.assertStubCalled("zfs set quota=5G testpool/dmfs/fs-test")
+	h.assertDotMounted("fs-test")
+}
+
+// commonArgs are the flags every subcommand needs to find the pool and the
+// fake dotmesh.
+func (h *harness) commonArgs() []string {
+	return []string{
+		"-pool-name=testpool",
+		"-dotmesh-address=" + strings.TrimPrefix(h.server.URL, "http://"),
+		"-admin-api-key-file=" + filepath.Join(h.dir, "admin-api-key"),
+	}
+}
+
+func TestIntegrationInit(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.runCommand(append([]string{
+		"init",
+		"-storage-device=" + filepath.Join(h.dir, "disk.img"),
+		"-etcd-data-dir=" + filepath.Join(h.dir, "etcd"),
+	}, h.commonArgs()...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zpool create -f testpool " + filepath.Join(h.dir, "disk.img"))
+	h.assertStubCalled("zfs create -o mountpoint=legacy testpool/dotmesh-etcd")
+	h.assertStubNotCalled("etcd")
+	h.assertStubNotCalled("dotmesh-server")
+	if len(h.dotmesh.calls) != 0 {
+		t.Errorf("init shouldn't talk to dotmesh, calls: %v", h.dotmesh.calls)
+	}
+}
+
+func TestIntegrationMountCommand(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	target := filepath.Join(h.dir, "mnt", "other")
+
+	readyDir := filepath.Join(h.dir, "ready")
+
+	code, output := h.runCommand(append([]string{
+		"mount", "-dot=other", "-mountpoint=" + target, "-ro", "-ready-dir=" + readyDir,
+	}, h.commonArgs()...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if !h.dotmesh.called("Create other") {
+		t.Errorf("dot wasn't created, calls: %v", h.dotmesh.calls)
+	}
+	m, ok := h.mounts()[target]
+	if !ok || m.Source != calculateMountpoint("testpool", "fs-other") || !m.Options.ReadOnly {
+		t.Errorf("wrong mount at %s: %+v", target, h.mounts())
+	}
+	h.assertReady(target, DaemonMount{Dot: "other", Id: "fs-other", Mountpoint: target, ReadOnly: true})
+}
+
+// assertReady checks up, mount or the daemon wrote mountpoint's ready file,
+// saying m is mounted there.
+func (h *harness) assertReady(mountpoint string, m DaemonMount) {
+	content, err := ioutil.ReadFile(readyFilePath(filepath.Join(h.dir, "ready"), mountpoint))
+	if err != nil {
+		h.t.Fatalf("no ready file for %s: %v", mountpoint, err)
+	}
+	var ready DaemonMount
+	if err := json.Unmarshal(content, &ready); err != nil {
+		h.t.Fatalf("bad ready file for %s: %v", mountpoint, err)
+	}
+	if ready != m {
+		h.t.Errorf("expected ready file for %s to say %+v, got %+v", mountpoint, m, ready)
+	}
+}
+
+func (h *harness) assertNotReady(mountpoint string) {
+	_, err := os.Stat(readyFilePath(filepath.Join(h.dir, "ready"), mountpoint))
+	if !os.IsNotExist(err) {
+		h.t.Errorf("ready file for %s left behind: %v", mountpoint, err)
+	}
+}
+
+func TestIntegrationWait(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	target := filepath.Join(h.dir, "mnt", "test")
+	waitArgs := []string{"wait", "-mount=" + target, "-ready-dir=" + filepath.Join(h.dir, "ready")}
+
+	code, output := h.runCommand(append(waitArgs, "-timeout=200ms")...)
+	if code == 0 || !strings.Contains(output, "timed out after 200ms waiting for "+target) {
+		t.Errorf("expected wait to time out, got exit code %d, output:\n%s", code, output)
+	}
+
+	waiter := h.start("wait-output", append(waitArgs, "sh", "-c", "echo waited for $0", target)...)
+	defer syscall.Kill(-waiter.Process.Pid, syscall.SIGKILL)
+	time.Sleep(500 * time.Millisecond)
+	if output, _ := ioutil.ReadFile(filepath.Join(h.dir, "wait-output")); len(output) > 0 {
+		t.Fatalf("wait shouldn't run its command until the dot's mounted, output:\n%s", output)
+	}
+
+	if code, output := h.run(); code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertReady(target, DaemonMount{Dot: "test", Id: "fs-test", Mountpoint: target})
+	if code := h.wait(waiter, "wait-output"); code != 0 {
+		t.Errorf("expected wait to exit cleanly, got %d", code)
+	}
+	waitOutput, _ := ioutil.ReadFile(filepath.Join(h.dir, "wait-output"))
+	if string(waitOutput) != "waited for "+target+"\n" {
+		t.Errorf("wait didn't run its command, output:\n%s", waitOutput)
+	}
+}
+
+// freeAddress returns a localhost address nothing's listening on.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startDaemon starts up without -oneshot, and waits for it to write its pid
+// file and start serving its control API.
+func (h *harness) startDaemon(pidFile, socket string, extraArgs ...string) *exec.Cmd {
+	var args []string
+	for _, arg := range h.args {
+		if arg != "-oneshot" {
+			args = append(args, arg)
+		}
+	}
+	daemon := h.start("daemon-output", append(append([]string{
+		"up", "-pid-file=" + pidFile, "-control-socket=" + socket,
+	}, extraArgs...), args...)...)
+
+	for i := 0; ; i++ {
+		_, pidErr := os.Stat(pidFile)
+		_, socketErr := os.Stat(socket)
+		if pidErr == nil && socketErr == nil {
+			return daemon
+		}
+		if i == 300 {
+			syscall.Kill(-daemon.Process.Pid, syscall.SIGKILL)
+			output, _ := ioutil.ReadFile(filepath.Join(h.dir, "daemon-output"))
+			h.t.Fatalf("daemon didn't start, output:\n%s", output)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestIntegrationDaemonDown(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	pidFile := filepath.Join(h.dir, "dm-linuxkit.pid")
+	socket := filepath.Join(h.dir, "dm-linuxkit.sock")
+
+	daemon := h.startDaemon(pidFile, socket)
+	defer syscall.Kill(-daemon.Process.Pid, syscall.SIGKILL)
+
+	// Without the socket, down falls back to signalling the pid.
+	code, output := h.runCommand(
+		"down", "-pid-file="+pidFile, "-control-socket="+filepath.Join(h.dir, "nonexistent.sock"),
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if code := h.wait(daemon, "daemon-output"); code != 0 {
+		t.Errorf("expected the daemon to exit cleanly, got %d", code)
+	}
+	daemonOutput, _ := ioutil.ReadFile(filepath.Join(h.dir, "daemon-output"))
+	if !strings.Contains(string(daemonOutput), "stopping dotmesh and etcd") {
+		t.Errorf("daemon didn't stop its children, output:\n%s", daemonOutput)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("pid file left behind: %v", err)
+	}
+}
+
+func TestIntegrationControl(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	pidFile := filepath.Join(h.dir, "dm-linuxkit.pid")
+	socket := filepath.Join(h.dir, "dm-linuxkit.sock")
+	first := filepath.Join(h.dir, "mnt", "first")
+	second := filepath.Join(h.dir, "mnt", "second")
+
+	// The dot up's configured with, mounted by an earlier -oneshot.
+	h.dotmesh.dots["test"] = "fs-test"
+
+	metricsAddress := freeAddress(t)
+	daemon := h.startDaemon(pidFile, socket, "-metrics-address="+metricsAddress)
+	defer syscall.Kill(-daemon.Process.Pid, syscall.SIGKILL)
+
+	runOK := func(args ...string) string {
+		code, output := h.runCommand(append(args, "-control-socket="+socket)...)
+		if code != 0 {
+			t.Fatalf("%s: expected exit code 0, got %d, output:\n%s", args[0], code, output)
+		}
+		return output
+	}
+	runOK(append([]string{"mount", "-dot=first", "-mountpoint=" + first}, h.commonArgs()...)...)
+	runOK(append([]string{"mount", "-dot=second", "-mountpoint=" + second, "-ro"}, h.commonArgs()...)...)
+	h.assertReady(first, DaemonMount{Dot: "first", Id: "fs-first", Mountpoint: first})
+
+	// The fake mounts are in the daemon's process, so status doesn't see
+	// them.
+	output := runOK(append([]string{"status"}, h.commonArgs()...)...)
+	for _, expected := range []string{
+		"dot first: id fs-first, branch master, latest commit none, clean, 0 bytes used, 0 available, quota none, refquota none, NOT mounted at " + first,
+		"dot second: id fs-second, branch master, latest commit none, clean, 0 bytes used, 0 available, quota none, refquota none, NOT mounted at " + second,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("status should say %q, output:\n%s", expected, output)
+		}
+	}
+
+	resp, err := http.Get("http://" + metricsAddress + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scraped, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`dm_linuxkit_pool_size_bytes{pool="testpool"} 1.073741824e+09`,
+		`dm_linuxkit_pool_health{pool="testpool",health="ONLINE"} 1`,
+		`dm_linuxkit_dot_used_bytes{dot="first",mountpoint="` + first + `"} 0`,
+		`dm_linuxkit_dot_used_bytes{dot="test",mountpoint="` + filepath.Join(h.dir, "mnt", "test") + `"} 0`,
+		`dm_linuxkit_child_up{process="etcd"} 1`,
+		`dm_linuxkit_child_starts_total{process="dotmesh-server"} 1`,
+		`dm_linuxkit_rpc_requests_total{method="DotmeshRPC.Create"} 2`,
+		`dm_linuxkit_rpc_duration_seconds_bucket{method="DotmeshRPC.Create",le="+Inf"} 2`,
+		`dm_linuxkit_rpc_duration_seconds_count{method="DotmeshRPC.Create"} 2`,
+	} {
+		if !strings.Contains(string(scraped), expected+"\n") {
+			t.Errorf("metrics should include %s, got:\n%s", expected, scraped)
+		}
+	}
+
+	runOK("unmount", "-mountpoint="+first)
+	h.assertNotReady(first)
+	output = runOK(append([]string{"commit", "-dot=second", "-m=checkpoint"}, h.commonArgs()...)...)
+	if !strings.Contains(output, "Committed second as commit-1") {
+		t.Errorf("commit didn't report the commit ID, output:\n%s", output)
+	}
+	if !h.dotmesh.called("Commit second checkpoint trigger=control") {
+		t.Errorf("daemon didn't commit, calls: %v", h.dotmesh.calls)
+	}
+
+	runOK("down", "-pid-file="+filepath.Join(h.dir, "nonexistent.pid"))
+	if code := h.wait(daemon, "daemon-output"); code != 0 {
+		t.Errorf("expected the daemon to exit cleanly, got %d", code)
+	}
+	daemonOutput, _ := ioutil.ReadFile(filepath.Join(h.dir, "daemon-output"))
+	if !strings.Contains(string(daemonOutput), "Asked to shut down over the control API") {
+		t.Errorf("daemon wasn't stopped over the control API, output:\n%s", daemonOutput)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("control socket left behind: %v", err)
+	}
+
+	// The daemon writes its mounts when it exits.
+	mounts := h.mountsOf("daemon-output")
+	if _, ok := mounts[first]; ok {
+		t.Errorf("%s should have been unmounted: %+v", first, mounts)
+	}
+	if m, ok := mounts[second]; !ok || m.Source != calculateMountpoint("testpool", "fs-second") {
+		t.Errorf("wrong mount at %s: %+v", second, mounts)
+	}
+}
+
+func TestIntegrationStatusJSON(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	if code, output := h.run("-quota=5G", "-etcd-reservation=256M"); code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.dotmesh.commits = map[string][]DotmeshCommit{"test": {
+		{Id: "commit-1"},
+		{Id: "commit-2", Metadata: map[string]string{"timestamp": "1530446400000000000"}},
+	}}
+	h.dotmesh.dirtyBytes = map[string]int64{"fs-test": 4096}
+	mountpoint := filepath.Join(h.dir, "mnt", "test")
+
+	code, output := h.runCommand(append([]string{
+		"status", "-json", "-dot=test", "-mountpoint=" + mountpoint,
+		"-control-socket=" + filepath.Join(h.dir, "nonexistent.sock"),
+		"-pid-file=" + filepath.Join(h.dir, "nonexistent.pid"),
+	}, h.commonArgs()...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	var report statusReport
+	// The report is the only thing starting a line with {.
+	start := strings.Index("\n"+output, "\n{\n")
+	if start < 0 {
+		t.Fatalf("no JSON in output:\n%s", output)
+	}
+	if err := json.Unmarshal([]byte(output[start:]), &report); err != nil {
+		t.Fatalf("bad JSON: %v, output:\n%s", err, output)
+	}
+
+	if report.Pool.Name != "testpool" || report.Pool.Health != "ONLINE" ||
+		report.Pool.Id != "1234567890abcdef" || report.Pool.Size != 1073741824 {
+		t.Errorf("wrong pool status: %+v", report.Pool)
+	}
+	if report.Etcd.Healthy || report.Etcd.Error == "" {
+		t.Errorf("etcd should be unhealthy with no etcdctl: %+v", report.Etcd)
+	}
+	if report.Etcd.Dataset != "testpool/dotmesh-etcd" || report.Etcd.UsageError != "" ||
+		report.Etcd.Reservation != "256M" || report.Etcd.Quota != "none" {
+		t.Errorf("wrong etcd usage: %+v", report.Etcd)
+	}
+	if !report.Dotmesh.Up || report.Dotmesh.Version != "0.5.0" || report.Dotmesh.PingSeconds <= 0 {
+		t.Errorf("wrong dotmesh status: %+v", report.Dotmesh)
+	}
+	if report.Daemon.Running {
+		t.Errorf("daemon shouldn't be running: %+v", report.Daemon)
+	}
+	committed := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	expected := []dotStatus{{
+		Name:             "test",
+		Id:               "fs-test",
+		Branch:           "master",
+		LatestCommit:     "commit-2",
+		LatestCommitTime: &committed,
+		Dirty:            true,
+		DirtyBytes:       4096,
+		// The stub zfs reports values as they were set, not in bytes.
+		Quota:      "5G",
+		Refquota:   "none",
+		Mountpoint: mountpoint,
+		// The oneshot run's fake mount went with it.
+		Mounted: false,
+	}}
+	if !reflect.DeepEqual(report.Dots, expected) {
+		t.Errorf("expected dots %+v, got %+v", expected, report.Dots)
+	}
+}
+
+func TestIntegrationScheduledCommits(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	if code, output := h.run(); code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.dotmesh.dirtyBytes = map[string]int64{"fs-test": 4096}
+	pidFile := filepath.Join(h.dir, "dm-linuxkit.pid")
+	socket := filepath.Join(h.dir, "dm-linuxkit.sock")
+
+	daemon := h.startDaemon(pidFile, socket, "-commit-schedule=300ms")
+	defer syscall.Kill(-daemon.Process.Pid, syscall.SIGKILL)
+
+	for i := 0; !h.dotmesh.called("Commit test Scheduled commit (300ms) trigger=schedule"); i++ {
+		if i == 100 {
+			t.Fatalf("dot wasn't committed on schedule, calls: %v", h.dotmesh.calls)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Nothing's changed since, so there are no more commits.
+	time.Sleep(time.Second)
+	h.dotmesh.mu.Lock()
+	commits := len(h.dotmesh.commits["test"])
+	h.dotmesh.mu.Unlock()
+	if commits != 1 {
+		t.Errorf("expected one scheduled commit of an unchanged dot, got %d", commits)
+	}
+
+	code, output := h.runCommand(append([]string{
+		"status", "-json", "-control-socket=" + socket,
+	}, h.commonArgs()...)...)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	var report statusReport
+	if err := json.Unmarshal([]byte(output[strings.Index(output, "{"):]), &report); err != nil {
+		t.Fatalf("bad JSON: %v, output:\n%s", err, output)
+	}
+	if len(report.Dots) != 1 || report.Dots[0].CommitSchedule == nil {
+		t.Fatalf("expected the scheduled dot in status, got %+v", report.Dots)
+	}
+	schedule := report.Dots[0].CommitSchedule
+	if schedule.Schedule != "300ms" || schedule.LastCommit != "commit-1" ||
+		schedule.LastCommitTime == nil || schedule.Next == nil || schedule.LastError != "" {
+		t.Errorf("wrong schedule status: %+v", schedule)
+	}
+	if report.Dots[0].LatestCommit != "commit-1" || report.Dots[0].LatestCommitTime == nil {
+		t.Errorf("wrong latest commit: %+v", report.Dots[0])
+	}
+}
+
+func TestIntegrationJSONLogs(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.run("-log-format=json")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	phases := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("line isn't JSON: %q", line)
+		}
+		if phase, ok := fields["phase"].(string); ok {
+			phases[phase] = true
+		}
+		if fields["msg"] == "Created dot test!" && fields["dot"] != "test" {
+			t.Errorf("expected a dot field: %q", line)
+		}
+		if fields["level"] == "debug" {
+			t.Errorf("debug logged at the default level: %q", line)
+		}
+	}
+	for _, phase := range []string{"pool", "etcd", "dotmesh", "create", "mount", "shutdown"} {
+		if !phases[phase] {
+			t.Errorf("nothing logged in phase %s, output:\n%s", phase, output)
+		}
+	}
+}
+
+func TestIntegrationProcessLogs(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	logDir := filepath.Join(h.dir, "logs")
+
+	code, output := h.run("-process-logs", "-process-log-dir="+logDir)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zfs create -o mountpoint=legacy testpool/dm-linuxkit-logs")
+	if !regexp.MustCompile(`etcd is ready to serve client requests .*process=etcd`).MatchString(output) {
+		t.Errorf("etcd's output wasn't logged with its name, output:\n%s", output)
+	}
+
+	code, output = h.runCommand("logs", "etcd", "-process-log-dir="+logDir)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	if output != "etcd is ready to serve client requests\n" {
+		t.Errorf("unexpected logs output:\n%s", output)
+	}
+
+	code, output = h.runCommand("logs", "dotmesh", "-process-log-dir="+filepath.Join(h.dir, "nonexistent"))
+	if code == 0 || !strings.Contains(output, "No log file for dotmesh-server") {
+		t.Errorf("expected a missing log error, got %d, output:\n%s", code, output)
+	}
+}
+
+func TestIntegrationQuota(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	code, output := h.run("-quota=10G", "-etcd-reservation=256M")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	h.assertStubCalled("zfs set quota=10G testpool/dmfs/fs-test")
+	h.assertStubCalled("zfs set reservation=256M testpool/dotmesh-etcd")
+	h.assertStubNotCalled("zfs set refquota")
+}
+
+func TestIntegrationFaultedPool(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("state/pool-testpool", "")
+	h.writeFile("state/health-testpool", "FAULTED")
+
+	code, output := h.run()
+	// Like the other commands, up exits 1 with the error, not a panic.
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "refusing to start dotmesh") {
+		t.Errorf("expected a refusal in the output:\n%s", output)
+	}
+	h.assertStubCalled("zpool status testpool")
+	if strings.Contains(output, "goroutine") {
+		t.Errorf("expected no stack trace in the output:\n%s", output)
+	}
+	h.assertStubNotCalled("dotmesh-server")
+}
+
+func TestIntegrationSeed(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("seed", "dothub.com/justincormack/postgres")
+	h.writeFile("credentials", "justin:secret")
+	h.dotmesh.transfers = []TransferPollResult{
+		{Status: "running", Index: 1, Total: 1, Size: 100, Sent: 50, NanosecondsElapsed: 1e9},
+		{Status: "finished", Index: 1, Total: 1, Size: 100, Sent: 100, NanosecondsElapsed: 2e9},
+	}
+
+	code, output := h.run()
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", code, output)
+	}
+	tr := h.dotmesh.transfer
+	if tr.Peer != "dothub.com" || tr.User != "justin" || tr.ApiKey != "secret" ||
+		tr.RemoteNamespace != "justincormack" || tr.RemoteName != "postgres" ||
+		tr.LocalName != "test" || tr.Direction != "pull" {
+		t.Errorf("wrong transfer request: %+v", tr)
+	}
+	if h.dotmesh.called("Create test") {
+		t.Errorf("seeded dot shouldn't be created")
+	}
+	h.assertDotMounted("fs-test")
+}
+
+func TestIntegrationTransferError(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("seed", "dothub.com/justincormack/postgres")
+	h.writeFile("credentials", "justin:secret")
+	h.dotmesh.transfers = []TransferPollResult{
+		{Status: "error", Index: 1, Total: 1, Message: "no such dot"},
+	}
+
+	code, output := h.run()
+	if code == 0 {
+		t.Fatalf("expected a non-zero exit code, output:\n%s", output)
+	}
+	if !strings.Contains(output, "no such dot") {
+		t.Errorf("expected the transfer error in the output:\n%s", output)
+	}
+}
+
+func TestIntegrationTransferStall(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+	h.writeFile("seed", "dothub.com/justincormack/postgres")
+	h.writeFile("credentials", "justin:secret")
+	h.dotmesh.transfers = []TransferPollResult{
+		{Status: "running", Index: 1, Total: 1, Size: 100, Sent: 10, NanosecondsElapsed: 1e9},
+	}
+
+	code, output := h.run("-transfer-stall-timeout=2s")
+	if code == 0 {
+		t.Fatalf("expected a non-zero exit code, output:\n%s", output)
+	}
+	if !strings.Contains(output, "made no progress") {
+		t.Errorf("expected a stall error in the output:\n%s", output)
+	}
+}
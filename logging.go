@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dm-linuxkit logs through logger, which has levels and adds fields (such as
+// the phase of up we're in, the dot and the transfer ID) to each line, as text
+// or JSON. The standard log package is redirected to it at info level, so
+// plain log.Printf still works; warnings and errors should use logger.Warnf,
+// logger.Errorf and logger.Fatal, and things someone should look at
+// logger.Alertf.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.ToLower(s) == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q, should be debug, info, warn or error", s)
+}
+
+// logFields are extra key/values for a log line.
+type logFields map[string]interface{}
+
+// logOutput is where log lines go, shared between a logger and those made
+// from it with with.
+type logOutput struct {
+	mu     sync.Mutex
+	out    io.Writer
+	json   bool
+	level  logLevel
+	fields logFields // added to every line, see setField
+	now    func() time.Time
+}
+
+type structuredLogger struct {
+	output *logOutput
+	fields logFields
+}
+
+func newLogger(out io.Writer) *structuredLogger {
+	return &structuredLogger{
+		output: &logOutput{out: out, level: levelInfo, fields: logFields{}, now: time.Now},
+		fields: logFields{},
+	}
+}
+
+// logger is dm-linuxkit's logger.
+var logger = newLogger(os.Stderr)
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger})
+}
+
+// configure sets the format ("text" or "json") and lowest level logged.
+func (l *structuredLogger) configure(format string, level logLevel) error {
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+	switch format {
+	case "text":
+		l.output.json = false
+	case "json":
+		l.output.json = true
+	default:
+		return fmt.Errorf("unknown log format %q, should be text or json", format)
+	}
+	l.output.level = level
+	return nil
+}
+
+// setField adds a field to everything logged from now on, by this logger
+// and all the others sharing its output, e.g. the phase of up we're in.
+func (l *structuredLogger) setField(key string, value interface{}) {
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+	l.output.fields[key] = value
+}
+
+// setPhase sets the phase field, e.g. "pool" or "seed" while up is setting
+// those up.
+func (l *structuredLogger) setPhase(phase string) {
+	l.setField("phase", phase)
+}
+
+// with returns a logger adding fields to what l logs.
+func (l *structuredLogger) with(fields logFields) *structuredLogger {
+	merged := logFields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &structuredLogger{output: l.output, fields: merged}
+}
+
+func (l *structuredLogger) Debugf(format string, args ...interface{}) {
+	l.log(levelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *structuredLogger) Infof(format string, args ...interface{}) {
+	l.log(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *structuredLogger) Warnf(format string, args ...interface{}) {
+	l.log(levelWarn, fmt.Sprintf(format, args...))
+}
+
+// Alertf logs at warn level with alert=true, for things someone should look
+// at, e.g. an unhealthy pool or a failed backup.
+func (l *structuredLogger) Alertf(format string, args ...interface{}) {
+	l.with(logFields{"alert": true}).log(levelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *structuredLogger) Errorf(format string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs its arguments, like fmt.Sprint, at error level and exits 1,
+// like log.Fatal.
+func (l *structuredLogger) Fatal(args ...interface{}) {
+	l.log(levelError, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+// Fatalf logs at error level and exits 1, like log.Fatalf.
+func (l *structuredLogger) Fatalf(format string, args ...interface{}) {
+	l.log(levelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *structuredLogger) enabled(level logLevel) bool {
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+	return level >= l.output.level
+}
+
+func (l *structuredLogger) log(level logLevel, message string) {
+	o := l.output
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if level < o.level {
+		return
+	}
+	fields := logFields{}
+	for k, v := range o.fields {
+		fields[k] = v
+	}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	now := o.now()
+
+	var line bytes.Buffer
+	if o.json {
+		fields["time"] = now.UTC().Format(time.RFC3339Nano)
+		fields["level"] = logLevelNames[level]
+		fields["msg"] = message
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{
+				"level": logLevelNames[level],
+				"msg":   message,
+				"error": fmt.Sprintf("can't log fields: %v", err),
+			})
+		}
+		line.Write(b)
+	} else {
+		fmt.Fprintf(
+			&line, "%s %-5s %s", now.Format("2006/01/02 15:04:05"),
+			strings.ToUpper(logLevelNames[level]), message,
+		)
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value := fmt.Sprint(fields[k])
+			if strings.ContainsAny(value, " \t\"=") {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&line, " %s=%s", k, value)
+		}
+	}
+	line.WriteByte('\n')
+	o.out.Write(line.Bytes())
+}
+
+// stdLogWriter takes the standard log package's output, logging each line at
+// info level.
+type stdLogWriter struct {
+	logger *structuredLogger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.Infof("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// processLogWriter logs a child process's output, a line at a time, with
+// the process's name.
+type processLogWriter struct {
+	logger  *structuredLogger
+	mu      sync.Mutex
+	partial []byte
+}
+
+func newProcessLogWriter(process string) *processLogWriter {
+	return &processLogWriter{logger: logger.with(logFields{"process": process})}
+}
+
+func (w *processLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Infof("%s", w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// logFlags say how to log. Every subcommand takes them.
+type logFlags struct {
+	format *string
+	level  *string
+}
+
+func addLogFlags(flags *flag.FlagSet) *logFlags {
+	return &logFlags{
+		format: flags.String("log-format", "text", "Log as text or json"),
+		level: flags.String(
+			"log-level", "info",
+			"Lowest level to log: debug, info, warn or error",
+		),
+	}
+}
+
+// setup configures the logger from the flags. Call it once they're parsed.
+func (f *logFlags) setup() error {
+	level, err := parseLogLevel(*f.level)
+	if err != nil {
+		return err
+	}
+	return logger.configure(*f.format, level)
+}
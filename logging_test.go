@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(format string, level logLevel) (*structuredLogger, *bytes.Buffer) {
+	var out bytes.Buffer
+	l := newLogger(&out)
+	l.output.now = func() time.Time {
+		return time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	}
+	if err := l.configure(format, level); err != nil {
+		panic(err)
+	}
+	return l, &out
+}
+
+func TestLoggerText(t *testing.T) {
+	l, out := newTestLogger("text", levelInfo)
+	l.setPhase("seed")
+	l.with(logFields{"dot": "test", "transferId": "a b"}).Infof("Starting transfer of %d bytes...", 10)
+	l.Debugf("hidden")
+	l.Alertf("careful")
+
+	expected := "2018/07/01 12:00:00 INFO  Starting transfer of 10 bytes... " +
+		"dot=test phase=seed transferId=\"a b\"\n" +
+		"2018/07/01 12:00:00 WARN  careful alert=true phase=seed\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, out := newTestLogger("json", levelDebug)
+	l.with(logFields{"dot": "test"}).Debugf("polled")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("bad JSON %q: %v", out.String(), err)
+	}
+	expected := map[string]interface{}{
+		"time":  "2018-07-01T12:00:00Z",
+		"level": "debug",
+		"msg":   "polled",
+		"dot":   "test",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, line[k])
+		}
+	}
+}
+
+func TestLoggerStdLog(t *testing.T) {
+	l, out := newTestLogger("text", levelInfo)
+	std := log.New(stdLogWriter{l}, "", 0)
+	std.Printf("Created dot %s!", "test")
+	if out.String() != "2018/07/01 12:00:00 INFO  Created dot test!\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestProcessLogWriter(t *testing.T) {
+	l, out := newTestLogger("text", levelInfo)
+	w := &processLogWriter{logger: l.with(logFields{"process": "etcd"})}
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\nunfinished"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 ||
+		!strings.HasSuffix(lines[0], "INFO  first line process=etcd") ||
+		!strings.HasSuffix(lines[1], "INFO  second line process=etcd") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if level, err := parseLogLevel("WARN"); err != nil || level != levelWarn {
+		t.Errorf("expected warn, got %v, %v", level, err)
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -65,378 +66,687 @@ type TransferPollResult struct {
 	Message            string
 }
 
+// PID_FILE is where a running `dm-linuxkit up` daemon writes its pid, for
+// `dm-linuxkit down`.
+const PID_FILE = "/run/dotmesh/dm-linuxkit.pid"
+
+// commands are dm-linuxkit's subcommands. With none, or only flags, it runs
+// up, as it always has.
+var commands = map[string]struct {
+	run         func(args []string)
+	description string
+}{
+	"init":         {initCommand, "create or import the pool and etcd's filesystem, then exit"},
+	"up":           {upCommand, "set up the pool, start etcd and dotmesh, and seed, create and mount the dot"},
+	"seed":         {seedCommand, "seed a dot from a remote on the running dotmesh"},
+	"mount":        {mountCommand, "mount a dot, creating it if need be, using the running dotmesh"},
+	"unmount":      {unmountCommand, "unmount a dot"},
+	"commit":       {commitCommand, "commit a dot on the running dotmesh"},
+	"push":         {pushCommand, "push a dot to a remote from the running dotmesh"},
+	"status":       {statusCommand, "show the pool and whether dotmesh is up"},
+	"down":         {downCommand, "stop a running up daemon, and the etcd and dotmesh it started"},
+	"etcd-backup":  {etcdBackupCommand, "save a snapshot of etcd"},
+	"etcd-restore": {etcdRestoreCommand, "restore etcd from a snapshot while it's stopped"},
+	"logs":         {logsCommand, "show etcd's or dotmesh-server's log file"},
+	"wait":         {waitCommand, "wait for dots to be mounted, then run a command"},
+}
+
 func main() {
-	flagStorageDevice := flag.String(
-		"storage-device", "",
-		"block device or file to store data (seperate multiple with commas)",
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		upCommand(os.Args[1:])
+		return
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	command.run(os.Args[2:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for a command's flags.\n", os.Args[0])
+}
+
+func upCommand(args []string) {
+	if err := up(args); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// up sets everything up and, unless it's -oneshot, runs as the daemon until
+// it's stopped. It returns any error once its deferred cleanups have run.
+func up(args []string) error {
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	storage := addStorageFlags(flags)
+	mountOpts := addMountFlags(flags)
+	seedOpts := addSeedFlags(flags)
+	processLogOpts := addProcessLogFlags(flags)
+	flagOneShot := flags.Bool(
+		"oneshot", false,
+		"Exit immediately, useful for initializing things on boot. "+
+			"Otherwise, runs as long-running daemon to support e.g. dm CLI interactions",
 	)
-	flagPool := flag.String(
-		"pool-name", "pool",
-		"Name of storage pool to use",
+	flagAdminPasswordFile := flags.String(
+		"admin-password-file", "/run/config/dotmesh/admin-password",
+		"Initial admin password for the local dotmesh",
 	)
-	flagDot := flag.String(
-		"dot", "",
-		"Name of dotmesh datadot to use (docs.dotmesh.com/concepts/what-is-a-datadot)",
+	flagImportExisting := flags.Bool(
+		"import-existing", false,
+		"Copy any files already in -mountpoint into the dot and commit them "+
+			"before mounting, rather than hiding them. Done once per dot, "+
+			"and never into dots with commits",
 	)
-	// TODO: Add a flag for specifying a branch of a dot, rather than always
-	// defaulting to master.
-	flagMountpoint := flag.String(
-		"mountpoint", "",
-		"Where to mount the datadot on the host",
+	flagOwner := flags.String(
+		"owner", "",
+		"User name or uid to own the root of the dot, e.g. 1000",
 	)
-	flagOneShot := flag.Bool(
-		"oneshot", false,
-		"Exit immediately, useful for initializing things on boot. "+
-			"Otherwise, runs as long-running daemon to support e.g. dm CLI interactions",
+	flagGroup := flags.String(
+		"group", "",
+		"Group name or gid to own the root of the dot",
 	)
-	flagSeedFile := flag.String(
-		"seed-file", "/run/config/dotmesh/seed",
-		"File containing address of a datadot to seed from e.g. dothub.com/justincormack/postgres",
+	flagMode := flags.String(
+		"mode", "",
+		"Octal permissions for the root of the dot, e.g. 0755",
 	)
-	flagCredentialsFile := flag.String(
-		"credentials-file", "/run/config/dotmesh/credentials",
-		"File containing <API username>:<API key> for use with -seed",
+	flagEnforcePermissions := flags.Bool(
+		"enforce-permissions", false,
+		"Apply -owner, -group and -mode on every boot, not just when the dot is created",
 	)
-	flagAdminApiKeyFile := flag.String(
-		"admin-api-key-file", "/run/config/dotmesh/admin-api-key",
-		"Initial admin API key for the local dotmesh",
+	flagCommit := flags.String(
+		"commit", "",
+		"ID of a commit of the datadot to expose read-only at -commit-mountpoint",
 	)
-	flagAdminPasswordFile := flag.String(
-		"admin-password-file", "/run/config/dotmesh/admin-password",
-		"Initial admin password for the local dotmesh",
+	flagCommitMountpoint := flags.String(
+		"commit-mountpoint", "",
+		"Where to mount the -commit of the datadot on the host (always read-only)",
+	)
+	flagHealthCheckInterval := flags.Duration(
+		"health-check-interval", time.Minute,
+		"How often to check the pool's health when running as a daemon",
+	)
+	flagScrubInterval := flags.Duration(
+		"scrub-interval", 0,
+		"Scrub the pool when running as a daemon if it's not been scrubbed "+
+			"for this long, e.g. 720h (default never)",
 	)
-	flag.Parse()
+	flagQuota := flags.String(
+		"quota", "",
+		"ZFS quota for the datadot, including its snapshots, e.g. 10G (or none)",
+	)
+	flagRefquota := flags.String(
+		"refquota", "",
+		"ZFS refquota for the datadot, excluding its snapshots, e.g. 10G (or none)",
+	)
+	flagRecover := flags.Bool(
+		"recover", false,
+		"Give dots on the pool that dotmesh has lost (e.g. with its etcd data) "+
+			"their names back, from the name dm-linuxkit tagged their datasets with",
+	)
+	flagEtcdBackupInterval := flags.Duration(
+		"etcd-backup-interval", 0,
+		"How often to back up etcd when not in oneshot mode (0 disables)",
+	)
+	flagEtcdBackupDir := flags.String(
+		"etcd-backup-dir", ETCD_BACKUP_DIR,
+		"Where to mount the filesystem on the pool for periodic etcd backups",
+	)
+	flagEtcdBackupQuota := addEtcdBackupQuotaFlag(flags, "etcd-backup-quota")
+	flagEtcdBackupKeep := flags.Int(
+		"etcd-backup-keep", 7,
+		"Number of periodic etcd backups to keep",
+	)
+	flagPidFile := flags.String(
+		"pid-file", PID_FILE,
+		"Where to write our pid when running as a daemon, for dm-linuxkit down",
+	)
+	flagControlSocket := flags.String(
+		"control-socket", CONTROL_SOCKET,
+		"Where to serve the control API the other subcommands use when running as a daemon",
+	)
+	flagReadyDir := addReadyDirFlag(flags)
+	flagCommitSchedule := addCommitScheduleFlag(flags)
+	flagMetricsAddress := flags.String(
+		"metrics-address", "",
+		"host:port to serve Prometheus metrics on at /metrics when running as a "+
+			"daemon, e.g. :9100 (default off)",
+	)
+	flags.Parse(args)
 
-	err := setupZFS(*flagPool, strings.Split(*flagStorageDevice, ","))
+	md, cfg, err := common.load()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	etcdCmd, err := runEtcd(*flagPool)
-	if err != nil {
-		panic(err)
+	dotLimits := spaceLimits{Quota: *flagQuota, Refquota: *flagRefquota}
+	if err := dotLimits.validate(); err != nil {
+		return err
 	}
 
-	adminPasswordBytes, err := ioutil.ReadFile(*flagAdminPasswordFile)
-	if err != nil {
-		panic(err)
+	var schedule *commitSchedule
+	if *flagCommitSchedule != "" {
+		if schedule, err = parseCommitSchedule(*flagCommitSchedule); err != nil {
+			return err
+		}
+		if *flagOneShot {
+			logger.Warnf("-commit-schedule only applies when running as a daemon, ignoring it")
+		}
 	}
 
-	adminPassword := string(adminPasswordBytes)
+	if err := mountOpts.setPropagation(); err != nil {
+		return err
+	}
+	if err := validateBranch(*mountOpts.branch); err != nil {
+		return err
+	}
+
+	if (*flagCommit == "") != (*flagCommitMountpoint == "") {
+		return fmt.Errorf("-commit and -commit-mountpoint must be given together")
+	}
+	if *flagCommit != "" {
+		if err := validateCommitId(*flagCommit); err != nil {
+			return err
+		}
+	}
+
+	permissions := rootPermissions{
+		Owner: *flagOwner,
+		Group: *flagGroup,
+		Mode:  *flagMode,
+	}
+	if err := permissions.validate(); err != nil {
+		return err
+	}
+
+	zfs := newExecZFS()
 
-	adminApiKeyBytes, err := ioutil.ReadFile(*flagAdminApiKeyFile)
+	phase("pool", "Setting up pool %s", *common.pool)
+	err = storage.setupPool(zfs, *common.pool)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	adminApiKey := string(adminApiKeyBytes)
+	logs, err := processLogOpts.setup(zfs, *common.pool)
+	if err != nil {
+		return err
+	}
+	if logs != nil {
+		defer logs.Close()
+	}
 
-	dotmeshCmd, err := runDotmesh(*flagPool, adminPassword, adminApiKey)
+	phase("etcd", "Starting etcd")
+	etcd, err := runEtcd(zfs, *common.pool, *storage.etcdDataDir, storage.etcdLimits(), logs)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// TODO: wait for dotmesh to start, make a dot.
+	adminPasswordBytes, err := md.read("admin-password", *flagAdminPasswordFile)
+	if err != nil {
+		return err
+	}
 
-	var result bool
-	var resultString string
+	adminPassword := string(adminPasswordBytes)
 
-	for {
-		err := doRPC("localhost", "admin", adminApiKey, "DotmeshRPC.Ping", nil, &result)
-		if err == nil {
-			log.Printf("Connected! Yay!")
-			break
-		}
-		log.Printf("Error, retrying... %v", err)
-		time.Sleep(1 * time.Second)
+	adminApiKey, err := common.adminApiKey(md)
+	if err != nil {
+		return err
 	}
 
-	var seed string
-	seedBytes, err := ioutil.ReadFile(*flagSeedFile)
+	phase("dotmesh", "Starting dotmesh")
+	dotmesh, err := runDotmesh(*common.pool, adminPassword, adminApiKey, logs)
 	if err != nil {
-		if os.IsNotExist(err) {
-			seed = ""
-		} else {
-			log.Printf(
-				"Unable to read seed file at %s, err: %v",
-				*flagSeedFile, err,
-			)
-			panic(err)
-		}
-	} else {
-		seed = string(seedBytes)
+		return err
+	}
+
+	waitForDotmesh(adminApiKey)
+
+	seed, err := seedOpts.source(md)
+	if err != nil {
+		return err
 	}
 
 	// Clone/create only if we're asked to seed and we're the onboot ("oneshot")
 	if *flagOneShot {
+		// Whether we created a brand new, empty dot on this run, as opposed to
+		// seeding one or finding one left over from a previous boot.
+		created := false
+		seeded := false
+
+		phase("recover", "Checking for lost dots")
+		err = recoverDots(zfs, *common.pool, adminApiKey, *flagRecover)
+		if err != nil {
+			return err
+		}
+
+		logger.setField("dot", *mountOpts.dot)
 		if seed != "" {
+			phase("seed", "Seeding %s from %s", *mountOpts.dot, seed)
 			// Extract api username and key from environment metadata.
-			credentialsBytes, err := ioutil.ReadFile(*flagCredentialsFile)
+			credentials, err := seedOpts.credentials(md)
 			if err != nil {
-				log.Printf(
-					"Unable to read credentials file at %s, see the "+
-						"README for how to provide credentials for seeding.",
-					*flagCredentialsFile,
-				)
-				panic(err)
+				return err
 			}
-			// XXX handle :s in the username
-			shrapnel := strings.Split(string(credentialsBytes), ":")
-			username := shrapnel[0]
-			apiKey := shrapnel[1]
-			log.Printf("got username=%s, apiKey=%s", username, apiKey)
-
-			// TODO interpret 'dothub.com/justincormack/postgres'
-			shrapnel = strings.Split(seed, "/")
-			if len(shrapnel) != 3 {
-				panic(fmt.Errorf(
-					"Need exactly two '/'s in -seed argument, " +
-						"e.g. 'dothub.com/justincormack/postgres'",
-				))
+			err = seedDot(adminApiKey, *mountOpts.dot, seed, credentials, *seedOpts.stallTimeout)
+			if err != nil {
+				return err
 			}
-			hostname := shrapnel[0]        // dothub.com
-			remoteNamespace := shrapnel[1] // e.g. justincormack
-			remoteName := shrapnel[2]      // e.g. postgres
-
-			var transferId string
-			err = doRPC(
-				"localhost", "admin", adminApiKey,
-				"DotmeshRPC.Transfer", TransferRequest{
-					Peer:             hostname,
-					User:             username,
-					ApiKey:           apiKey,
-					Direction:        "pull",
-					LocalNamespace:   "admin",
-					LocalName:        *flagDot,
-					LocalBranchName:  "",
-					RemoteNamespace:  remoteNamespace,
-					RemoteName:       remoteName,
-					RemoteBranchName: "",
-				}, &transferId)
+			seeded = true
+		} else {
+			phase("create", "Creating %s", *mountOpts.dot)
+			created, err = ensureDot(adminApiKey, *mountOpts.dot)
 			if err != nil {
-				panic(err)
+				return err
 			}
+		}
+
+		phase("mount", "Mounting %s at %s", *mountOpts.dot, *mountOpts.mountpoint)
+		// Find the ID of the dot.
+		lookupResult, err := lookupDot(adminApiKey, *mountOpts.dot, *mountOpts.branch)
+		if err != nil {
+			return err
+		}
+
+		dotMountpoint := calculateMountpoint(*common.pool, lookupResult)
 
-			err = func() error {
-				started := false
-				debugMode := true
-
-				for {
-					if debugMode {
-						log.Printf("DEBUG About to sleep for 1s...")
-					}
-					time.Sleep(time.Second)
-					result := &TransferPollResult{}
-
-					if debugMode {
-						log.Printf("DEBUG Calling GetTransfer(%s)...", transferId)
-					}
-					err := doRPC(
-						"localhost", "admin", adminApiKey,
-						"DotmeshRPC.GetTransfer", transferId, result,
-					)
-					if debugMode {
-						log.Printf(
-							"DEBUG done GetTransfer(%s), got err %#v and result %#v...",
-							transferId, err, result,
-						)
-					}
-					if debugMode {
-						log.Printf("DEBUG rpcError consumed!")
-					}
-
-					if debugMode {
-						log.Printf("DEBUG Got err: %s", err)
-					}
-					if err != nil {
-						if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
-							log.Printf("Got error, trying again: %s", err)
-						}
-					}
-
-					if debugMode {
-						log.Printf("Got DotmeshRPC.GetTransfer response: %+v", result)
-					}
-					if !started {
-						log.Printf("Starting transfer of %d bytes...", result.Size)
-						started = true
-					}
-					log.Printf(result.Status)
-					var speed string
-					if result.NanosecondsElapsed > 0 {
-						speed = fmt.Sprintf(" %.2f MiB/s",
-							// mib/sec
-							(float64(result.Sent)/(1024*1024))/
-								(float64(result.NanosecondsElapsed)/(1000*1000*1000)),
-						)
-					} else {
-						speed = " ? MiB/s"
-					}
-					quotient := fmt.Sprintf(" (%d/%d)", result.Index, result.Total)
-					log.Printf(speed + quotient)
-
-					if result.Index == result.Total && result.Status == "finished" {
-						if started {
-							log.Printf("Done!")
-						}
-						time.Sleep(time.Second)
-						return nil
-					}
-					if result.Status == "error" {
-						if started {
-							log.Printf("error: %s", result.Message)
-						}
-						time.Sleep(time.Second)
-						return fmt.Errorf(result.Message)
-					}
-				}
-			}()
+		// Only master's dataset is the dot's, for recovery to rename.
+		if isMaster(*mountOpts.branch) {
+			err = tagDotDataset(zfs, *common.pool, lookupResult, "admin", *mountOpts.dot)
 			if err != nil {
-				panic(err)
+				return err
 			}
+		}
 
-		} else {
-			// see if the dot already exists
-			if err := tryUntilSucceedsN(func() error {
-				return doRPC(
-					"localhost", "admin", adminApiKey,
-					"DotmeshRPC.Exists",
-					map[string]string{"Name": *flagDot, "Namespace": "admin"},
-					&resultString,
-				)
-			}, fmt.Sprintf("check if %s exists", *flagDot), 5); err != nil {
-				panic(err)
+		err = applySpaceLimits(zfs, calculateDataset(*common.pool, lookupResult), dotLimits)
+		if err != nil {
+			return err
+		}
+		for name, value := range cfg.Dot.Properties {
+			err = zfs.SetProperty(calculateDataset(*common.pool, lookupResult), name, value)
+			if err != nil {
+				return err
 			}
-			// create if does not exist
-			if resultString == "" {
-				if err := doRPC(
-					"localhost", "admin", adminApiKey,
-					"DotmeshRPC.Create",
-					map[string]string{"Name": *flagDot, "Namespace": "admin"},
-					&result,
-				); err != nil {
-					panic(err)
-				}
-				log.Printf("Created dot %s!", *flagDot)
-			} else {
-				log.Printf("Found existing dot %s!", *flagDot)
+		}
+
+		// A branch starts from one of the dot's commits, so isn't new.
+		if !seeded && *flagImportExisting && isMaster(*mountOpts.branch) {
+			err = importExistingData(
+				zfs, calculateDataset(*common.pool, lookupResult),
+				adminApiKey, *mountOpts.dot, *mountOpts.mountpoint, dotMountpoint,
+			)
+			if err != nil {
+				return err
 			}
 		}
 
-		// TODO: mount the dot on the filesystem at flagMountpoint, after doing
-		// mkdir flagMountpoint
+		if created || seeded || *flagEnforcePermissions {
+			err = permissions.apply(dotMountpoint)
+			if err != nil {
+				return err
+			}
+		}
 
-		// Find the ID of the dot.
-		var lookupResult string
-		err = doRPC(
-			"localhost", "admin", adminApiKey,
-			"DotmeshRPC.Lookup",
-			map[string]string{"Name": *flagDot, "Namespace": "admin"},
-			&lookupResult,
-		)
+		err = mountDot(dotMountpoint, *mountOpts.mountpoint, *mountOpts.readOnly)
+		if err != nil {
+			return err
+		}
+		err = markReady(*flagReadyDir, DaemonMount{
+			Dot:        *mountOpts.dot,
+			Branch:     branchName(*mountOpts.branch),
+			Id:         lookupResult,
+			Mountpoint: *mountOpts.mountpoint,
+			ReadOnly:   *mountOpts.readOnly,
+		})
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		// TODO: switch this to running DotmeshRPC.Procure once that yields actual
-		// mount points, rather than symlinks.
-		// Related: https://github.com/dotmesh-io/dotmesh/issues/421
+		if *flagCommit != "" {
+			err = mountCommit(
+				dotMountpoint, *mountOpts.dot, *flagCommit, *flagCommitMountpoint,
+			)
+			if err != nil {
+				return err
+			}
+			err = markReady(*flagReadyDir, DaemonMount{
+				Dot:        *mountOpts.dot,
+				Branch:     branchName(*mountOpts.branch),
+				Id:         lookupResult,
+				Mountpoint: *flagCommitMountpoint,
+				ReadOnly:   true,
+			})
+			if err != nil {
+				return err
+			}
+		}
 
-		err = bindMountFilesystem(
-			// Seems like this MOUNT_PREFIX of /var is set in dotmesh utils.go
-			// (unless MOUNT_PREFIX is set, and we're not setting it...)
-			calculateMountpoint(*flagPool, lookupResult),
-			*flagMountpoint,
-		)
-		if err != nil {
-			panic(err)
+		for _, d := range cfg.Dots {
+			logger.setField("dot", d.Name)
+			phase("mount", "Mounting %s at %s", d.Name, d.Mountpoint)
+			err = setUpConfiguredDot(zfs, *common.pool, adminApiKey, *flagReadyDir, d)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// SHUTDOWN FOLLOWS
 
 	if *flagOneShot {
-		err = dotmeshCmd.Process.Signal(syscall.SIGTERM)
+		// Everything's mounted, for units ordered after us.
+		notifySystemd("READY=1")
+		phase("shutdown", "Stopping dotmesh and etcd")
+		return stopChildren(dotmesh, etcd)
+	}
+
+	if err := writePidFile(*flagPidFile); err != nil {
+		return err
+	}
+	defer os.Remove(*flagPidFile)
+
+	monitor := newPoolMonitor(zfs, *common.pool, *flagHealthCheckInterval, *flagScrubInterval)
+	stopMonitor := make(chan struct{})
+	go monitor.run(stopMonitor)
+	defer close(stopMonitor)
+
+	if *flagEtcdBackupInterval > 0 {
+		err := setupEtcdBackupFilesystem(zfs, *common.pool, *flagEtcdBackupDir, *flagEtcdBackupQuota)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		err = dotmeshCmd.Wait()
-		if err != nil {
-			log.Printf("dotmesh exited with %v, this is normal (we just killed it)", err)
+		go runEtcdBackups(
+			newExecRunner(), ETCD_ENDPOINT, *flagEtcdBackupDir,
+			*flagEtcdBackupInterval, *flagEtcdBackupKeep, stopMonitor,
+		)
+	}
+
+	control := newControlDaemon(
+		zfs, *common.pool, adminApiKey,
+		func() (string, error) { return seedOpts.credentials(md) },
+		*seedOpts.stallTimeout, monitor, *flagReadyDir,
+	)
+	control.adoptMounts(mountOpts.configured(cfg))
+	controlListener, err := control.serve(*flagControlSocket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*flagControlSocket)
+	defer controlListener.Close()
+
+	if schedule != nil && *mountOpts.dot != "" {
+		if err := control.scheduleCommits(*mountOpts.dot, *mountOpts.branch, schedule); err != nil {
+			return err
 		}
-		err = etcdCmd.Process.Signal(syscall.SIGTERM)
-		if err != nil {
-			panic(err)
+	}
+	for _, d := range cfg.Dots {
+		if d.CommitSchedule == "" {
+			continue
 		}
-		err = etcdCmd.Wait()
+		dotSchedule, err := parseCommitSchedule(d.CommitSchedule)
 		if err != nil {
-			log.Printf("etcd exited with %v, this is be normal (we just killed it)", err)
+			return err
 		}
-	} else {
-		err = dotmeshCmd.Wait()
+		if err := control.scheduleCommits(d.Name, d.Branch, dotSchedule); err != nil {
+			return err
+		}
+	}
+	defer control.stopScheduledCommits()
+
+	if *flagMetricsAddress != "" {
+		metricsListener, err := serveMetrics(*flagMetricsAddress, &metricsCollector{
+			zfs:     zfs,
+			pool:    *common.pool,
+			control: control,
+		})
 		if err != nil {
-			log.Printf("dotmesh exited with %v, this is unusual (we were in non-oneshot mode)", err)
+			return err
+		}
+		defer metricsListener.Close()
+	}
+
+	// Run until dotmesh dies, or we're asked to stop (by dm-linuxkit down,
+	// with a signal or over the control API).
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	if interval, err := sdWatchdogInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		go runSdWatchdog(interval, func() error {
+			var result bool
+			return doRPC(dotmeshAddress, "admin", adminApiKey, "DotmeshRPC.Ping", nil, &result)
+		}, stopMonitor)
+	}
+	phase("running", "Running")
+	notifySystemd("READY=1")
+	select {
+	case sig := <-signals:
+		notifySystemd("STOPPING=1")
+		phase("shutdown", "Stopping dotmesh and etcd")
+		log.Printf("Got %s, stopping dotmesh and etcd", sig)
+		return stopChildren(dotmesh, etcd)
+	case <-control.shutdown:
+		notifySystemd("STOPPING=1")
+		phase("shutdown", "Stopping dotmesh and etcd")
+		log.Printf("Asked to shut down over the control API, stopping dotmesh and etcd")
+		return stopChildren(dotmesh, etcd)
+	case <-dotmesh.done:
+		if dotmesh.err != nil {
+			logger.Errorf("dotmesh exited with %v, this is unusual (we were in non-oneshot mode)", dotmesh.err)
 		}
-		err = etcdCmd.Wait()
+		err = etcd.wait()
 		if err != nil {
-			log.Printf("etcd exited with %v, this is unusual (we were in non-oneshot mode)", err)
+			logger.Errorf("etcd exited with %v, this is unusual (we were in non-oneshot mode)", err)
+		}
+	}
+	return nil
+}
+
+// setUpConfiguredDot creates and mounts one of the config file's dots, setting
+// its quotas and properties on the way.
+func setUpConfiguredDot(zfs ZFS, pool, adminApiKey, readyDir string, d dotConfig) error {
+	if _, err := ensureDot(adminApiKey, d.Name); err != nil {
+		return err
+	}
+	id, err := lookupDot(adminApiKey, d.Name, d.Branch)
+	if err != nil {
+		return err
+	}
+	dataset := calculateDataset(pool, id)
+	if isMaster(d.Branch) {
+		if err := tagDotDataset(zfs, pool, id, "admin", d.Name); err != nil {
+			return err
+		}
+	}
+	if err := applySpaceLimits(zfs, dataset, spaceLimits{Quota: d.Quota, Refquota: d.Refquota}); err != nil {
+		return err
+	}
+	for name, value := range d.Properties {
+		if err := zfs.SetProperty(dataset, name, value); err != nil {
+			return err
 		}
 	}
+	if err := mountDot(calculateMountpoint(pool, id), d.Mountpoint, d.ReadOnly); err != nil {
+		return err
+	}
+	m := d.mount()
+	m.Id = id
+	return markReady(readyDir, m)
+}
 
+// phase notes which step of up we're on, in the logs and in the status systemd
+// shows.
+func phase(name, format string, args ...interface{}) {
+	logger.setPhase(name)
+	sdNotifyStatus(format, args...)
 }
 
-func setupZFS(pool string, devices []string) error {
-	_, err := findLocalPoolId(pool)
+// waitForDotmesh waits until dotmesh answers its API.
+func waitForDotmesh(adminApiKey string) {
+	var result bool
+	for {
+		err := doRPC(dotmeshAddress, "admin", adminApiKey, "DotmeshRPC.Ping", nil, &result)
+		if err == nil {
+			log.Printf("Connected! Yay!")
+			break
+		}
+		logger.Warnf("Error, retrying... %v", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// child is etcd or dotmesh-server, which we wait for from when it starts so
+// that dm_linuxkit_child_up goes to 0 as soon as it exits.
+type child struct {
+	name string
+	cmd  *exec.Cmd
+	done chan struct{} // closed once it's exited
+	err  error         // what Wait returned, once done's closed
+}
+
+// startChild starts cmd, as the child process name.
+func startChild(name string, cmd *exec.Cmd) (*child, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	l := labels("process", name)
+	metrics.add("dm_linuxkit_child_starts_total", l, 1)
+	metrics.set("dm_linuxkit_child_up", l, 1)
+	c := &child{name: name, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		c.err = cmd.Wait()
+		metrics.set("dm_linuxkit_child_up", l, 0)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// wait waits for c to exit, returning what Wait did.
+func (c *child) wait() error {
+	<-c.done
+	return c.err
+}
+
+// stopChildren stops dotmesh, then etcd, waiting for each to exit.
+func stopChildren(dotmesh, etcd *child) error {
+	err := dotmesh.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+	err = dotmesh.wait()
+	if err != nil {
+		log.Printf("dotmesh exited with %v, this is normal (we just killed it)", err)
+	}
+	err = etcd.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+	err = etcd.wait()
+	if err != nil {
+		log.Printf("etcd exited with %v, this is be normal (we just killed it)", err)
+	}
+	return nil
+}
+
+func setupZFS(zfs ZFS, pool string, devices []string, opts poolOptions) error {
+	info, err := zfs.Pool(pool)
 	if err == nil {
 		// pool already exists
-		return nil
+		logPool(info)
+		return growPool(zfs, pool, devices, opts)
+	}
+	if err != errNoSuchPool {
+		return err
+	}
+
+	err = zfs.CreatePool(pool, devices)
+	if err != nil {
+		return err
+	}
+	info, err = zfs.Pool(pool)
+	if err != nil {
+		return err
 	}
+	logPool(info)
+	return nil
+}
+
+func logPool(info PoolInfo) {
+	log.Printf(
+		"Using pool %s (guid %s): %s, %d/%d bytes used (%d%%), %d%% fragmented",
+		info.Name, info.Id(), info.Health, info.Allocated, info.Size,
+		info.Capacity, info.Fragmentation,
+	)
+}
 
-	return createPool(pool, devices)
+// setupEtcdFilesystem makes sure pool/dotmesh-etcd exists and is mounted at
+// dataDir, ready for etcd to use.
+func setupEtcdFilesystem(zfs ZFS, pool, dataDir string) error {
+	return setupPoolFilesystem(zfs, pool, "dotmesh-etcd", dataDir)
 }
 
-func runEtcd(pool string) (*exec.Cmd, error) {
-	// 1. create a zfs filesystem for etcd if it doesn't exist already
-	exists, err := filesystemExists(pool, "dotmesh-etcd")
+// setupPoolFilesystem creates filesystem on the pool if it doesn't exist, and
+// mounts it at mountpoint if it isn't already.
+func setupPoolFilesystem(zfs ZFS, pool, filesystem, mountpoint string) error {
+	exists, err := zfs.FilesystemExists(pool, filesystem)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if !exists {
-		err := createFilesystem(pool, "dotmesh-etcd")
+		err := zfs.CreateFilesystem(pool, filesystem)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	mounted, err := filesystemMounted(ETCD_DATA_DIR)
+	mounted, err := filesystemMounted(mountpoint)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if !mounted {
-		err = mountFilesystem(pool, "dotmesh-etcd", ETCD_DATA_DIR)
+		err = mountFilesystem(pool, filesystem, mountpoint)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	// 2. start etcd
-	cmd := exec.Command("etcd",
-		"-data-dir", ETCD_DATA_DIR,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	return nil
+}
+
+func runEtcd(zfs ZFS, pool, dataDir string, limits spaceLimits, logs *processLogs) (*child, error) {
+	// 1. create a zfs filesystem for etcd if it doesn't exist already
+	err := setupEtcdFilesystem(zfs, pool, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	err = applySpaceLimits(zfs, pool+"/dotmesh-etcd", limits)
 	if err != nil {
 		return nil, err
 	}
-	return cmd, nil
+	// 2. start etcd
+	cmd := exec.Command("etcd",
+		"-data-dir", dataDir,
+	)
+	output := logs.output("etcd")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return startChild("etcd", cmd)
 }
 
-func runDotmesh(pool, adminPassword, adminApiKey string) (*exec.Cmd, error) {
+func runDotmesh(pool, adminPassword, adminApiKey string, logs *processLogs) (*child, error) {
 	adminPasswordBase64 := base64.StdEncoding.EncodeToString([]byte(adminPassword))
 	adminApiKeyBase64 := base64.StdEncoding.EncodeToString([]byte(adminApiKey))
 
 	cmd := exec.Command("dotmesh-server")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	output := logs.output("dotmesh-server")
+	cmd.Stdout = output
+	cmd.Stderr = output
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env,
 		// TODO: disable docker volume plugin
@@ -449,9 +759,5 @@ func runDotmesh(pool, adminPassword, adminApiKey string) (*exec.Cmd, error) {
 		fmt.Sprintf("INITIAL_ADMIN_API_KEY=%s", adminApiKeyBase64),
 		fmt.Sprintf("INITIAL_ADMIN_PASSWORD=%s", adminPasswordBase64),
 	)
-	err := cmd.Start()
-	if err != nil {
-		return nil, err
-	}
-	return cmd, nil
+	return startChild("dotmesh-server", cmd)
 }
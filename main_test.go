@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dm-linuxkit/mount"
+)
+
+// useFakeMounter swaps the package mounter for a fake, returning it and a
+// func to put the real one back.
+func useFakeMounter() (*mount.Fake, func()) {
+	previous := mounter
+	fake := mount.NewFake()
+	mounter = fake
+	return fake, func() { mounter = previous }
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dm-linuxkit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestSetupZFSCreatesMissingPool(t *testing.T) {
+	zfs := newFakeZFS()
+	err := setupZFS(zfs, "pool", []string{"/dev/sda", "/dev/sdb"}, poolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, ok := zfs.pools["pool"]
+	if !ok {
+		t.Fatalf("pool wasn't created, calls: %v", zfs.calls)
+	}
+	if len(devices) != 2 || devices[0] != "/dev/sda" || devices[1] != "/dev/sdb" {
+		t.Errorf("pool created on wrong devices: %v", devices)
+	}
+}
+
+func TestSetupZFSLeavesExistingPool(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	err := setupZFS(zfs, "pool", []string{"/dev/sdb"}, poolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("CreatePool"); n != 0 {
+		t.Errorf("expected no CreatePool calls, got %d", n)
+	}
+}
+
+func TestSetupZFSCreatePoolFails(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.errors["CreatePool"] = errors.New("no such device")
+	err := setupZFS(zfs, "pool", []string{"/dev/sda"}, poolOptions{})
+	if err == nil {
+		t.Fatal("expected an error creating the pool")
+	}
+}
+
+func TestSetupEtcdFilesystem(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	dataDir := filepath.Join(dir, "etcd")
+
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = nil
+
+	err := setupEtcdFilesystem(zfs, "pool", dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zfs.filesystems["pool/dotmesh-etcd"] {
+		t.Errorf("pool/dotmesh-etcd wasn't created, calls: %v", zfs.calls)
+	}
+	m, ok := fakeMounter.Mounts()[dataDir]
+	if !ok {
+		t.Fatalf("%s wasn't mounted: %v", dataDir, fakeMounter.Mounts())
+	}
+	if m.Op != "zfs" || m.Source != "pool/dotmesh-etcd" {
+		t.Errorf("wrong mount at %s: %+v", dataDir, m)
+	}
+
+	// Running it again, as on a reboot without the mount going away, is a
+	// no-op.
+	err = setupEtcdFilesystem(zfs, "pool", dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("CreateFilesystem"); n != 1 {
+		t.Errorf("expected 1 CreateFilesystem call, got %d", n)
+	}
+}
+
+func TestSetupEtcdFilesystemErrors(t *testing.T) {
+	for _, op := range []string{"FilesystemExists", "CreateFilesystem"} {
+		t.Run(op, func(t *testing.T) {
+			_, restore := useFakeMounter()
+			defer restore()
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+
+			zfs := newFakeZFS()
+			zfs.pools["pool"] = nil
+			zfs.errors[op] = errors.New("boom")
+			err := setupEtcdFilesystem(zfs, "pool", filepath.Join(dir, "etcd"))
+			if err == nil {
+				t.Fatalf("expected %s error to be returned", op)
+			}
+		})
+	}
+}
+
+func TestSetupEtcdFilesystemMountFails(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = nil
+	fakeMounter.Fail = errors.New("permission denied")
+	err := setupEtcdFilesystem(zfs, "pool", filepath.Join(dir, "etcd"))
+	if _, ok := err.(*mount.Error); !ok {
+		t.Fatalf("expected a *mount.Error, got %#v", err)
+	}
+}
+
+func TestMountCommit(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	dotMountpoint := filepath.Join(dir, "dmfs", "id")
+	commit := "5d8b3a1e-0f4c-4b7a-9e2d-1c6f8a9b0e3d"
+	snapshot := filepath.Join(dotMountpoint, ".zfs", "snapshot", commit)
+	if err := os.MkdirAll(snapshot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mountpoint := filepath.Join(dir, "commit")
+
+	if err := mountCommit(dotMountpoint, "test", commit, mountpoint); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := fakeMounter.Mounts()[mountpoint]
+	if !ok {
+		t.Fatalf("%s wasn't mounted: %v", mountpoint, fakeMounter.Mounts())
+	}
+	if m.Op != "bind" || m.Source != snapshot || !m.Options.ReadOnly {
+		t.Errorf("expected a read-only bind mount of %s, got %+v", snapshot, m)
+	}
+}
+
+func TestMountCommitMissing(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	err := mountCommit(filepath.Join(dir, "dmfs", "id"), "test", "nosuchcommit", filepath.Join(dir, "commit"))
+	if err == nil {
+		t.Fatal("expected an error mounting a commit that isn't there")
+	}
+	if mounts := fakeMounter.Mounts(); len(mounts) != 0 {
+		t.Errorf("expected nothing to be mounted, got %v", mounts)
+	}
+}
+
+func TestMountCommitRejectsPaths(t *testing.T) {
+	fakeMounter, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	dotMountpoint := filepath.Join(dir, "dmfs", "id")
+	// Something a commit ID of ../../.. would reach.
+	if err := os.MkdirAll(filepath.Join(dotMountpoint, ".zfs", "snapshot"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commit := range []string{"", "..", "../../..", "a/b", "-x", ".hidden", "a b"} {
+		err := mountCommit(dotMountpoint, "test", commit, filepath.Join(dir, "commit"))
+		if err == nil {
+			t.Errorf("expected commit %q to be rejected", commit)
+		}
+	}
+	if mounts := fakeMounter.Mounts(); len(mounts) != 0 {
+		t.Errorf("expected nothing to be mounted, got %v", mounts)
+	}
+}
+
+func TestSetupZFSExpandsGrownPool(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	zfs.expandSize["pool"] = 9 << 30
+
+	err := setupZFS(zfs, "pool", []string{"/dev/sda"}, poolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("ExpandVdev pool /dev/sda"); n != 1 {
+		t.Errorf("expected /dev/sda to be expanded, calls: %v", zfs.calls)
+	}
+	info, _ := zfs.Pool("pool")
+	if info.Size != 10<<30 {
+		t.Errorf("expected the pool to have grown to 10GiB, got %d", info.Size)
+	}
+}
+
+func TestSetupZFSAddsDevicesOnlyWhenAllowed(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+
+	err := setupZFS(zfs, "pool", []string{"/dev/sda", "/dev/sdb"}, poolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("AddDevices"); n != 0 {
+		t.Fatalf("devices added without -allow-add-devices: %v", zfs.calls)
+	}
+
+	err = setupZFS(zfs, "pool", []string{"/dev/sda", "/dev/sdb"}, poolOptions{AllowAddDevices: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("AddDevices pool /dev/sdb"); n != 1 {
+		t.Errorf("expected /dev/sdb to be added, calls: %v", zfs.calls)
+	}
+}
+
+func TestSetupZFSCarriesOnWhenZpoolRefusesToAddDevices(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	zfs.errors["AddDevices"] = errors.New("/dev/sdb contains a filesystem of type 'ext4'")
+
+	err := setupZFS(zfs, "pool", []string{"/dev/sda", "/dev/sdb"}, poolOptions{AllowAddDevices: true})
+	if err != nil {
+		t.Fatalf("expected to carry on with the pool as it is, got %v", err)
+	}
+	if devices := zfs.pools["pool"]; len(devices) != 1 {
+		t.Errorf("expected the pool to still have just /dev/sda, got %v", devices)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// METADATA_ENTRIES are the entries of the dotmesh section of LinuxKit
+// metadata we use, which the linuxkit/metadata package would otherwise write
+// out as files under /run/config/dotmesh. Those that are true are required.
+var METADATA_ENTRIES = map[string]bool{
+	"admin-api-key":  true,
+	"admin-password": true,
+	"credentials":    false,
+	"seed":           false,
+	"config":         false,
+}
+
+// metadataUserDataURLs are where cloud providers serve user-data from, for
+// when the linuxkit/metadata package isn't being used, keyed by the name to
+// give -metadata. The headers are what the provider requires.
+var metadataUserDataURLs = map[string]struct {
+	URL     string
+	Headers map[string]string
+}{
+	"gcp": {
+		URL:     "http://metadata.google.internal/computeMetadata/v1/instance/attributes/user-data",
+		Headers: map[string]string{"Metadata-Flavor": "Google"},
+	},
+	"aws": {
+		URL: "http://169.254.169.254/latest/user-data",
+	},
+}
+
+// metadata is the content of the entries in the dotmesh section of LinuxKit
+// metadata JSON, by name. A nil metadata means we weren't given any, and read
+// the files the linuxkit/metadata package writes instead.
+type metadata map[string]string
+
+// metadataJSON is a file or directory in LinuxKit metadata: a file has
+// content, a directory has entries.
+type metadataJSON struct {
+	Content *string                 `json:"content"`
+	Entries map[string]metadataJSON `json:"entries"`
+}
+
+// parseMetadata parses LinuxKit metadata JSON, returning the entries of its
+// dotmesh section.
+func parseMetadata(data []byte) (metadata, error) {
+	var sections map[string]metadataJSON
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("can't parse metadata: %v", err)
+	}
+	section, ok := sections["dotmesh"]
+	if !ok {
+		return nil, fmt.Errorf("metadata has no dotmesh section")
+	}
+	m := metadata{}
+	for name, entry := range section.Entries {
+		if entry.Content == nil {
+			return nil, fmt.Errorf("metadata entry dotmesh.entries.%s has no content", name)
+		}
+		m[name] = *entry.Content
+	}
+	return m, nil
+}
+
+// fetchMetadata reads raw metadata JSON from source, which is either a path
+// or the name of a cloud provider to get user-data from (see
+// metadataUserDataURLs).
+func fetchMetadata(source string) ([]byte, error) {
+	userData, ok := metadataUserDataURLs[source]
+	if !ok {
+		return ioutil.ReadFile(source)
+	}
+	req, err := http.NewRequest("GET", userData.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range userData.Headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s user-data: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func loadMetadata(source string) (metadata, error) {
+	data, err := fetchMetadata(source)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return m, nil
+}
+
+// check reports which entries were found and which are missing, and returns
+// an error if a required one is missing.
+func (m metadata) check() error {
+	var found, missing, unknown, required []string
+	for name := range m {
+		if _, ok := METADATA_ENTRIES[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	for name, isRequired := range METADATA_ENTRIES {
+		_, ok := m[name]
+		switch {
+		case ok:
+			found = append(found, name)
+		case isRequired:
+			required = append(required, name)
+			missing = append(missing, name)
+		default:
+			missing = append(missing, name)
+		}
+	}
+	for _, names := range [][]string{found, missing, unknown, required} {
+		sort.Strings(names)
+	}
+	log.Printf(
+		"Metadata has %s; doesn't have %s",
+		listOrNone(found), listOrNone(missing),
+	)
+	if len(unknown) > 0 {
+		logger.Warnf("Ignoring unknown metadata entries %s", strings.Join(unknown, ", "))
+	}
+	if len(required) > 0 {
+		return fmt.Errorf("metadata is missing required entries %s", strings.Join(required, ", "))
+	}
+	return nil
+}
+
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// read returns the entry name from metadata if we have some, otherwise the
+// content of the file at path. A missing entry is reported like a missing
+// file, so os.IsNotExist works on either.
+func (m metadata) read(name, path string) ([]byte, error) {
+	if m == nil {
+		return ioutil.ReadFile(path)
+	}
+	content, ok := m[name]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: "metadata dotmesh.entries." + name, Err: os.ErrNotExist}
+	}
+	return []byte(content), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const exampleMetadata = `{
+  "dotmesh": {
+    "entries": {
+      "admin-api-key": {"content": "key"},
+      "admin-password": {"content": "password"},
+      "seed": {"content": "dothub.com/justincormack/postgres"},
+      "colour": {"content": "blue"}
+    }
+  },
+  "ssh": {"entries": {"authorized_keys": {"content": "ssh-rsa AAAA"}}}
+}`
+
+func TestParseMetadata(t *testing.T) {
+	m, err := parseMetadata([]byte(exampleMetadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := metadata{
+		"admin-api-key":  "key",
+		"admin-password": "password",
+		"seed":           "dothub.com/justincormack/postgres",
+		"colour":         "blue",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+	if err := m.check(); err != nil {
+		t.Errorf("unexpected error checking metadata: %v", err)
+	}
+
+	delete(m, "admin-password")
+	if err := m.check(); err == nil {
+		t.Errorf("expected an error for missing admin-password")
+	}
+
+	for _, bad := range []string{
+		`{"ssh": {}}`,
+		`{"dotmesh": {"entries": {"seed": {"entries": {}}}}}`,
+		`{"dotmesh": `,
+	} {
+		if _, err := parseMetadata([]byte(bad)); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestMetadataRead(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "seed")
+
+	// Without metadata, files are read.
+	var none metadata
+	if _, err := none.read("seed", path); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+
+	m := metadata{"seed": "dothub.com/justincormack/postgres"}
+	content, err := m.read("seed", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "dothub.com/justincormack/postgres" {
+		t.Errorf("unexpected seed %q", content)
+	}
+	if _, err := m.read("credentials", path); !os.IsNotExist(err) {
+		t.Errorf("expected a missing entry to look like a missing file, got %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept here and served in Prometheus's text exposition format
+// with -metrics-address, which is simple enough not to need its client
+// library.
+
+// metricSet is a set of metrics, each a family of samples told apart by their
+// labels.
+type metricSet struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	kind    string // counter, gauge or histogram
+	help    string
+	samples map[string]float64 // by formatted labels, e.g. {method="x"}
+
+	buckets    []float64             // upper bounds, for a histogram
+	histograms map[string]*histogram // by formatted labels
+}
+
+// histogram counts observations into buckets, each counting those no bigger
+// than its upper bound.
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// defaultBuckets are Prometheus's default histogram buckets, for latencies
+// in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newMetricSet() *metricSet {
+	return &metricSet{families: map[string]*metricFamily{}}
+}
+
+// metrics are dm-linuxkit's metrics. Everything that happens in the process
+// is counted whether or not they're served.
+var metrics = newMetricSet()
+
+func init() {
+	for _, m := range []struct{ name, kind, help string }{
+		{"dm_linuxkit_pool_size_bytes", "gauge", "Size of the pool."},
+		{"dm_linuxkit_pool_allocated_bytes", "gauge", "Space allocated in the pool."},
+		{"dm_linuxkit_pool_health", "gauge", "1 for the pool's current health, e.g. ONLINE."},
+		{"dm_linuxkit_dot_used_bytes", "gauge", "Space used by a mounted dot, including its snapshots."},
+		{"dm_linuxkit_child_up", "gauge", "Whether a child process (etcd or dotmesh-server) is running."},
+		{"dm_linuxkit_child_starts_total", "counter", "Times a child process has been started."},
+		{"dm_linuxkit_last_success_timestamp_seconds", "gauge", "When a seed, commit or push of a dot last succeeded."},
+		{"dm_linuxkit_transfer_bytes_total", "counter", "Bytes sent or received by seeds and pushes."},
+		{"dm_linuxkit_transfer_throughput_bytes_per_second", "gauge", "Throughput of the current or last transfer."},
+		{"dm_linuxkit_rpc_requests_total", "counter", "Calls to dotmesh's API."},
+		{"dm_linuxkit_rpc_errors_total", "counter", "Calls to dotmesh's API that failed."},
+		{"dm_linuxkit_rpc_duration_seconds", "histogram", "How long calls to dotmesh's API took."},
+	} {
+		metrics.describe(m.name, m.kind, m.help)
+	}
+}
+
+func (m *metricSet) describe(name, kind, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := &metricFamily{kind: kind, help: help, samples: map[string]float64{}}
+	if kind == "histogram" {
+		f.buckets = defaultBuckets
+		f.histograms = map[string]*histogram{}
+	}
+	m.families[name] = f
+}
+
+func (m *metricSet) family(name string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		panic(fmt.Sprintf("undescribed metric %s", name))
+	}
+	return f
+}
+
+// set sets a gauge.
+func (m *metricSet) set(name, labels string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name).samples[labels] = value
+}
+
+// add adds to a counter.
+func (m *metricSet) add(name, labels string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name).samples[labels] += value
+}
+
+// observe adds an observation to a histogram.
+func (m *metricSet) observe(name, labels string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name)
+	h, ok := f.histograms[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(f.buckets))}
+		f.histograms[labels] = h
+	}
+	for i, bound := range f.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// reset removes all of a gauge's samples, so ones for e.g. a dot that's been
+// unmounted don't hang around.
+func (m *metricSet) reset(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name)
+	f.samples = map[string]float64{}
+	if f.histograms != nil {
+		f.histograms = map[string]*histogram{}
+	}
+}
+
+func (m *metricSet) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := m.families[name]
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind); err != nil {
+			return err
+		}
+		var labels []string
+		for l := range f.samples {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			if _, err := fmt.Fprintf(w, "%s%s %g\n", name, l, f.samples[l]); err != nil {
+				return err
+			}
+		}
+		if err := f.writeHistograms(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHistograms writes a histogram's cumulative buckets, sum and count for
+// each set of labels.
+func (f *metricFamily) writeHistograms(w io.Writer, name string) error {
+	var labels []string
+	for l := range f.histograms {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		h := f.histograms[l]
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += h.counts[i]
+			le := withLabel(l, "le", fmt.Sprintf("%g", bound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, le, cumulative); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(
+			w, "%s_bucket%s %d\n%s_sum%s %g\n%s_count%s %d\n",
+			name, withLabel(l, "le", "+Inf"), h.count, name, l, h.sum, name, l, h.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label names and values, given alternately, for a sample.
+func labels(namesAndValues ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(
+			`%s="%s"`, namesAndValues[i], labelValueEscaper.Replace(namesAndValues[i+1]),
+		))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to formatted labels.
+func withLabel(formatted, name, value string) string {
+	extra := labels(name, value)
+	if formatted == "" || formatted == "{}" {
+		return extra
+	}
+	return strings.TrimSuffix(formatted, "}") + "," + strings.TrimPrefix(extra, "{")
+}
+
+// recordSuccess notes that operation (seed, commit or push) of dot worked.
+func recordSuccess(operation, dot string) {
+	metrics.set(
+		"dm_linuxkit_last_success_timestamp_seconds",
+		labels("operation", operation, "dot", dot),
+		float64(time.Now().UnixNano())/1e9,
+	)
+}
+
+// recordRPC counts a call to dotmesh's API.
+func recordRPC(method string, took time.Duration, err error) {
+	l := labels("method", method)
+	metrics.add("dm_linuxkit_rpc_requests_total", l, 1)
+	metrics.observe("dm_linuxkit_rpc_duration_seconds", l, took.Seconds())
+	if err != nil {
+		metrics.add("dm_linuxkit_rpc_errors_total", l, 1)
+	}
+}
+
+// metricsCollector fills in the metrics that are read when they're scraped
+// rather than counted as things happen.
+type metricsCollector struct {
+	zfs     ZFS
+	pool    string
+	control *controlDaemon
+}
+
+func (c *metricsCollector) collect() {
+	metrics.reset("dm_linuxkit_pool_health")
+	info, err := c.zfs.Pool(c.pool)
+	if err != nil {
+		logger.Warnf("Couldn't get metrics for pool %s: %v", c.pool, err)
+	} else {
+		l := labels("pool", c.pool)
+		metrics.set("dm_linuxkit_pool_size_bytes", l, float64(info.Size))
+		metrics.set("dm_linuxkit_pool_allocated_bytes", l, float64(info.Allocated))
+		metrics.set("dm_linuxkit_pool_health", labels("pool", c.pool, "health", info.Health), 1)
+	}
+
+	metrics.reset("dm_linuxkit_dot_used_bytes")
+	c.control.mu.Lock()
+	var mounts []DaemonMount
+	for _, m := range c.control.mounts {
+		mounts = append(mounts, m)
+	}
+	c.control.mu.Unlock()
+	for _, m := range mounts {
+		if m.Id == "" {
+			// adoptMounts couldn't find it.
+			continue
+		}
+		space, err := datasetUsage(c.zfs, calculateDataset(c.pool, m.Id))
+		if err != nil {
+			logger.Warnf("Couldn't get metrics for dot %s: %v", m.Dot, err)
+			continue
+		}
+		metrics.set(
+			"dm_linuxkit_dot_used_bytes",
+			labels("dot", m.Dot, "mountpoint", m.Mountpoint),
+			float64(space.Used),
+		)
+	}
+}
+
+// serveMetrics serves /metrics at address until the listener it returns is
+// closed.
+func serveMetrics(address string, collector *metricsCollector) (net.Listener, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		collector.collect()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(listener, mux)
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	return listener, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+func TestMetricSetWrite(t *testing.T) {
+	m := newMetricSet()
+	m.describe("b_total", "counter", "Some bs.")
+	m.describe("a", "gauge", "An a.")
+	m.add("b_total", labels("method", "x"), 1)
+	m.add("b_total", labels("method", "x"), 2)
+	m.add("b_total", labels("method", `y"\`+"\n"), 1)
+	m.set("a", "", 0.5)
+
+	var out bytes.Buffer
+	if err := m.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP a An a.
+# TYPE a gauge
+a 0.5
+# HELP b_total Some bs.
+# TYPE b_total counter
+b_total{method="x"} 3
+b_total{method="y\"\\\n"} 1
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	m.reset("b_total")
+	out.Reset()
+	m.write(&out)
+	if bytes.Contains(out.Bytes(), []byte("b_total{")) {
+		t.Errorf("reset left samples:\n%s", out.String())
+	}
+}
+
+func TestMetricSetHistogram(t *testing.T) {
+	m := newMetricSet()
+	m.describe("took_seconds", "histogram", "How long.")
+	l := labels("method", "x")
+	m.observe("took_seconds", l, 0.001)
+	m.observe("took_seconds", l, 0.3)
+	m.observe("took_seconds", l, 0.5)
+	m.observe("took_seconds", l, 60)
+
+	var out bytes.Buffer
+	if err := m.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE took_seconds histogram\n",
+		`took_seconds_bucket{method="x",le="0.005"} 1` + "\n",
+		`took_seconds_bucket{method="x",le="0.25"} 1` + "\n",
+		`took_seconds_bucket{method="x",le="0.5"} 3` + "\n",
+		`took_seconds_bucket{method="x",le="10"} 3` + "\n",
+		`took_seconds_bucket{method="x",le="+Inf"} 4` + "\n",
+		`took_seconds_sum{method="x"} 60.801` + "\n",
+		`took_seconds_count{method="x"} 4` + "\n",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(expected)) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestStartChildTracksExit(t *testing.T) {
+	c, err := startChild("test-child", exec.Command("sh", "-c", "exit 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wait(); err == nil {
+		t.Errorf("expected the child's exit status as an error")
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	l := labels("process", "test-child")
+	if up, ok := metrics.families["dm_linuxkit_child_up"].samples[l]; !ok || up != 0 {
+		t.Errorf("expected child_up 0 once the child's exited, got %g", up)
+	}
+	if starts := metrics.families["dm_linuxkit_child_starts_total"].samples[l]; starts != 1 {
+		t.Errorf("expected 1 start, got %g", starts)
+	}
+}
+
+func TestRecordTransferProgress(t *testing.T) {
+	metrics.reset("dm_linuxkit_transfer_bytes_total")
+	counted := transferProgress{}
+	for _, result := range []TransferPollResult{
+		{Index: 1, Total: 2, Sent: 100, NanosecondsElapsed: 1e9},
+		{Index: 1, Total: 2, Sent: 300, NanosecondsElapsed: 2e9},
+		{Index: 1, Total: 2, Sent: 300, NanosecondsElapsed: 2e9},
+		// The next segment starts counting from 0 again.
+		{Index: 2, Total: 2, Sent: 50, NanosecondsElapsed: 1e9},
+	} {
+		r := result
+		recordTransferProgress(&counted, &r)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if sent := metrics.families["dm_linuxkit_transfer_bytes_total"].samples[""]; sent != 350 {
+		t.Errorf("expected 350 bytes counted, got %g", sent)
+	}
+	if speed := metrics.families["dm_linuxkit_transfer_throughput_bytes_per_second"].samples[""]; speed != 50 {
+		t.Errorf("expected 50 bytes/s, got %g", speed)
+	}
+}
@@ -0,0 +1,91 @@
+package mount
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// FakeMount is a mount recorded by a Fake.
+type FakeMount struct {
+	Op      string // "bind" or "zfs"
+	Source  string
+	Target  string
+	Options Options
+}
+
+// Fake is an in-memory Mounter which records mounts without touching the
+// kernel, for unit testing the code that drives mounts.
+type Fake struct {
+	mu     sync.Mutex
+	mounts map[string]FakeMount
+
+	// Fail, if set, is returned (as an *Error) by the next call to Bind,
+	// MountZFS or Unmount instead of doing anything.
+	Fail error
+}
+
+// NewFake returns a Fake with nothing mounted.
+func NewFake() *Fake {
+	return &Fake{mounts: map[string]FakeMount{}}
+}
+
+func (f *Fake) Bind(source, target string, opts Options) error {
+	return f.mount("bind", source, target, opts)
+}
+
+func (f *Fake) MountZFS(dataset, target string, opts Options) error {
+	return f.mount("zfs", dataset, target, opts)
+}
+
+func (f *Fake) mount(op, source, target string, opts Options) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure(); err != nil {
+		return &Error{Op: op, Source: source, Target: target, Err: err}
+	}
+	target = filepath.Clean(target)
+	if _, ok := f.mounts[target]; ok {
+		return &Error{Op: op, Source: source, Target: target, Err: syscall.EBUSY}
+	}
+	f.mounts[target] = FakeMount{Op: op, Source: source, Target: target, Options: opts}
+	return nil
+}
+
+func (f *Fake) Unmount(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeFailure(); err != nil {
+		return &Error{Op: "unmount", Target: target, Err: err}
+	}
+	target = filepath.Clean(target)
+	if _, ok := f.mounts[target]; !ok {
+		return &Error{Op: "unmount", Target: target, Err: syscall.EINVAL}
+	}
+	delete(f.mounts, target)
+	return nil
+}
+
+func (f *Fake) Mounted(target string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.mounts[filepath.Clean(target)]
+	return ok, nil
+}
+
+// Mounts returns everything currently mounted, keyed by target.
+func (f *Fake) Mounts() map[string]FakeMount {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mounts := make(map[string]FakeMount, len(f.mounts))
+	for k, v := range f.mounts {
+		mounts[k] = v
+	}
+	return mounts
+}
+
+func (f *Fake) takeFailure() error {
+	err := f.Fail
+	f.Fail = nil
+	return err
+}
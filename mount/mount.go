@@ -0,0 +1,98 @@
+// Package mount does the mounting dm-linuxkit needs (bind mounts of dots and
+// ZFS filesystems) with mount(2) directly, rather than shelling out to mount,
+// mount.zfs and mountpoint, which might not be in the image.
+package mount
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Propagation is the mount propagation type to set on a new mount, see
+// https://www.kernel.org/doc/Documentation/filesystems/sharedsubtree.txt
+type Propagation string
+
+const (
+	// Inherit leaves propagation as whatever the kernel gives the new mount.
+	Inherit  Propagation = ""
+	Private  Propagation = "private"
+	RPrivate Propagation = "rprivate"
+	Shared   Propagation = "shared"
+	RShared  Propagation = "rshared"
+	Slave    Propagation = "slave"
+	RSlave   Propagation = "rslave"
+)
+
+// ParsePropagation parses a propagation type as written in a LinuxKit yml
+// (e.g. rootfsPropagation: shared) or a mount -o option (e.g. rshared).
+func ParsePropagation(s string) (Propagation, error) {
+	switch p := Propagation(s); p {
+	case Inherit, Private, RPrivate, Shared, RShared, Slave, RSlave:
+		return p, nil
+	}
+	return Inherit, fmt.Errorf("unknown mount propagation %q", s)
+}
+
+// Options control how a new mount is made.
+type Options struct {
+	ReadOnly    bool
+	Propagation Propagation
+}
+
+// Mounter is the set of mount operations dm-linuxkit uses. New returns the
+// real, syscall backed implementation; NewFake returns an in-memory one for
+// tests.
+type Mounter interface {
+	// Bind bind mounts source onto target.
+	Bind(source, target string, opts Options) error
+	// MountZFS mounts a ZFS dataset with mountpoint=legacy (e.g.
+	// "pool/dotmesh-etcd") onto target.
+	MountZFS(dataset, target string, opts Options) error
+	// Unmount unmounts target.
+	Unmount(target string) error
+	// Mounted reports whether target is a mountpoint.
+	Mounted(target string) (bool, error)
+}
+
+// Error is returned by the syscall backed Mounter. Err is usually a
+// syscall.Errno, so callers can check for e.g. syscall.EPERM or syscall.EBUSY.
+type Error struct {
+	Op     string // "bind", "zfs", "remount", "propagation" or "unmount"
+	Source string
+	Target string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("mount %s of %s failed: %v", e.Op, e.Target, e.Err)
+	}
+	return fmt.Sprintf("mount %s of %s on %s failed: %v", e.Op, e.Source, e.Target, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// isMountpoint looks for target in a parsed mountinfo table. Paths are
+// compared after resolving symlinks, since that's what the kernel reports. A
+// target that doesn't exist isn't a mountpoint.
+func isMountpoint(mounts []Info, target string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(target)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == resolved {
+			return true, nil
+		}
+	}
+	return false, nil
+}
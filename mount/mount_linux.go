@@ -0,0 +1,100 @@
+package mount
+
+import (
+	"fmt"
+	"syscall"
+)
+
+type syscallMounter struct{}
+
+// New returns a Mounter which calls mount(2) and umount(2) directly.
+func New() Mounter {
+	return syscallMounter{}
+}
+
+// Bind doesn't use MS_REC: anything mounted under source (e.g. a commit's
+// .zfs/snapshot automount) isn't carried over, and a read-only remount only
+// applies to the top mount anyway, so a recursive bind could leave writable
+// mounts under a "read-only" one.
+func (syscallMounter) Bind(source, target string, opts Options) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND, "")
+	if err != nil {
+		return &Error{Op: "bind", Source: source, Target: target, Err: err}
+	}
+	// The kernel ignores MS_RDONLY on the initial bind, so it takes a remount
+	// to make a bind mount read-only.
+	if opts.ReadOnly {
+		err = syscall.Mount(
+			"", target, "",
+			syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "",
+		)
+		if err != nil {
+			return undoMount(target, &Error{Op: "remount", Target: target, Err: err})
+		}
+	}
+	if err := setPropagation(target, opts.Propagation); err != nil {
+		return undoMount(target, err)
+	}
+	return nil
+}
+
+func (syscallMounter) MountZFS(dataset, target string, opts Options) error {
+	var flags uintptr
+	if opts.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	err := syscall.Mount(dataset, target, "zfs", flags, "")
+	if err != nil {
+		return &Error{Op: "zfs", Source: dataset, Target: target, Err: err}
+	}
+	if err := setPropagation(target, opts.Propagation); err != nil {
+		return undoMount(target, err)
+	}
+	return nil
+}
+
+// undoMount unmounts target after finishing off a new mount there failed with
+// err, so we don't leave it half done (e.g. writable when it should be
+// read-only), and returns err.
+func undoMount(target string, err error) error {
+	if unmountErr := syscall.Unmount(target, 0); unmountErr != nil {
+		return fmt.Errorf("%v, and unmounting it again failed: %v", err, unmountErr)
+	}
+	return err
+}
+
+func (syscallMounter) Unmount(target string) error {
+	err := syscall.Unmount(target, 0)
+	if err != nil {
+		return &Error{Op: "unmount", Target: target, Err: err}
+	}
+	return nil
+}
+
+func (syscallMounter) Mounted(target string) (bool, error) {
+	mounts, err := GetMounts()
+	if err != nil {
+		return false, err
+	}
+	return isMountpoint(mounts, target)
+}
+
+var propagationFlags = map[Propagation]uintptr{
+	Private:  syscall.MS_PRIVATE,
+	RPrivate: syscall.MS_PRIVATE | syscall.MS_REC,
+	Shared:   syscall.MS_SHARED,
+	RShared:  syscall.MS_SHARED | syscall.MS_REC,
+	Slave:    syscall.MS_SLAVE,
+	RSlave:   syscall.MS_SLAVE | syscall.MS_REC,
+}
+
+func setPropagation(target string, propagation Propagation) error {
+	if propagation == Inherit {
+		return nil
+	}
+	err := syscall.Mount("", target, "", propagationFlags[propagation], "")
+	if err != nil {
+		return &Error{Op: "propagation", Target: target, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMounted(t *testing.T) {
+	m := New()
+	mounted, err := m.Mounted("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounted {
+		t.Error("expected / to be a mountpoint")
+	}
+	mounted, err = m.Mounted("/nonexistent/dm-linuxkit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted {
+		t.Error("expected a nonexistent path not to be a mountpoint")
+	}
+}
+
+// bindTest makes a source and target directory to bind mount, skipping the
+// test if we can't mount things.
+func bindTest(t *testing.T) (string, string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounting needs root")
+	}
+	dir, err := ioutil.TempDir("", "mount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, target := filepath.Join(dir, "source"), filepath.Join(dir, "target")
+	for _, d := range []string{source, target} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), []byte("hello"), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return source, target, func() {
+		syscall.Unmount(target, 0)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBindReadOnly(t *testing.T) {
+	source, target, cleanup := bindTest(t)
+	defer cleanup()
+	m := New()
+
+	err := m.Bind(source, target, Options{ReadOnly: true})
+	if mountErr, ok := err.(*Error); ok && mountErr.Err == syscall.EPERM {
+		t.Skip("not allowed to mount here")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	mounted, err := m.Mounted(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounted {
+		t.Fatalf("expected %s to be mounted", target)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(target, "file"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("expected to read the source's file, got %q, %v", content, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(target, "new"), nil, 0644)
+	if !os.IsPermission(err) && !isErrno(err, syscall.EROFS) {
+		t.Errorf("expected writing to the read-only mount to fail with EROFS, got %v", err)
+	}
+
+	if err := m.Unmount(target); err != nil {
+		t.Fatal(err)
+	}
+	mounted, err = m.Mounted(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted {
+		t.Errorf("expected %s to be unmounted", target)
+	}
+}
+
+func TestBindUnmountsOnPropagationFailure(t *testing.T) {
+	source, target, cleanup := bindTest(t)
+	defer cleanup()
+	m := New()
+
+	// There's no such propagation type, so setting it fails after the bind.
+	err := m.Bind(source, target, Options{Propagation: "bogus"})
+	if mountErr, ok := err.(*Error); ok && mountErr.Err == syscall.EPERM && mountErr.Op == "bind" {
+		t.Skip("not allowed to mount here")
+	}
+	if mountErr, ok := err.(*Error); !ok || mountErr.Op != "propagation" {
+		t.Fatalf("expected a propagation *Error, got %#v", err)
+	}
+	mounted, err := m.Mounted(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted {
+		t.Errorf("expected %s to be unmounted again after the failure", target)
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == errno
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const mountInfo = `22 28 0:21 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+28 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 28 98:0 /mnt1 /mnt\0402 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+40 28 0:45 / /var/dotmesh/mnt/dmfs/abc rw,relatime - zfs pool/dmfs/abc rw,xattr,noacl
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(mountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("expected 4 mounts, got %d: %+v", len(mounts), mounts)
+	}
+	expected := Info{
+		ID: 36, Parent: 28, Major: 98, Minor: 0,
+		Root: "/mnt1", Mountpoint: "/mnt 2", Options: "rw,noatime",
+		OptionalFields: []string{"master:1"},
+		FSType:         "ext3", Source: "/dev/root", SuperOptions: "rw,errors=continue",
+	}
+	if !reflect.DeepEqual(mounts[2], expected) {
+		t.Errorf("expected %+v, got %+v", expected, mounts[2])
+	}
+	if !mounts[1].Shared() || mounts[1].Slave() {
+		t.Errorf("expected / to be shared and not a slave: %+v", mounts[1])
+	}
+	if mounts[2].Shared() || !mounts[2].Slave() {
+		t.Errorf("expected /mnt 2 to be a slave and not shared: %+v", mounts[2])
+	}
+	if len(mounts[3].OptionalFields) != 0 || mounts[3].FSType != "zfs" {
+		t.Errorf("expected a private zfs mount: %+v", mounts[3])
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	for _, line := range []string{
+		"36 28 98:0 /mnt1 /mnt2 rw,noatime",
+		"x 28 98:0 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"36 28 98 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"36 28 98:0 /mnt1 /mnt2 rw - ext3",
+	} {
+		_, err := ParseMountInfo(strings.NewReader(mountInfo + line + "\n"))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", line)
+		} else if !strings.Contains(err.Error(), "line 5") {
+			t.Errorf("expected the error to say which line, got %v", err)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for _, c := range []struct{ escaped, expected string }{
+		{"/plain", "/plain"},
+		{`/a\040b`, "/a b"},
+		{`/tab\011and\012newline`, "/tab\tand\nnewline"},
+		{`/back\134slash`, `/back\slash`},
+		{`/short\04`, `/short\04`},
+		{`/notoctal\089`, `/notoctal\089`},
+	} {
+		if actual := unescape(c.escaped); actual != c.expected {
+			t.Errorf("unescape(%q): expected %q, got %q", c.escaped, c.expected, actual)
+		}
+	}
+}
+
+func TestParsePropagation(t *testing.T) {
+	for _, s := range []string{"", "private", "rprivate", "shared", "rshared", "slave", "rslave"} {
+		p, err := ParsePropagation(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+		} else if string(p) != s {
+			t.Errorf("%q: got %q", s, p)
+		}
+	}
+	for _, s := range []string{"Shared", "unbindable", "rw"} {
+		if _, err := ParsePropagation(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestIsMountpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The kernel reports the resolved path, so a symlink to a mountpoint is
+	// one.
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(resolvedDir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	mounts := []Info{{Mountpoint: target}}
+
+	for _, c := range []struct {
+		path     string
+		expected bool
+	}{
+		{target, true},
+		{link, true},
+		{dir, false},
+		{filepath.Join(dir, "nonexistent"), false},
+	} {
+		actual, err := isMountpoint(mounts, c.path)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		} else if actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.path, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package mount
+
+import (
+	"errors"
+)
+
+var errUnsupported = errors.New("mounting is only supported on linux")
+
+type unsupportedMounter struct{}
+
+// New returns a Mounter which always fails, as mount(2) is linux-only here.
+func New() Mounter {
+	return unsupportedMounter{}
+}
+
+func (unsupportedMounter) Bind(source, target string, opts Options) error {
+	return &Error{Op: "bind", Source: source, Target: target, Err: errUnsupported}
+}
+
+func (unsupportedMounter) MountZFS(dataset, target string, opts Options) error {
+	return &Error{Op: "zfs", Source: dataset, Target: target, Err: errUnsupported}
+}
+
+func (unsupportedMounter) Unmount(target string) error {
+	return &Error{Op: "unmount", Target: target, Err: errUnsupported}
+}
+
+func (unsupportedMounter) Mounted(target string) (bool, error) {
+	return false, errUnsupported
+}
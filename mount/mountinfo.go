@@ -0,0 +1,143 @@
+package mount
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Info is one line of /proc/<pid>/mountinfo, see proc(5).
+type Info struct {
+	ID             int
+	Parent         int
+	Major          int
+	Minor          int
+	Root           string
+	Mountpoint     string
+	Options        string
+	OptionalFields []string // e.g. "shared:1", "master:2"
+	FSType         string
+	Source         string
+	SuperOptions   string
+}
+
+// Shared reports whether the mount is in a peer group, i.e. has shared
+// propagation.
+func (i Info) Shared() bool {
+	return i.hasOptionalField("shared:")
+}
+
+// Slave reports whether the mount receives propagation from a master.
+func (i Info) Slave() bool {
+	return i.hasOptionalField("master:")
+}
+
+func (i Info) hasOptionalField(prefix string) bool {
+	for _, f := range i.OptionalFields {
+		if strings.HasPrefix(f, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMounts returns the mount table of the current process.
+func GetMounts() ([]Info, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
+
+// ParseMountInfo parses the format of /proc/<pid>/mountinfo.
+func ParseMountInfo(r io.Reader) ([]Info, error) {
+	var mounts []Info
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		info, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("mountinfo line %d: %v", lineNumber, err)
+		}
+		mounts = append(mounts, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+// (1)(2)(3)   (4)   (5)      (6)      (7)   (8) (9)   (10)         (11)
+func parseMountInfoLine(line string) (Info, error) {
+	fields := strings.Fields(line)
+	separator := -1
+	for i, f := range fields {
+		if f == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 6 || len(fields) < separator+3 {
+		return Info{}, fmt.Errorf("malformed line %q", line)
+	}
+
+	var info Info
+	var err error
+	if info.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return Info{}, fmt.Errorf("bad mount ID %q", fields[0])
+	}
+	if info.Parent, err = strconv.Atoi(fields[1]); err != nil {
+		return Info{}, fmt.Errorf("bad parent ID %q", fields[1])
+	}
+	majorMinor := strings.SplitN(fields[2], ":", 2)
+	if len(majorMinor) != 2 {
+		return Info{}, fmt.Errorf("bad major:minor %q", fields[2])
+	}
+	if info.Major, err = strconv.Atoi(majorMinor[0]); err != nil {
+		return Info{}, fmt.Errorf("bad major %q", majorMinor[0])
+	}
+	if info.Minor, err = strconv.Atoi(majorMinor[1]); err != nil {
+		return Info{}, fmt.Errorf("bad minor %q", majorMinor[1])
+	}
+	info.Root = unescape(fields[3])
+	info.Mountpoint = unescape(fields[4])
+	info.Options = fields[5]
+	info.OptionalFields = fields[6:separator]
+	info.FSType = fields[separator+1]
+	info.Source = unescape(fields[separator+2])
+	if len(fields) > separator+3 {
+		info.SuperOptions = fields[separator+3]
+	}
+	return info, nil
+}
+
+// unescape undoes the octal escaping (e.g. \040 for space) the kernel applies
+// to paths in mountinfo.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
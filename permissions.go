@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// rootPermissions describes the ownership and mode to apply to the root
+// directory of a dot. Empty fields mean "leave as-is".
+type rootPermissions struct {
+	Owner string // user name or numeric uid
+	Group string // group name or numeric gid
+	Mode  string // octal, e.g. "0755"
+}
+
+func (p rootPermissions) isSet() bool {
+	return p.Owner != "" || p.Group != "" || p.Mode != ""
+}
+
+// validate checks the owner, group and mode can be resolved, so that we fail
+// before touching the pool rather than halfway through bringing up a dot.
+func (p rootPermissions) validate() error {
+	if _, err := lookupUid(p.Owner); err != nil {
+		return err
+	}
+	if _, err := lookupGid(p.Group); err != nil {
+		return err
+	}
+	if _, err := parseMode(p.Mode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// apply chowns and chmods directory according to p.
+func (p rootPermissions) apply(directory string) error {
+	if !p.isSet() {
+		return nil
+	}
+	uid, err := lookupUid(p.Owner)
+	if err != nil {
+		return err
+	}
+	gid, err := lookupGid(p.Group)
+	if err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		// -1 leaves that half of the ownership unchanged.
+		if err := os.Chown(directory, uid, gid); err != nil {
+			return err
+		}
+	}
+	if p.Mode != "" {
+		mode, err := parseMode(p.Mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(directory, mode); err != nil {
+			return err
+		}
+	}
+	log.Printf(
+		"Set %s to owner=%q group=%q mode=%q",
+		directory, p.Owner, p.Group, p.Mode,
+	)
+	return nil
+}
+
+// lookupUid resolves a user name or numeric uid. On LinuxKit there's usually
+// no /etc/passwd entry for the service that'll use the dot, so numeric ids
+// are the common case.
+func lookupUid(owner string) (int, error) {
+	if owner == "" {
+		return -1, nil
+	}
+	if numericId(owner) {
+		return parseId(owner, "owner")
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return -1, fmt.Errorf("unknown owner %q: %v", owner, err)
+	}
+	return parseId(u.Uid, "owner")
+}
+
+func lookupGid(group string) (int, error) {
+	if group == "" {
+		return -1, nil
+	}
+	if numericId(group) {
+		return parseId(group, "group")
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, fmt.Errorf("unknown group %q: %v", group, err)
+	}
+	return parseId(g.Gid, "group")
+}
+
+// numericId says whether id is meant as a number rather than a name,
+// including bad numbers like -1, which parseId then rejects.
+func numericId(id string) bool {
+	return strings.TrimLeft(strings.TrimPrefix(id, "-"), "0123456789") == ""
+}
+
+// parseId parses a uid or gid. They're unsigned 32 bit, and the largest is
+// chown's "don't change", so isn't allowed either.
+func parseId(id, kind string) (int, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil || n == 1<<32-1 {
+		return -1, fmt.Errorf("invalid %s %q, expected a name or an id from 0 to %d", kind, id, uint32(1<<32-2))
+	}
+	return int(n), nil
+}
+
+func parseMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal e.g. 0755", mode)
+	}
+	// os.FileMode keeps setuid/setgid/sticky in its own high bits.
+	fileMode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode, nil
+}
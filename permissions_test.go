@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	for mode, expected := range map[string]os.FileMode{
+		"":     0,
+		"0755": 0755,
+		"700":  0700,
+		"1777": 0777 | os.ModeSticky,
+		"2750": 0750 | os.ModeSetgid,
+		"4755": 0755 | os.ModeSetuid,
+	} {
+		m, err := parseMode(mode)
+		if err != nil || m != expected {
+			t.Errorf("%q: expected %s, got %s (%v)", mode, expected, m, err)
+		}
+	}
+	for _, mode := range []string{"rwx", "0789", "10000", "-755"} {
+		if _, err := parseMode(mode); err == nil {
+			t.Errorf("%q: expected an error", mode)
+		}
+	}
+}
+
+func TestLookupIds(t *testing.T) {
+	for _, tc := range []struct {
+		id       string
+		expected int
+	}{
+		{"", -1},
+		{"0", 0},
+		{"1000", 1000},
+		{"4294967294", 4294967294},
+		{"root", 0},
+	} {
+		uid, err := lookupUid(tc.id)
+		if err != nil || uid != tc.expected {
+			t.Errorf("owner %q: expected %d, got %d (%v)", tc.id, tc.expected, uid, err)
+		}
+		gid, err := lookupGid(tc.id)
+		if err != nil || gid != tc.expected {
+			t.Errorf("group %q: expected %d, got %d (%v)", tc.id, tc.expected, gid, err)
+		}
+	}
+	for _, id := range []string{"-1", "-", "4294967295", "99999999999", "no-such-user-here"} {
+		if uid, err := lookupUid(id); err == nil {
+			t.Errorf("owner %q: expected an error, got %d", id, uid)
+		}
+		if gid, err := lookupGid(id); err == nil {
+			t.Errorf("group %q: expected an error, got %d", id, gid)
+		}
+	}
+}
+
+func TestRootPermissionsApply(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := rootPermissions{Owner: "1000", Group: "1001", Mode: "2750"}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() != 0 {
+		p.Owner, p.Group = "", ""
+	}
+	if err := p.apply(root); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != os.ModeDir|os.ModeSetgid|0750 {
+		t.Errorf("expected mode 2750, got %s", info.Mode())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); p.Owner != "" && (stat.Uid != 1000 || stat.Gid != 1001) {
+		t.Errorf("expected owner 1000:1001, got %d:%d", stat.Uid, stat.Gid)
+	}
+}
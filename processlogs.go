@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROCESS_LOG_DIR is where the dm-linuxkit-logs filesystem, which keeps
+// etcd's and dotmesh-server's output across reboots, is mounted.
+const PROCESS_LOG_DIR = "/var/dotmesh/logs"
+
+// PROCESS_LOG_FILESYSTEM is the filesystem on the pool for process logs.
+const PROCESS_LOG_FILESYSTEM = "dm-linuxkit-logs"
+
+// logComponents are the processes we keep log files for.
+var logComponents = []string{"etcd", "dotmesh-server"}
+
+// processLogFlags say whether and how to keep log files for etcd and
+// dotmesh-server.
+type processLogFlags struct {
+	enabled *bool
+	dir     *string
+	maxSize *string
+	keep    *int
+}
+
+func addProcessLogFlags(flags *flag.FlagSet) *processLogFlags {
+	return &processLogFlags{
+		enabled: flags.Bool(
+			"process-logs", false,
+			"Also write etcd's and dotmesh-server's output to log files on a "+
+				"filesystem in the pool, so they survive reboots",
+		),
+		dir: addProcessLogDirFlag(flags),
+		maxSize: flags.String(
+			"process-log-max-size", "10M",
+			"Rotate a process's log file when it gets this big",
+		),
+		keep: flags.Int(
+			"process-log-keep", 5,
+			"Number of rotated log files to keep for each process",
+		),
+	}
+}
+
+func addProcessLogDirFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"process-log-dir", PROCESS_LOG_DIR,
+		"Where to mount the filesystem for process log files",
+	)
+}
+
+// setup creates and mounts the log filesystem, returning the processLogs
+// to write to, or nil if -process-logs isn't on. The filesystem's quota
+// leaves room for every log file plus a spare.
+func (f *processLogFlags) setup(zfs ZFS, pool string) (*processLogs, error) {
+	if !*f.enabled {
+		return nil, nil
+	}
+	maxSize, err := parseSize(*f.maxSize)
+	if err == nil && maxSize <= 0 {
+		err = fmt.Errorf("must be more than 0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-process-log-max-size: %v", err)
+	}
+	if *f.keep < 0 {
+		return nil, fmt.Errorf("-process-log-keep can't be negative")
+	}
+	if err := setupPoolFilesystem(zfs, pool, PROCESS_LOG_FILESYSTEM, *f.dir); err != nil {
+		return nil, err
+	}
+	quota := maxSize * int64(len(logComponents)*(*f.keep+1)+1)
+	err = applySpaceLimits(zfs, pool+"/"+PROCESS_LOG_FILESYSTEM, spaceLimits{
+		Quota: strconv.FormatInt(quota, 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Keeping etcd and dotmesh-server logs in %s", *f.dir)
+	return &processLogs{dir: *f.dir, maxSize: maxSize, keep: *f.keep}, nil
+}
+
+// processLogs are the log files for child processes.
+type processLogs struct {
+	dir     string
+	maxSize int64
+	keep    int
+
+	mu    sync.Mutex
+	files []*rotatingFile
+}
+
+// output returns where a child process's output should go: the log, and its
+// log file if we're keeping them. l can be nil.
+func (l *processLogs) output(process string) io.Writer {
+	w := newProcessLogWriter(process)
+	if l == nil {
+		return w
+	}
+	file := &rotatingFile{
+		path:    processLogPath(l.dir, process),
+		maxSize: l.maxSize,
+		keep:    l.keep,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files = append(l.files, file)
+	return &processOutput{process: process, file: file, log: w}
+}
+
+// processOutput writes a child process's output to its log file and the log.
+// Unlike io.MultiWriter, it carries on if the file can't be written, e.g.
+// because the filesystem's full, rather than blocking the process.
+type processOutput struct {
+	process   string
+	file      io.Writer
+	log       io.Writer
+	fileError bool
+}
+
+func (o *processOutput) Write(p []byte) (int, error) {
+	if _, err := o.file.Write(p); err != nil {
+		if !o.fileError {
+			logger.Alertf("couldn't write %s's log file: %v", o.process, err)
+		}
+		o.fileError = true
+	} else {
+		o.fileError = false
+	}
+	return o.log.Write(p)
+}
+
+func (l *processLogs) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range l.files {
+		f.Close()
+	}
+	return nil
+}
+
+func processLogPath(dir, process string) string {
+	return filepath.Join(dir, process+".log")
+}
+
+// rotatingFile appends to the file at path, opening it when first written
+// to. When a write would take it past maxSize, it's renamed to path.1, path.1
+// to path.2 and so on, keeping keep of them, and a new file started.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	os.Remove(rotatedLogPath(f.path, f.keep))
+	for i := f.keep - 1; i >= 1; i-- {
+		err := os.Rename(rotatedLogPath(f.path, i), rotatedLogPath(f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if f.keep > 0 {
+		if err := os.Rename(f.path, rotatedLogPath(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func rotatedLogPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// tailLog returns the last n lines of the log at path, including any rotated
+// files they're in, oldest first. It also returns the log itself, open just
+// after the last whole line it read, for followLog to carry on from even if
+// the log's rotated in between. The caller closes it.
+func tailLog(path string, n int) ([]string, *os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	// Leave a partly written last line for followLog to show once it's all
+	// there.
+	complete := bytes.LastIndexByte(content, '\n') + 1
+	if _, err := file.Seek(int64(complete), io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	lines := splitLines(content[:complete])
+	for i := 1; len(lines) < n; i++ {
+		rotated, err := ioutil.ReadFile(rotatedLogPath(path, i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		lines = append(splitLines(rotated), lines...)
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, file, nil
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// followLog copies what's appended to the log file to out until stop is
+// closed, starting from where file is. When the log's rotated, it finishes
+// the old file then starts on the new one. It closes file.
+func followLog(file *os.File, out io.Writer, interval time.Duration, stop <-chan struct{}) error {
+	path := file.Name()
+	defer func() {
+		file.Close()
+	}()
+	for {
+		if _, err := io.Copy(out, file); err != nil {
+			return err
+		}
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(path)
+		if err == nil && !os.SameFile(current, latest) {
+			// Rotated. Anything written to the old file since the copy
+			// above was written before the rename, so get that first.
+			if _, err := io.Copy(out, file); err != nil {
+				return err
+			}
+			newFile, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			file = newFile
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func logsCommand(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr, "Usage: %s logs <%s> [flags]\n",
+			os.Args[0], strings.Join(logComponents, "|"),
+		)
+		flags.PrintDefaults()
+	}
+	logging := addLogFlags(flags)
+	flagDir := addProcessLogDirFlag(flags)
+	flagLines := flags.Int("n", 50, "Number of lines to show")
+	flagFollow := flags.Bool("f", false, "Keep showing lines as they're logged")
+	// The component can come before or after the flags.
+	var component string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		component, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+	if component == "" {
+		component = flags.Arg(0)
+	}
+	if component == "dotmesh" {
+		component = "dotmesh-server"
+	}
+	known := false
+	for _, c := range logComponents {
+		known = known || c == component
+	}
+	if !known {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	path := processLogPath(*flagDir, component)
+	lines, file, err := tailLog(path, *flagLines)
+	if os.IsNotExist(err) {
+		logger.Fatalf("No log file for %s at %s, is up running with -process-logs?", component, path)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if !*flagFollow {
+		file.Close()
+		return
+	}
+	if err := followLog(file, os.Stdout, 500*time.Millisecond, nil); err != nil {
+		logger.Fatal(err)
+	}
+}
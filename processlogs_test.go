@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "etcd.log")
+
+	f := &rotatingFile{path: path, maxSize: 10, keep: 2}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	expected := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "three\n",
+	}
+	for p, content := range expected {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("expected %s to contain %q, got %q", p, content, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept too many rotated files: %v", err)
+	}
+
+	for n, expected := range map[int][]string{
+		0:   {},
+		3:   {"four", "five", "six"},
+		100: {"three", "four", "five", "six"},
+	} {
+		lines, file, err := tailLog(path, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("expected tail -n %d to be %v, got %v", n, expected, lines)
+		}
+	}
+}
+
+func TestTailLogMissing(t *testing.T) {
+	for _, n := range []int{10, 0} {
+		if _, _, err := tailLog("/nonexistent/etcd.log", n); !os.IsNotExist(err) {
+			t.Errorf("expected a not exist error with -n %d, got %v", n, err)
+		}
+	}
+}
+
+func TestFollowLog(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "etcd.log")
+	if err := ioutil.WriteFile(path, []byte("old\npart"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, file, err := tailLog(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"old"}) {
+		t.Errorf("expected just the whole line, got %v", lines)
+	}
+
+	var out bytes.Buffer
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- followLog(file, &out, 10*time.Millisecond, stop)
+	}()
+	f := &rotatingFile{path: path, maxSize: 16, keep: 1}
+	f.Write([]byte("ial\n"))
+	time.Sleep(100 * time.Millisecond)
+	// This rotates, and followLog starts on the new file.
+	f.Write([]byte("rotated\n"))
+	f.Close()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "partial\nrotated\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestFollowLogRotatedAfterTail(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "etcd.log")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, file, err := tailLog(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Between the tail and following: a last line, then a rotation to a
+	// new file that's bigger than the one we read.
+	f := &rotatingFile{path: path, maxSize: 9, keep: 1}
+	f.Write([]byte("last\n"))
+	f.Write([]byte("a longer new line\n"))
+	f.Close()
+
+	var out bytes.Buffer
+	stop := make(chan struct{})
+	close(stop)
+	if err := followLog(file, &out, time.Millisecond, stop); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "last\na longer new line\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestProcessLogsSetup(t *testing.T) {
+	_, restore := useFakeMounter()
+	defer restore()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+
+	enabled, logDir, maxSize, keep := true, filepath.Join(dir, "logs"), "1M", 3
+	opts := &processLogFlags{enabled: &enabled, dir: &logDir, maxSize: &maxSize, keep: &keep}
+	logs, err := opts.setup(zfs, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+	if !zfs.filesystems["pool/"+PROCESS_LOG_FILESYSTEM] {
+		t.Errorf("log filesystem wasn't created, calls: %v", zfs.calls)
+	}
+	// Two processes with 3 rotated files each, and a spare.
+	if quota := zfs.properties["pool/"+PROCESS_LOG_FILESYSTEM]["quota"]; quota != "9437184" {
+		t.Errorf("expected a 9M quota, got %q", quota)
+	}
+
+	w := logs.output("etcd")
+	w.Write([]byte("started\n"))
+	b, err := ioutil.ReadFile(processLogPath(logDir, "etcd"))
+	if err != nil || !strings.Contains(string(b), "started") {
+		t.Errorf("output not written to the log file: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// spaceLimits are the ZFS space properties we manage on a dataset. Values are
+// as zfs set takes them, e.g. "10G" or "none"; empty means leave it alone.
+type spaceLimits struct {
+	Quota       string // limit on the dataset and its snapshots
+	Refquota    string // limit on the data the dataset itself references
+	Reservation string // space guaranteed to the dataset
+}
+
+func (l spaceLimits) properties() map[string]string {
+	properties := map[string]string{}
+	if l.Quota != "" {
+		properties["quota"] = l.Quota
+	}
+	if l.Refquota != "" {
+		properties["refquota"] = l.Refquota
+	}
+	if l.Reservation != "" {
+		properties["reservation"] = l.Reservation
+	}
+	return properties
+}
+
+// validate checks the values look like sizes before we hand them to zfs.
+func (l spaceLimits) validate() error {
+	for name, value := range l.properties() {
+		if strings.ToLower(value) == "none" {
+			continue
+		}
+		if _, err := parseSize(value); err != nil {
+			return fmt.Errorf("bad %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// applySpaceLimits sets limits on dataset, then logs its usage against them.
+// It's run on every boot, so changing a limit just takes a reboot.
+func applySpaceLimits(zfs ZFS, dataset string, limits spaceLimits) error {
+	for name, value := range limits.properties() {
+		if err := zfs.SetProperty(dataset, name, value); err != nil {
+			return err
+		}
+	}
+	return logDatasetUsage(zfs, dataset)
+}
+
+func logDatasetUsage(zfs ZFS, dataset string) error {
+	usage, err := datasetUsage(zfs, dataset)
+	if err != nil {
+		return err
+	}
+	log.Printf(
+		"%s: %d bytes used, %d available, quota %s, refquota %s, reservation %s",
+		dataset, usage.Used, usage.Available, usage.Quota, usage.Refquota,
+		usage.Reservation,
+	)
+	return nil
+}
+
+// datasetSpace is how much space a dataset is using, and its limits.
+type datasetSpace struct {
+	Used        uint64
+	Available   uint64
+	Referenced  uint64
+	Quota       string // bytes, or "none"
+	Refquota    string
+	Reservation string
+}
+
+func datasetUsage(zfs ZFS, dataset string) (datasetSpace, error) {
+	datasets, err := zfs.Datasets(dataset)
+	if err != nil {
+		return datasetSpace{}, err
+	}
+	var space datasetSpace
+	for _, d := range datasets {
+		if d.Name == dataset {
+			space.Used, space.Available, space.Referenced = d.Used, d.Available, d.Referenced
+		}
+	}
+	properties, err := zfs.DatasetProperties(dataset, "quota", "refquota", "reservation")
+	if err != nil {
+		return datasetSpace{}, err
+	}
+	for _, p := range properties {
+		// -p prints an unset limit as 0.
+		value := p.Value
+		if value == "0" || value == "-" {
+			value = "none"
+		}
+		switch p.Property {
+		case "quota":
+			space.Quota = value
+		case "refquota":
+			space.Refquota = value
+		case "reservation":
+			space.Reservation = value
+		}
+	}
+	return space, nil
+}
+
+// calculateDataset returns the ZFS dataset dotmesh keeps a dot's filesystem
+// in, given its ID from DotmeshRPC.Lookup.
+func calculateDataset(pool, fs string) string {
+	return pool + "/dmfs/" + fs
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSpaceLimitsValidate(t *testing.T) {
+	good := []spaceLimits{
+		{},
+		{Quota: "10G", Refquota: "none"},
+		{Reservation: "268435456"},
+	}
+	for _, limits := range good {
+		if err := limits.validate(); err != nil {
+			t.Errorf("%+v: %v", limits, err)
+		}
+	}
+	bad := []spaceLimits{{Quota: "lots"}, {Refquota: "-1G"}, {Reservation: "10Q"}}
+	for _, limits := range bad {
+		if err := limits.validate(); err == nil {
+			t.Errorf("expected an error for %+v", limits)
+		}
+	}
+}
+
+func TestApplySpaceLimits(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+	zfs.filesystems["pool/dmfs/fs-1"] = true
+
+	err := applySpaceLimits(zfs, "pool/dmfs/fs-1", spaceLimits{Quota: "10G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("SetProperty pool/dmfs/fs-1 quota=10G"); n != 1 {
+		t.Errorf("expected quota to be set once, calls: %v", zfs.calls)
+	}
+
+	space, err := datasetUsage(zfs, "pool/dmfs/fs-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if space.Quota != "10G" || space.Refquota != "none" || space.Reservation != "none" {
+		t.Errorf("unexpected limits: %+v", space)
+	}
+
+	// Nothing to set is fine, and leaves the dataset alone.
+	zfs.calls = nil
+	if err := applySpaceLimits(zfs, "pool/dmfs/fs-1", spaceLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := zfs.callsTo("SetProperty"); n != 0 {
+		t.Errorf("unexpected calls: %v", zfs.calls)
+	}
+
+	if err := applySpaceLimits(zfs, "pool/dmfs/missing", spaceLimits{Quota: "1G"}); err == nil {
+		t.Errorf("expected an error for a missing dataset")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// READY_DIR is where we write a file for each dot we've mounted, once it's
+// mounted, for containers that use the dot to wait for with `dm-linuxkit wait`
+// (or a shell loop). Bind it into both. On LinuxKit, /run is a tmpfs, so
+// they're gone after a reboot until the dots are mounted again.
+const READY_DIR = "/run/dotmesh/ready"
+
+func addReadyDirFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"ready-dir", READY_DIR,
+		"Where to write a file for each mounted dot, for dm-linuxkit wait",
+	)
+}
+
+// readyFilePath is the ready file for mountpoint in dir, named like systemd
+// names mount units: /var/dot/test is var-dot-test.
+func readyFilePath(dir, mountpoint string) string {
+	return filepath.Join(dir, escapePath(mountpoint))
+}
+
+// escapePath escapes a path as systemd-escape --path does.
+func escapePath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			escaped.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c == '_' || c == '.' || c >= 'a' && c <= 'z' ||
+				c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'):
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+// markReady writes m's ready file in dir, saying which dot's mounted there.
+// It's written to a temporary file and renamed, so waiters never see it half
+// written.
+func markReady(dir string, m DaemonMount) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := readyFilePath(dir, m.Mountpoint)
+	if err := ioutil.WriteFile(path+".tmp", append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// markNotReady removes mountpoint's ready file from dir, if it's there.
+func markNotReady(dir, mountpoint string) error {
+	err := os.Remove(readyFilePath(dir, mountpoint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// unmountReady unmounts mountpoint, then removes its ready file in dir. If
+// the unmount fails, the dot's still there, so the file's left alone and
+// anything waiting on it carries on seeing the dot as ready.
+func unmountReady(dir, mountpoint string) error {
+	if err := mounter.Unmount(mountpoint); err != nil {
+		return err
+	}
+	return markNotReady(dir, mountpoint)
+}
+
+// waitForReady waits for all of mountpoints' ready files to appear in dir,
+// checking every interval, for up to timeout (or forever if it's 0).
+func waitForReady(dir string, mountpoints []string, interval, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		var waiting []string
+		for _, mountpoint := range mountpoints {
+			_, err := os.Stat(readyFilePath(dir, mountpoint))
+			if os.IsNotExist(err) {
+				waiting = append(waiting, mountpoint)
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf(
+				"timed out after %s waiting for %s", timeout, strings.Join(waiting, ", "),
+			)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// mountpointsFlag is a -mount flag that can be given more than once.
+type mountpointsFlag []string
+
+func (f *mountpointsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *mountpointsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func waitCommand(args []string) {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr, "Usage: %s wait -mount=<mountpoint> [flags] [command [args]]\n",
+			os.Args[0],
+		)
+		flags.PrintDefaults()
+	}
+	logging := addLogFlags(flags)
+	var mountpoints mountpointsFlag
+	flags.Var(&mountpoints, "mount", "Mountpoint of a dot to wait for, can be given more than once")
+	flagReadyDir := addReadyDirFlag(flags)
+	flagTimeout := flags.Duration("timeout", 0, "Give up after this long, or 0 to wait forever")
+	flags.Parse(args)
+	if err := logging.setup(); err != nil {
+		logger.Fatal(err)
+	}
+	if len(mountpoints) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	logger.Debugf("Waiting for %s", mountpoints.String())
+	if err := waitForReady(*flagReadyDir, mountpoints, 500*time.Millisecond, *flagTimeout); err != nil {
+		logger.Fatal(err)
+	}
+	if flags.NArg() == 0 {
+		return
+	}
+
+	// Run the rest of the command line in our place, so we can go in front of
+	// a container's entrypoint.
+	command, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := syscall.Exec(command, flags.Args(), os.Environ()); err != nil {
+		logger.Fatalf("Couldn't run %s: %v", command, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEscapePath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/var/dot/test":        "var-dot-test",
+		"/var/dot/test/":       "var-dot-test",
+		"/var/dot/my-dot":      `var-dot-my\x2ddot`,
+		"/var/dot/.hidden":     "var-dot-.hidden",
+		"/.hidden/dot":         `\x2ehidden-dot`,
+		"/var/dot/with space":  `var-dot-with\x20space`,
+		"/var/dot/under_score": "var-dot-under_score",
+		"/":                    "-",
+	} {
+		if escaped := escapePath(path); escaped != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, escaped)
+		}
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = waitForReady(dir, []string{"/var/dot/a", "/var/dot/b"}, time.Millisecond, 20*time.Millisecond)
+	if err == nil || err.Error() != "timed out after 20ms waiting for /var/dot/a, /var/dot/b" {
+		t.Errorf("expected to time out waiting for both, got %v", err)
+	}
+
+	if err := markReady(dir, DaemonMount{Dot: "a", Mountpoint: "/var/dot/a"}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		markReady(dir, DaemonMount{Dot: "b", Mountpoint: "/var/dot/b"})
+	}()
+	if err := waitForReady(dir, []string{"/var/dot/a", "/var/dot/b"}, time.Millisecond, 0); err != nil {
+		t.Errorf("expected both to be ready, got %v", err)
+	}
+
+	if err := markNotReady(dir, "/var/dot/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := markNotReady(dir, "/var/dot/a"); err != nil {
+		t.Errorf("removing a missing ready file should be fine, got %v", err)
+	}
+	err = waitForReady(dir, []string{"/var/dot/a"}, time.Millisecond, 5*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected /var/dot/a not to be ready after markNotReady")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// DOT_NAME_PROPERTY is a ZFS user property dm-linuxkit keeps a dot's
+// namespace/name in, on the dot's dataset, so the dot can be found again if
+// dotmesh's etcd (which is the only other place names are kept) is lost.
+const DOT_NAME_PROPERTY = "io.dotmesh.linuxkit:name"
+
+// taggedDot is a dot's dataset on the pool and the name it's tagged with.
+type taggedDot struct {
+	Namespace string
+	Name      string
+	Id        string // the dot's filesystem ID, as from DotmeshRPC.Lookup
+}
+
+// tagDotDataset records namespace/name on the dataset of the dot with ID id.
+func tagDotDataset(zfs ZFS, pool, id, namespace, name string) error {
+	return zfs.SetProperty(calculateDataset(pool, id), DOT_NAME_PROPERTY, namespace+"/"+name)
+}
+
+// taggedDots returns the dots on the pool whose datasets are tagged with a
+// name. Datasets dotmesh made without us (e.g. branches) aren't tagged.
+func taggedDots(zfs ZFS, pool string) ([]taggedDot, error) {
+	exists, err := zfs.FilesystemExists(pool, "dmfs")
+	if err != nil || !exists {
+		return nil, err
+	}
+	datasets, err := zfs.Datasets(pool + "/dmfs")
+	if err != nil {
+		return nil, err
+	}
+	var dots []taggedDot
+	for _, dataset := range datasets {
+		id := strings.TrimPrefix(dataset.Name, pool+"/dmfs/")
+		if id == dataset.Name || strings.Contains(id, "/") {
+			continue
+		}
+		properties, err := zfs.DatasetProperties(dataset.Name, DOT_NAME_PROPERTY)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range properties {
+			parts := strings.SplitN(p.Value, "/", 2)
+			if p.Property != DOT_NAME_PROPERTY || len(parts) != 2 {
+				continue
+			}
+			dots = append(dots, taggedDot{Namespace: parts[0], Name: parts[1], Id: id})
+		}
+	}
+	return dots, nil
+}
+
+// registerFilesystemArgs are the arguments to dotmesh's
+// DotmeshRPC.RegisterFilesystem, which names an existing filesystem.
+type registerFilesystemArgs struct {
+	Namespace              string
+	TopLevelFilesystemName string
+	CloneName              string
+	FilesystemId           string
+}
+
+// recoverDots finds dots on the pool that dotmesh doesn't know the names of,
+// which happens when its etcd data is lost but the pool isn't. If register is
+// set it gives them their names back, otherwise it warns about each and
+// carries on without them.
+func recoverDots(zfs ZFS, pool, adminApiKey string, register bool) error {
+	dots, err := taggedDots(zfs, pool)
+	if err != nil {
+		return err
+	}
+	for _, dot := range dots {
+		var id string
+		err := doRPC(
+			dotmeshAddress, "admin", adminApiKey,
+			"DotmeshRPC.Exists",
+			map[string]string{"Name": dot.Name, "Namespace": dot.Namespace},
+			&id,
+		)
+		if err != nil {
+			return err
+		}
+		if id == dot.Id {
+			continue
+		}
+		if id != "" {
+			logger.Warnf(
+				"Dot %s/%s is %s but dataset %s is tagged with its name, leaving it alone",
+				dot.Namespace, dot.Name, id, calculateDataset(pool, dot.Id),
+			)
+			continue
+		}
+		if !register {
+			logger.Warnf(
+				"dotmesh doesn't know about dot %s/%s in dataset %s, was its etcd lost? "+
+					"Carrying on without it; pass -recover to register it again",
+				dot.Namespace, dot.Name, calculateDataset(pool, dot.Id),
+			)
+			continue
+		}
+		var result bool
+		err = doRPC(
+			dotmeshAddress, "admin", adminApiKey,
+			"DotmeshRPC.RegisterFilesystem",
+			registerFilesystemArgs{
+				Namespace:              dot.Namespace,
+				TopLevelFilesystemName: dot.Name,
+				FilesystemId:           dot.Id,
+			},
+			&result,
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf(
+			"Recovered dot %s/%s from dataset %s",
+			dot.Namespace, dot.Name, calculateDataset(pool, dot.Id),
+		)
+	}
+	return nil
+}
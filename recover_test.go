@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTaggedDots(t *testing.T) {
+	zfs := newFakeZFS()
+	zfs.pools["pool"] = []string{"/dev/sda"}
+
+	// No dots yet, so no dmfs either.
+	dots, err := taggedDots(zfs, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dots) != 0 {
+		t.Errorf("expected no dots, got %+v", dots)
+	}
+
+	zfs.filesystems["pool/dmfs"] = true
+	zfs.filesystems["pool/dmfs/fs-1"] = true
+	zfs.filesystems["pool/dmfs/fs-2"] = true // e.g. a branch, not tagged
+	zfs.filesystems["pool/dmfs/fs-1/child"] = true
+	if err := tagDotDataset(zfs, "pool", "fs-1", "admin", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	dots, err = taggedDots(zfs, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []taggedDot{{Namespace: "admin", Name: "test", Id: "fs-1"}}
+	if !reflect.DeepEqual(dots, expected) {
+		t.Errorf("expected %+v, got %+v", expected, dots)
+	}
+}
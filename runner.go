@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// COMMAND_TIMEOUT bounds how long we'll wait for any one zpool or zfs command.
+// zpool create on a big device, or an import, can legitimately take a while.
+const COMMAND_TIMEOUT = 5 * time.Minute
+
+// CommandResult is what a command printed and how it exited.
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Runner runs external commands. Exiting non-zero is not an error as far as
+// Run is concerned, it's reported in the result's ExitCode; an error means the
+// command couldn't be run at all, or was cancelled.
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) (CommandResult, error)
+}
+
+// CommandNotFoundError is returned by Run when the binary isn't on the PATH,
+// so that e.g. a missing zfs can't be mistaken for a missing filesystem.
+type CommandNotFoundError struct {
+	Name string
+}
+
+func (e *CommandNotFoundError) Error() string {
+	return fmt.Sprintf("%s: command not found", e.Name)
+}
+
+// CommandFailedError describes a command which ran but exited non-zero.
+type CommandFailedError struct {
+	Command string
+	Result  CommandResult
+}
+
+func (e *CommandFailedError) Error() string {
+	return fmt.Sprintf(
+		"%s failed (exit status %d): %s",
+		e.Command, e.Result.ExitCode, strings.TrimSpace(e.Result.Stderr),
+	)
+}
+
+// execRunner is the Runner that actually runs things, with a per-command
+// timeout on top of whatever the caller's context imposes.
+type execRunner struct {
+	timeout time.Duration
+}
+
+func newExecRunner() Runner {
+	return execRunner{timeout: COMMAND_TIMEOUT}
+}
+
+func (r execRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	result := CommandResult{
+		Stdout: stdout.String(),
+		Stderr: stderr.String(),
+	}
+	if err == nil {
+		return result, nil
+	}
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), ctx.Err())
+	}
+	if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+		return result, &CommandNotFoundError{Name: name}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			result.ExitCode = status.ExitStatus()
+			return result, nil
+		}
+	}
+	return result, err
+}
+
+// runChecked runs a command with runner and turns a non-zero exit into a
+// *CommandFailedError, for callers that only care whether it worked.
+func runChecked(runner Runner, name string, args ...string) (CommandResult, error) {
+	result, err := runner.Run(context.Background(), name, args...)
+	if err != nil {
+		return result, err
+	}
+	if result.ExitCode != 0 {
+		return result, &CommandFailedError{
+			Command: name + " " + strings.Join(args, " "),
+			Result:  result,
+		}
+	}
+	return result, nil
+}
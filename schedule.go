@@ -0,0 +1,355 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The up daemon can commit dots on a schedule, so there's always a recent
+// commit to go back to or push. A schedule is an interval, e.g. 1h, or a cron
+// expression, e.g. "0 3 * * *" for 3am every day.
+
+func addCommitScheduleFlag(flags *flag.FlagSet) *string {
+	return flags.String(
+		"commit-schedule", "",
+		"Commit the dot when running as a daemon, every interval (e.g. 1h) or "+
+			"on a cron schedule (e.g. \"0 3 * * *\"), skipping commits when "+
+			"nothing's changed",
+	)
+}
+
+// commitSchedule says when to commit.
+type commitSchedule struct {
+	spec     string
+	interval time.Duration // if it's an interval
+	cron     *cronSchedule // otherwise
+}
+
+func parseCommitSchedule(spec string) (*commitSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("commit schedule interval must be more than 0, not %s", spec)
+		}
+		return &commitSchedule{spec: spec, interval: interval}, nil
+	}
+	cron, err := parseCron(spec)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"commit schedule %q isn't an interval (e.g. 1h) or cron expression: %v", spec, err,
+		)
+	}
+	return &commitSchedule{spec: spec, cron: cron}, nil
+}
+
+func (s *commitSchedule) String() string {
+	return s.spec
+}
+
+// next is when to commit after the time given.
+func (s *commitSchedule) next(after time.Time) time.Time {
+	if s.cron == nil {
+		return after.Add(s.interval)
+	}
+	return s.cron.next(after)
+}
+
+// cronSchedule is a standard five field cron expression: minute, hour, day of
+// month, month and day of week (0 or 7 for Sunday). Each field is *, a number,
+// a range (1-5) or a list of them (1,15), optionally with a step (*/15).
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit n set if n matches
+	domAny, dowAny                bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	if alias, ok := cronAliases[spec]; ok {
+		spec = alias
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	c := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		name     string
+		bits     *uint64
+		min, max int
+	}{
+		{"minute", &c.minute, 0, 59},
+		{"hour", &c.hour, 0, 23},
+		{"day of month", &c.dom, 1, 31},
+		{"month", &c.month, 1, 12},
+		{"day of week", &c.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.bits = bits
+	}
+	// Sunday is 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("never matches")
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+		first, last := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if first, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end, every 15.
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for n := first; n <= last; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron, if both are restricted, either matching will do.
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next is the first minute after the time given that matches, in its time
+// zone, or the zero time if there isn't one in the next five years.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// DaemonSchedule is how a dot's scheduled commits are going, for
+// ControlRPC.Status.
+type DaemonSchedule struct {
+	Dot            string
+	Branch         string `json:",omitempty"` // "" for master
+	Schedule       string
+	Next           time.Time
+	LastCommit     string    // ID of the last scheduled commit, "" if none yet
+	LastCommitTime time.Time // when it was made
+	LastChecked    time.Time // when we last committed or found nothing to commit
+	LastError      string    // from the last try, if it failed
+}
+
+// scheduleKey is what the daemon keeps a schedule under. Each branch of a dot
+// can have its own.
+type scheduleKey struct {
+	dot    string
+	branch string // "" for master
+}
+
+func newScheduleKey(dot, branch string) scheduleKey {
+	return scheduleKey{dot: dot, branch: branchName(branch)}
+}
+
+// String gives the dot's name, and its branch unless that's master.
+func (k scheduleKey) String() string {
+	if k.branch == "" {
+		return k.dot
+	}
+	return fmt.Sprintf("branch %s of %s", k.branch, k.dot)
+}
+
+// scheduledCommits commits a dot on its schedule until stopped.
+type scheduledCommits struct {
+	adminApiKey string
+	schedule    *commitSchedule
+	stop        chan struct{}
+
+	mu     sync.Mutex
+	status DaemonSchedule
+}
+
+func newScheduledCommits(adminApiKey, dot, branch string, schedule *commitSchedule) *scheduledCommits {
+	return &scheduledCommits{
+		adminApiKey: adminApiKey,
+		schedule:    schedule,
+		stop:        make(chan struct{}),
+		status:      DaemonSchedule{Dot: dot, Branch: branchName(branch), Schedule: schedule.String()},
+	}
+}
+
+func (s *scheduledCommits) run() {
+	for {
+		next := s.schedule.next(time.Now())
+		s.mu.Lock()
+		s.status.Next = next
+		s.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.commit()
+	}
+}
+
+// commit commits the dot if it's changed since its last commit.
+func (s *scheduledCommits) commit() {
+	status := s.Status()
+	dot := status.Dot
+	key := newScheduleKey(dot, status.Branch)
+	commitId, err := func() (string, error) {
+		id, err := lookupDot(s.adminApiKey, dot, status.Branch)
+		if err != nil {
+			return "", err
+		}
+		var volume dotmeshVolume
+		err = doRPC(dotmeshAddress, "admin", s.adminApiKey, "DotmeshRPC.Get", id, &volume)
+		if err != nil {
+			return "", err
+		}
+		if volume.DirtyBytes == 0 {
+			return "", nil
+		}
+		return commitDot(
+			s.adminApiKey, dot, status.Branch, fmt.Sprintf("Scheduled commit (%s)", s.schedule),
+			"schedule", map[string]string{"schedule": s.schedule.String()},
+		)
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	switch {
+	case err != nil:
+		s.status.LastError = err.Error()
+		logger.Alertf("scheduled commit of %s failed: %v", key, err)
+		return
+	case commitId == "":
+		logger.Debugf("Nothing's changed in %s since its last commit, not committing", key)
+	default:
+		s.status.LastCommit, s.status.LastCommitTime = commitId, now
+		log.Printf("Committed %s as %s on schedule", key, commitId)
+	}
+	s.status.LastChecked = now
+	s.status.LastError = ""
+}
+
+func (s *scheduledCommits) Status() DaemonSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// scheduleCommits starts committing branch of dot on schedule. A branch only
+// has one schedule at a time.
+func (d *controlDaemon) scheduleCommits(dot, branch string, schedule *commitSchedule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := newScheduleKey(dot, branch)
+	if existing, ok := d.schedules[key]; ok {
+		return fmt.Errorf("%s is already committed on schedule %s", key, existing.schedule)
+	}
+	s := newScheduledCommits(d.adminApiKey, dot, branch, schedule)
+	d.schedules[key] = s
+	go s.run()
+	log.Printf("Committing %s on schedule %s", key, schedule)
+	return nil
+}
+
+// unscheduleCommits stops committing branch of dot on a schedule, if it was.
+func (d *controlDaemon) unscheduleCommits(dot, branch string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.unscheduleLocked(newScheduleKey(dot, branch))
+}
+
+// unscheduleLocked is unscheduleCommits for when d.mu is already held.
+func (d *controlDaemon) unscheduleLocked(key scheduleKey) {
+	if s, ok := d.schedules[key]; ok {
+		close(s.stop)
+		delete(d.schedules, key)
+	}
+}
+
+// stopScheduledCommits stops all the scheduled commits, when we're shutting
+// down.
+func (d *controlDaemon) stopScheduledCommits() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.schedules {
+		d.unscheduleLocked(key)
+	}
+}
+
+func (d *controlDaemon) scheduleStatuses() []DaemonSchedule {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var statuses []DaemonSchedule
+	for _, s := range d.schedules {
+		statuses = append(statuses, s.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Dot != statuses[j].Dot {
+			return statuses[i].Dot < statuses[j].Dot
+		}
+		return statuses[i].Branch < statuses[j].Branch
+	})
+	return statuses
+}
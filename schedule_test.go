@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommitSchedule(t *testing.T) {
+	s, err := parseCommitSchedule("90m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	if next := s.next(start); !next.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("expected 90m after %s, got %s", start, next)
+	}
+
+	for _, tc := range []struct {
+		spec     string
+		expected string
+	}{
+		{"0s", "must be more than 0"},
+		{"-1h", "must be more than 0"},
+		{"hourly", "expected 5 fields"},
+		{"60 * * * *", "minute"},
+		{"* 24 * * *", "hour"},
+		{"* * 0 * *", "day of month"},
+		{"* * * 13 *", "month"},
+		{"* * * * 8", "day of week"},
+		{"*/0 * * * *", "bad step"},
+		{"5-1 * * * *", "out of range"},
+		{"x * * * *", "bad value"},
+		{"0 0 30 2 *", "never matches"},
+	} {
+		_, err := parseCommitSchedule(tc.spec)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", tc.spec, tc.expected, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Sunday.
+	start := time.Date(2018, 7, 1, 12, 34, 56, 0, time.UTC)
+	for _, tc := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2018, 7, 1, 12, 35, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, 7, 1, 12, 45, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2018, 7, 1, 12, 35, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2018, 7, 2, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17 * * 1-5", time.Date(2018, 7, 2, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, 7, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0,30 12 * * *", time.Date(2018, 7, 2, 12, 0, 0, 0, time.UTC)},
+		// Either day field matching will do when both are restricted: the 15th
+		// or a Wednesday.
+		{"0 0 15 * 3", time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseCommitSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if next := s.next(start); !next.Equal(tc.expected) {
+			t.Errorf("%q: expected %s, got %s", tc.spec, tc.expected, next)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// On systemd hosts, we tell systemd how we're getting on with sd_notify(3)'s
+// protocol: datagrams to $NOTIFY_SOCKET. Without a unit with Type=notify
+// there's no $NOTIFY_SOCKET, and these do nothing.
+
+// sdNotify sends state, e.g. "READY=1", to systemd if it's listening.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ means the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifySystemd is sdNotify for when failing to tell systemd something isn't
+// a reason to stop what we're doing, so it just logs the error.
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		logger.Warnf("Couldn't send %s to systemd: %v", state, err)
+	}
+}
+
+// sdNotifyStatus sets the status systemctl status shows.
+func sdNotifyStatus(format string, args ...interface{}) {
+	notifySystemd("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// sdWatchdogInterval returns how often systemd wants to hear we're alive,
+// which is half its WatchdogSec=, or 0 if it isn't watching us.
+func sdWatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// It's watching someone else.
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond / 2, nil
+}
+
+// runSdWatchdog pets systemd's watchdog every interval for as long as
+// alive says we're OK, until stop is closed. If we stop being alive, systemd
+// restarts us after WatchdogSec=.
+func runSdWatchdog(interval time.Duration, alive func() error, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := alive(); err != nil {
+			logger.Alertf("not petting systemd's watchdog: %v", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Warnf("Couldn't pet systemd's watchdog: %v", err)
+		}
+	}
+}
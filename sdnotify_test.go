@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify listens like systemd does for sd_notify messages, setting
+// NOTIFY_SOCKET to point at it until the returned func is called.
+func listenNotify(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// notifications returns the messages sent to conn until none arrive for
+// wait.
+func notifications(conn *net.UnixConn, wait time.Duration) []string {
+	var messages []string
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(buf[:n]))
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	conn, done := listenNotify(t)
+	defer done()
+
+	sdNotifyStatus("Seeding %s", "test")
+	notifySystemd("READY=1")
+
+	messages := notifications(conn, 100*time.Millisecond)
+	if len(messages) != 2 || messages[0] != "STATUS=Seeding test" || messages[1] != "READY=1" {
+		t.Errorf("wrong notifications: %q", messages)
+	}
+}
+
+func TestSdNotifyWithoutSystemd(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("expected nothing to happen without NOTIFY_SOCKET, got %v", err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		usec, pid string
+		expected  time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"120000000", "", time.Minute, false},
+		{"120000000", pid, time.Minute, false},
+		{"120000000", "1", 0, false},
+		{"soon", "", 0, true},
+		{"0", "", 0, true},
+	} {
+		os.Setenv("WATCHDOG_USEC", test.usec)
+		os.Setenv("WATCHDOG_PID", test.pid)
+		interval, err := sdWatchdogInterval()
+		if (err != nil) != test.err || interval != test.expected {
+			t.Errorf(
+				"WATCHDOG_USEC=%q WATCHDOG_PID=%q: expected %s (error %v), got %s, %v",
+				test.usec, test.pid, test.expected, test.err, interval, err,
+			)
+		}
+	}
+}
+
+func TestSdWatchdog(t *testing.T) {
+	conn, done := listenNotify(t)
+	defer done()
+
+	alive := make(chan error, 10)
+	alive <- nil
+	stop := make(chan struct{})
+	go runSdWatchdog(10*time.Millisecond, func() error {
+		select {
+		case err := <-alive:
+			return err
+		default:
+			return os.ErrNotExist
+		}
+	}, stop)
+	defer close(stop)
+
+	// Only pets while alive.
+	messages := notifications(conn, 100*time.Millisecond)
+	if len(messages) != 1 || messages[0] != "WATCHDOG=1" {
+		t.Errorf("expected one WATCHDOG=1, got %q", messages)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// seedDot pulls the dot at seed, e.g. dothub.com/justincormack/postgres, into
+// the local dot called dot, using credentials ("<API username>:<API key>") to
+// talk to the remote. It waits for the transfer to finish, giving up if it
+// makes no progress for stallTimeout.
+func seedDot(adminApiKey, dot, seed, credentials string, stallTimeout time.Duration) error {
+	return transferDot(adminApiKey, "pull", dot, seed, credentials, stallTimeout)
+}
+
+// pushDot pushes the local dot called dot to remote, which is given like a
+// seed. Otherwise it's like seedDot.
+func pushDot(adminApiKey, dot, remote, credentials string, stallTimeout time.Duration) error {
+	return transferDot(adminApiKey, "push", dot, remote, credentials, stallTimeout)
+}
+
+func transferDot(adminApiKey, direction, dot, remote, credentials string, stallTimeout time.Duration) error {
+	// XXX handle :s in the username
+	shrapnel := strings.Split(strings.TrimSpace(credentials), ":")
+	if len(shrapnel) != 2 {
+		return fmt.Errorf("credentials should be <API username>:<API key>")
+	}
+	username := shrapnel[0]
+	apiKey := shrapnel[1]
+	logger.with(logFields{"dot": dot}).Debugf("Transferring as %s", username)
+
+	// TODO interpret 'dothub.com/justincormack/postgres'
+	shrapnel = strings.Split(strings.TrimSpace(remote), "/")
+	if len(shrapnel) != 3 {
+		return fmt.Errorf(
+			"Need exactly two '/'s in -seed argument, " +
+				"e.g. 'dothub.com/justincormack/postgres'",
+		)
+	}
+	hostname := shrapnel[0]        // dothub.com
+	remoteNamespace := shrapnel[1] // e.g. justincormack
+	remoteName := shrapnel[2]      // e.g. postgres
+
+	var transferId string
+	err := doRPC(
+		dotmeshAddress, "admin", adminApiKey,
+		"DotmeshRPC.Transfer", TransferRequest{
+			Peer:             hostname,
+			User:             username,
+			ApiKey:           apiKey,
+			Direction:        direction,
+			LocalNamespace:   "admin",
+			LocalName:        dot,
+			LocalBranchName:  "",
+			RemoteNamespace:  remoteNamespace,
+			RemoteName:       remoteName,
+			RemoteBranchName: "",
+		}, &transferId)
+	if err != nil {
+		return err
+	}
+	if err := waitForTransfer(adminApiKey, dot, transferId, stallTimeout); err != nil {
+		return err
+	}
+	if direction == "pull" {
+		recordSuccess("seed", dot)
+	} else {
+		recordSuccess("push", dot)
+	}
+	return nil
+}
+
+// waitForTransfer polls the transfer until it's finished, logging progress.
+func waitForTransfer(adminApiKey, dot, transferId string, stallTimeout time.Duration) error {
+	transferLogger := logger.with(logFields{"dot": dot, "transferId": transferId})
+	started := false
+
+	// Track when the transfer last moved forwards, so we can give
+	// up on one that's stalled rather than hang the boot forever.
+	lastProgress := time.Now()
+	lastIndex, lastSent := 0, int64(0)
+	counted := transferProgress{}
+
+	for {
+		time.Sleep(time.Second)
+		result := &TransferPollResult{}
+
+		err := doRPC(
+			dotmeshAddress, "admin", adminApiKey,
+			"DotmeshRPC.GetTransfer", transferId, result,
+		)
+		if err != nil {
+			if !strings.Contains(fmt.Sprintf("%s", err), "No such intercluster transfer") {
+				transferLogger.Warnf("Got error, trying again: %s", err)
+			}
+		}
+
+		transferLogger.Debugf("Got DotmeshRPC.GetTransfer response: %+v", result)
+		if !started {
+			transferLogger.Infof("Starting transfer of %d bytes...", result.Size)
+			started = true
+		}
+		var speed string
+		if result.NanosecondsElapsed > 0 {
+			speed = fmt.Sprintf(" %.2f MiB/s",
+				// mib/sec
+				(float64(result.Sent)/(1024*1024))/
+					(float64(result.NanosecondsElapsed)/(1000*1000*1000)),
+			)
+		} else {
+			speed = " ? MiB/s"
+		}
+		quotient := fmt.Sprintf(" (%d/%d)", result.Index, result.Total)
+		transferLogger.Infof("%s%s%s", result.Status, speed, quotient)
+		sdNotifyStatus("Transferring %s: %s%s%s", dot, result.Status, speed, quotient)
+		recordTransferProgress(&counted, result)
+
+		if result.Index == result.Total && result.Status == "finished" {
+			if started {
+				transferLogger.Infof("Done!")
+			}
+			time.Sleep(time.Second)
+			return nil
+		}
+		if result.Status == "error" {
+			if started {
+				transferLogger.Errorf("error: %s", result.Message)
+			}
+			time.Sleep(time.Second)
+			return fmt.Errorf("%s", result.Message)
+		}
+
+		if result.Index != lastIndex || result.Sent != lastSent {
+			lastProgress = time.Now()
+			lastIndex, lastSent = result.Index, result.Sent
+		} else if time.Since(lastProgress) > stallTimeout {
+			return fmt.Errorf(
+				"transfer %s made no progress for %s, giving up",
+				transferId, stallTimeout,
+			)
+		}
+	}
+}
+
+// transferProgress is how much of a transfer's been counted in the metrics.
+type transferProgress struct {
+	index int
+	sent  int64
+}
+
+// recordTransferProgress counts what's been sent since the last poll. Sent
+// is per segment, so starts again from 0 when Index moves on.
+func recordTransferProgress(counted *transferProgress, result *TransferPollResult) {
+	if result.Index != counted.index {
+		counted.index, counted.sent = result.Index, 0
+	}
+	if result.Sent > counted.sent {
+		metrics.add("dm_linuxkit_transfer_bytes_total", "", float64(result.Sent-counted.sent))
+		counted.sent = result.Sent
+	}
+	if result.NanosecondsElapsed > 0 {
+		metrics.set(
+			"dm_linuxkit_transfer_throughput_bytes_per_second", "",
+			float64(result.Sent)/(float64(result.NanosecondsElapsed)/1e9),
+		)
+	}
+}
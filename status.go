@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusReport is what `dm-linuxkit status` reports, and its --json output.
+// Each part has an Error rather than failing the whole report, since status
+// is most useful when something's wrong.
+type statusReport struct {
+	Pool    poolStatus      `json:"pool"`
+	Etcd    etcdStatus      `json:"etcd"`
+	Dotmesh dotmeshStatus   `json:"dotmesh"`
+	Daemon  daemonRunStatus `json:"daemon"`
+	Dots    []dotStatus     `json:"dots"`
+}
+
+type poolStatus struct {
+	Name      string `json:"name"`
+	Id        string `json:"id,omitempty"` // GUID, as dotmesh formats it
+	Health    string `json:"health,omitempty"`
+	Size      uint64 `json:"size"`
+	Allocated uint64 `json:"allocated"`
+	Free      uint64 `json:"free"`
+	Capacity  int    `json:"capacity"` // percent used
+	Error     string `json:"error,omitempty"`
+}
+
+type etcdStatus struct {
+	Endpoint    string `json:"endpoint"`
+	Healthy     bool   `json:"healthy"`
+	Error       string `json:"error,omitempty"`
+	Dataset     string `json:"dataset"`
+	Used        uint64 `json:"used"`
+	Available   uint64 `json:"available"`
+	Reservation string `json:"reservation,omitempty"` // bytes, or "none"
+	Quota       string `json:"quota,omitempty"`
+	UsageError  string `json:"usageError,omitempty"`
+}
+
+type dotmeshStatus struct {
+	Address     string  `json:"address"`
+	Up          bool    `json:"up"`
+	Version     string  `json:"version,omitempty"`
+	PingSeconds float64 `json:"pingSeconds,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type daemonRunStatus struct {
+	Running bool       `json:"running"`
+	Pid     int        `json:"pid,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+}
+
+type dotStatus struct {
+	Name             string          `json:"name"`
+	Id               string          `json:"id,omitempty"`
+	Branch           string          `json:"branch,omitempty"`
+	LatestCommit     string          `json:"latestCommit,omitempty"`
+	LatestCommitTime *time.Time      `json:"latestCommitTime,omitempty"`
+	Dirty            bool            `json:"dirty"`
+	DirtyBytes       int64           `json:"dirtyBytes"`
+	Used             uint64          `json:"used"`
+	Available        uint64          `json:"available"`
+	Quota            string          `json:"quota,omitempty"` // bytes, or "none"
+	Refquota         string          `json:"refquota,omitempty"`
+	Mountpoint       string          `json:"mountpoint,omitempty"`
+	Mounted          bool            `json:"mounted"`
+	ReadOnly         bool            `json:"readOnly,omitempty"`
+	CommitSchedule   *scheduleStatus `json:"commitSchedule,omitempty"`
+	Error            string          `json:"error,omitempty"`
+}
+
+// scheduleStatus is how the daemon's scheduled commits of a dot are going.
+type scheduleStatus struct {
+	Schedule       string     `json:"schedule"`
+	Next           *time.Time `json:"next,omitempty"`
+	LastCommit     string     `json:"lastCommit,omitempty"`
+	LastCommitTime *time.Time `json:"lastCommitTime,omitempty"`
+	LastChecked    *time.Time `json:"lastChecked,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+func newScheduleStatus(s DaemonSchedule) *scheduleStatus {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return &scheduleStatus{
+		Schedule:       s.Schedule,
+		Next:           optional(s.Next),
+		LastCommit:     s.LastCommit,
+		LastCommitTime: optional(s.LastCommitTime),
+		LastChecked:    optional(s.LastChecked),
+		LastError:      s.LastError,
+	}
+}
+
+// The parts of dotmesh's API responses we use.
+
+type dotmeshVersionInfo struct {
+	InstalledVersion string
+}
+
+type dotmeshVolume struct {
+	Id          string
+	Branch      string
+	SizeBytes   int64
+	DirtyBytes  int64
+	CommitCount int64
+}
+
+type dotmeshCommit struct {
+	Id       string
+	Metadata map[string]string
+}
+
+func statusCommand(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	mountOpts := addMountFlags(flags)
+	flagPidFile := flags.String("pid-file", PID_FILE, "Where a running up daemon writes its pid")
+	flagControlSocket := addControlSocketFlag(flags)
+	flagJSON := flags.Bool("json", false, "Report as JSON")
+	flags.Parse(args)
+	md, cfg, err := common.load()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Most of the report doesn't need the key, so carry on without it.
+	adminApiKey, _ := common.adminApiKey(md)
+	report := gatherStatus(
+		newExecZFS(), newExecRunner(), *common.pool, adminApiKey,
+		*flagControlSocket, *flagPidFile, mountOpts.configured(cfg),
+	)
+	if *flagJSON {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		fmt.Printf("%s\n", out)
+		return
+	}
+	report.print()
+}
+
+// gatherStatus asks the pool, etcd, dotmesh and the daemon how they are. The
+// dots it reports on are those the daemon has mounted, including those it was
+// configured with, or if it's not running, those configured.
+func gatherStatus(
+	zfs ZFS, runner Runner, pool, adminApiKey, socket, pidFile string,
+	configured []DaemonMount,
+) statusReport {
+	report := statusReport{
+		Pool:    poolStatus{Name: pool},
+		Etcd:    etcdStatus{Endpoint: ETCD_ENDPOINT, Dataset: pool + "/dotmesh-etcd"},
+		Dotmesh: dotmeshStatus{Address: dotmeshAddress},
+	}
+
+	info, err := zfs.Pool(pool)
+	if err != nil {
+		report.Pool.Error = err.Error()
+	} else {
+		report.Pool.Id = info.Id()
+		report.Pool.Health = info.Health
+		report.Pool.Size = info.Size
+		report.Pool.Allocated = info.Allocated
+		report.Pool.Free = info.Free
+		report.Pool.Capacity = info.Capacity
+	}
+
+	if _, err := runEtcdctl(runner, "--endpoints", ETCD_ENDPOINT, "endpoint", "health"); err != nil {
+		report.Etcd.Error = err.Error()
+	} else {
+		report.Etcd.Healthy = true
+	}
+	if usage, err := datasetUsage(zfs, report.Etcd.Dataset); err != nil {
+		report.Etcd.UsageError = err.Error()
+	} else {
+		report.Etcd.Used = usage.Used
+		report.Etcd.Available = usage.Available
+		report.Etcd.Reservation = usage.Reservation
+		report.Etcd.Quota = usage.Quota
+	}
+
+	var pong bool
+	pinged := time.Now()
+	err = doRPC(dotmeshAddress, "admin", adminApiKey, "DotmeshRPC.Ping", nil, &pong)
+	if err != nil {
+		report.Dotmesh.Error = err.Error()
+	} else {
+		report.Dotmesh.Up = true
+		report.Dotmesh.PingSeconds = time.Since(pinged).Seconds()
+		var version dotmeshVersionInfo
+		err = doRPC(dotmeshAddress, "admin", adminApiKey, "DotmeshRPC.Version", struct{}{}, &version)
+		if err != nil {
+			report.Dotmesh.Error = err.Error()
+		}
+		report.Dotmesh.Version = version.InstalledVersion
+	}
+
+	mounts := configured
+	var schedules []DaemonSchedule
+	if daemon := dialDaemon(socket); daemon != nil {
+		var status DaemonStatus
+		if err := daemon.call("Status", struct{}{}, &status); err == nil {
+			report.Daemon = daemonRunStatus{Running: true, Pid: status.Pid, Started: &status.Started}
+			mounts = status.Mounts
+			schedules = status.Schedules
+		}
+	}
+	if !report.Daemon.Running {
+		if pid, err := readPidFile(pidFile); err == nil && processRunning(pid) {
+			report.Daemon = daemonRunStatus{Running: true, Pid: pid}
+		}
+	}
+
+	for _, m := range mounts {
+		report.Dots = append(report.Dots, dotStatusOf(zfs, pool, adminApiKey, m, report.Dotmesh.Up))
+	}
+	for _, s := range schedules {
+		found := false
+		// Until now, report.Dots has been mounts', in the same order.
+		for i, m := range mounts {
+			if newScheduleKey(m.Dot, m.Branch) == newScheduleKey(s.Dot, s.Branch) {
+				report.Dots[i].CommitSchedule = newScheduleStatus(s)
+				found = true
+			}
+		}
+		if !found {
+			// Not mounted, at least not by the daemon.
+			status := dotStatusOf(zfs, pool, adminApiKey, DaemonMount{Dot: s.Dot, Branch: s.Branch}, report.Dotmesh.Up)
+			status.CommitSchedule = newScheduleStatus(s)
+			report.Dots = append(report.Dots, status)
+		}
+	}
+	sort.Slice(report.Dots, func(i, j int) bool {
+		return report.Dots[i].Mountpoint < report.Dots[j].Mountpoint
+	})
+	return report
+}
+
+// dotStatusOf reports on the dot m says is mounted, asking dotmesh about it
+// if it's up, and ZFS how much space it's using if we know its ID.
+func dotStatusOf(zfs ZFS, pool, adminApiKey string, m DaemonMount, dotmeshUp bool) dotStatus {
+	status := dotStatus{
+		Name:       m.Dot,
+		Id:         m.Id,
+		Mountpoint: m.Mountpoint,
+		ReadOnly:   m.ReadOnly,
+	}
+	if m.Mountpoint != "" {
+		mounted, err := filesystemMounted(m.Mountpoint)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		status.Mounted = mounted
+	}
+	if dotmeshUp {
+		if err := dotmeshStatusOf(adminApiKey, m.Dot, m.Branch, &status); err != nil {
+			status.Error = err.Error()
+		}
+	}
+	if status.Id != "" {
+		usage, err := datasetUsage(zfs, calculateDataset(pool, status.Id))
+		if err != nil && status.Error == "" {
+			status.Error = err.Error()
+		}
+		status.Used = usage.Used
+		status.Available = usage.Available
+		status.Quota = usage.Quota
+		status.Refquota = usage.Refquota
+	}
+	return status
+}
+
+// dotmeshStatusOf fills in what dotmesh knows about branch of dot in status.
+func dotmeshStatusOf(adminApiKey, dot, branch string, status *dotStatus) error {
+	if status.Id == "" {
+		id, err := lookupDot(adminApiKey, dot, branch)
+		if err != nil {
+			return err
+		}
+		status.Id = id
+	}
+	var volume dotmeshVolume
+	err := doRPC(dotmeshAddress, "admin", adminApiKey, "DotmeshRPC.Get", status.Id, &volume)
+	if err != nil {
+		return err
+	}
+	status.Branch = volume.Branch
+	if status.Branch == "" {
+		status.Branch = "master"
+	}
+	status.DirtyBytes = volume.DirtyBytes
+	status.Dirty = volume.DirtyBytes > 0
+
+	commits, err := dotCommits(adminApiKey, dot, volume.Branch)
+	if err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		latest := commits[len(commits)-1]
+		status.LatestCommit = latest.Id
+		if t, ok := commitTime(latest); ok {
+			status.LatestCommitTime = &t
+		}
+	}
+	return nil
+}
+
+// commitTime is when c was made, from its metadata, which dotmesh records as
+// nanoseconds since the epoch and commitDot as RFC 3339.
+func commitTime(c dotmeshCommit) (time.Time, bool) {
+	timestamp := c.Metadata["timestamp"]
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, true
+	}
+	if ns, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(0, ns).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+func (r statusReport) print() {
+	if r.Pool.Error != "" {
+		fmt.Printf("pool %s: %s\n", r.Pool.Name, r.Pool.Error)
+	} else {
+		fmt.Printf(
+			"pool %s (guid %s): %s, %d/%d bytes used (%d%%)\n",
+			r.Pool.Name, r.Pool.Id, r.Pool.Health, r.Pool.Allocated, r.Pool.Size,
+			r.Pool.Capacity,
+		)
+	}
+
+	etcd := "healthy"
+	if !r.Etcd.Healthy {
+		etcd = fmt.Sprintf("unhealthy (%s)", r.Etcd.Error)
+	}
+	if r.Etcd.UsageError != "" {
+		etcd += fmt.Sprintf(", %s: %s", r.Etcd.Dataset, r.Etcd.UsageError)
+	} else {
+		etcd += fmt.Sprintf(
+			", %s %d bytes used, %d available, reservation %s, quota %s",
+			r.Etcd.Dataset, r.Etcd.Used, r.Etcd.Available, r.Etcd.Reservation,
+			r.Etcd.Quota,
+		)
+	}
+	fmt.Printf("etcd at %s: %s\n", r.Etcd.Endpoint, etcd)
+
+	if r.Dotmesh.Up {
+		fmt.Printf(
+			"dotmesh at %s: up, version %s, ping %s\n",
+			r.Dotmesh.Address, r.Dotmesh.Version,
+			time.Duration(r.Dotmesh.PingSeconds*float64(time.Second)),
+		)
+	} else {
+		fmt.Printf("dotmesh at %s: down (%s)\n", r.Dotmesh.Address, r.Dotmesh.Error)
+	}
+
+	switch {
+	case !r.Daemon.Running:
+		fmt.Printf("daemon: not running\n")
+	case r.Daemon.Started != nil:
+		fmt.Printf(
+			"daemon: running, pid %d, up since %s\n",
+			r.Daemon.Pid, r.Daemon.Started.Format(time.RFC3339),
+		)
+	default:
+		fmt.Printf("daemon: running, pid %d\n", r.Daemon.Pid)
+	}
+
+	for _, d := range r.Dots {
+		var parts []string
+		if d.Id != "" {
+			commit := d.LatestCommit
+			if commit == "" {
+				commit = "none"
+			}
+			state := "clean"
+			if d.Dirty {
+				state = fmt.Sprintf("dirty (%d bytes)", d.DirtyBytes)
+			}
+			if d.LatestCommitTime != nil {
+				commit += " at " + d.LatestCommitTime.Format(time.RFC3339)
+			}
+			parts = append(parts,
+				"id "+d.Id, "branch "+d.Branch, "latest commit "+commit, state,
+				fmt.Sprintf(
+					"%d bytes used, %d available, quota %s, refquota %s",
+					d.Used, d.Available, d.Quota, d.Refquota,
+				),
+			)
+		}
+		if d.Mountpoint != "" {
+			mode := "read-write"
+			if d.ReadOnly {
+				mode = "read-only"
+			}
+			if d.Mounted {
+				parts = append(parts, "mounted "+mode+" at "+d.Mountpoint)
+			} else {
+				parts = append(parts, "NOT mounted at "+d.Mountpoint)
+			}
+		}
+		if s := d.CommitSchedule; s != nil {
+			schedule := "committing on schedule " + s.Schedule
+			if s.LastCommitTime != nil {
+				schedule += fmt.Sprintf(
+					" (last %s at %s)", s.LastCommit, s.LastCommitTime.Format(time.RFC3339),
+				)
+			}
+			if s.Next != nil {
+				schedule += ", next at " + s.Next.Format(time.RFC3339)
+			}
+			if s.LastError != "" {
+				schedule += ", last try failed: " + s.LastError
+			}
+			parts = append(parts, schedule)
+		}
+		if d.Error != "" {
+			parts = append(parts, "error: "+d.Error)
+		}
+		fmt.Printf("dot %s: %s\n", d.Name, strings.Join(parts, ", "))
+	}
+}
@@ -1,104 +1,243 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
-	"syscall"
 	"time"
+
+	"dm-linuxkit/mount"
 )
 
-const ZPOOL = "zpool"
-const ZFS = "zfs"
-const MOUNT_ZFS = "mount.zfs"
-const MOUNT = "mount"
+const ZPOOL_BIN = "zpool"
+const ZFS_BIN = "zfs"
+
+// errNoSuchPool is returned by ZFS.Pool when the pool doesn't exist (as
+// opposed to when we couldn't find out).
+var errNoSuchPool = errors.New("no such pool")
+
+// ZFS is the set of zpool and zfs operations dm-linuxkit uses. execZFS is the
+// real implementation; tests use an in-memory fake so that the bootstrap logic
+// can be tested without a kernel module.
+type ZFS interface {
+	// Pool returns the zpool list line for pool, or errNoSuchPool if the pool
+	// doesn't exist.
+	Pool(pool string) (PoolInfo, error)
+	// PoolStatus returns the zpool status of pool.
+	PoolStatus(pool string) (PoolStatus, error)
+	// PoolProperties returns the named properties of pool.
+	PoolProperties(pool string, names ...string) ([]Property, error)
+	// CreatePool creates pool on devices.
+	CreatePool(pool string, devices []string) error
+	// Scrub starts a scrub of pool, returning once it's started.
+	Scrub(pool string) error
+	// ExpandVdev grows vdev to use all the space on its device.
+	ExpandVdev(pool, vdev string) error
+	// AddDevices adds devices to pool as new top-level vdevs.
+	AddDevices(pool string, devices []string) error
+	// Datasets returns root and every dataset beneath it.
+	Datasets(root string) ([]DatasetInfo, error)
+	// DatasetProperties returns the named properties of dataset.
+	DatasetProperties(dataset string, names ...string) ([]Property, error)
+	// SetProperty sets a property of dataset.
+	SetProperty(dataset, name, value string) error
+	// Snapshot takes a snapshot of dataset called dataset@name.
+	Snapshot(dataset, name string) error
+	// FilesystemExists reports whether pool/filesystem exists.
+	FilesystemExists(pool, filesystem string) (bool, error)
+	// CreateFilesystem creates pool/filesystem with mountpoint=legacy.
+	CreateFilesystem(pool, filesystem string) error
+}
+
+// execZFS implements ZFS by running the zpool and zfs binaries.
+type execZFS struct {
+	runner Runner
+}
+
+func newExecZFS() ZFS {
+	return execZFS{runner: newExecRunner()}
+}
+
+// mounter does all our mounting. Tests can replace it with a mount.Fake.
+var mounter mount.Mounter = mount.New()
+
+// mountPropagation is applied to every mount we make, so that mounts made
+// inside the dm-linuxkit container show up on the host. It should match the
+// rootfsPropagation the container is run with (see dotmesh.yml).
+var mountPropagation = mount.RShared
 
 // TODO dedupe wrt dotmesh's zfs.go
-func findLocalPoolId(pool string) (string, error) {
-	output, err := exec.Command(ZPOOL, "get", "-H", "guid", pool).CombinedOutput()
+func (z execZFS) Pool(pool string) (PoolInfo, error) {
+	result, err := z.runner.Run(
+		context.Background(), ZPOOL_BIN,
+		"list", "-H", "-p", "-o", strings.Join(POOL_LIST_FIELDS, ","), pool,
+	)
 	if err != nil {
-		return string(output), err
+		return PoolInfo{}, err
 	}
-	i, err := strconv.ParseUint(strings.Split(string(output), "\t")[2], 10, 64)
+	if result.ExitCode != 0 {
+		if strings.Contains(result.Stderr, "no such pool") {
+			return PoolInfo{}, errNoSuchPool
+		}
+		return PoolInfo{}, &CommandFailedError{Command: "zpool list", Result: result}
+	}
+	pools, err := parsePoolList(result.Stdout)
 	if err != nil {
-		return string(output), err
+		return PoolInfo{}, fmt.Errorf("can't parse zpool list output: %v", err)
+	}
+	if len(pools) != 1 {
+		return PoolInfo{}, fmt.Errorf("expected zpool list to return 1 pool, got %d", len(pools))
 	}
-	return fmt.Sprintf("%x", i), nil
+	return pools[0], nil
 }
 
-func calculateMountpoint(pool, fs string) string {
-	// See main.go's env vars for how this is calculated
-	// (MOUNT_PREFIX + "/dmfs")
-	return "/var/dotmesh/mnt/dmfs/" + fs
+func (z execZFS) PoolStatus(pool string) (PoolStatus, error) {
+	// No -p, which ZFS before 0.8 doesn't have; parseErrorCount copes with
+	// the abbreviated error counts instead.
+	result, err := runChecked(z.runner, ZPOOL_BIN, "status", pool)
+	if err != nil {
+		return PoolStatus{}, err
+	}
+	statuses, err := parsePoolStatus(result.Stdout)
+	if err != nil {
+		return PoolStatus{}, fmt.Errorf("can't parse zpool status output: %v", err)
+	}
+	if len(statuses) != 1 {
+		return PoolStatus{}, fmt.Errorf("expected zpool status to return 1 pool, got %d", len(statuses))
+	}
+	return statuses[0], nil
 }
 
-func filesystemMounted(path string) (bool, error) {
-	// is filesystem mounted?
-	code, err := returnCode(
-		"mountpoint",
-		path,
+func (z execZFS) PoolProperties(pool string, names ...string) ([]Property, error) {
+	result, err := runChecked(
+		z.runner, ZPOOL_BIN, "get", "-H", "-p", strings.Join(names, ","), pool,
 	)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	properties, err := parseProperties(result.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse zpool get output: %v", err)
+	}
+	return properties, nil
+}
+
+func (z execZFS) Scrub(pool string) error {
+	_, err := runChecked(z.runner, ZPOOL_BIN, "scrub", pool)
+	return err
+}
+
+func (z execZFS) ExpandVdev(pool, vdev string) error {
+	_, err := runChecked(z.runner, ZPOOL_BIN, "online", "-e", pool, vdev)
+	return err
+}
+
+func (z execZFS) AddDevices(pool string, devices []string) error {
+	// No -f: zpool refuses devices which look like they're in use (e.g. have
+	// a filesystem or another pool on them) or don't match the pool's
+	// redundancy, and we'd rather not boot than overwrite them.
+	args := []string{"add", pool}
+	args = append(args, devices...)
+	_, err := runChecked(z.runner, ZPOOL_BIN, args...)
+	return err
+}
+
+func (z execZFS) Datasets(root string) ([]DatasetInfo, error) {
+	result, err := runChecked(
+		z.runner, ZFS_BIN,
+		"list", "-H", "-p", "-r", "-t", "filesystem",
+		"-o", strings.Join(DATASET_LIST_FIELDS, ","), root,
+	)
+	if err != nil {
+		return nil, err
+	}
+	datasets, err := parseDatasetList(result.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse zfs list output: %v", err)
+	}
+	return datasets, nil
+}
+
+func (z execZFS) DatasetProperties(dataset string, names ...string) ([]Property, error) {
+	result, err := runChecked(
+		z.runner, ZFS_BIN,
+		"get", "-H", "-p", "-o", "name,property,value,source",
+		strings.Join(names, ","), dataset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	properties, err := parseProperties(result.Stdout)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse zfs get output: %v", err)
 	}
-	mounted := code == 0
-	return mounted, nil
+	return properties, nil
 }
 
-func filesystemExists(pool, filesystem string) (bool, error) {
-	cmd := exec.Command(ZFS, "list", pool+"/"+filesystem)
-	if err := cmd.Start(); err != nil {
+func (z execZFS) SetProperty(dataset, name, value string) error {
+	_, err := runChecked(z.runner, ZFS_BIN, "set", name+"="+value, dataset)
+	return err
+}
+
+func (z execZFS) Snapshot(dataset, name string) error {
+	_, err := runChecked(z.runner, ZFS_BIN, "snapshot", dataset+"@"+name)
+	return err
+}
+
+func (z execZFS) FilesystemExists(pool, filesystem string) (bool, error) {
+	result, err := z.runner.Run(context.Background(), ZFS_BIN, "list", "-H", pool+"/"+filesystem)
+	if err != nil {
 		return false, err
 	}
-	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				return status.ExitStatus() == 0, nil
-			}
-		} else {
-			return false, err
-		}
+	if result.ExitCode == 0 {
+		return true, nil
 	}
-	// No error, filesystem exists
-	return true, nil
+	if strings.Contains(result.Stderr, "does not exist") {
+		return false, nil
+	}
+	// Anything else (permission denied, no ZFS kernel module...) means we
+	// don't know whether it exists.
+	return false, &CommandFailedError{Command: "zfs list", Result: result}
 }
 
-func createPool(pool string, devices []string) error {
+func (z execZFS) CreatePool(pool string, devices []string) error {
 	// create the pool
 	args := []string{"create", "-f", pool}
 	args = append(args, devices...)
-	cmd := exec.Command(ZPOOL, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("zpool create failed (%v): %s", err, output)
-	}
-	return nil
+	_, err := runChecked(z.runner, ZPOOL_BIN, args...)
+	return err
 }
 
-func createFilesystem(pool, filesystem string) error {
+func (z execZFS) CreateFilesystem(pool, filesystem string) error {
 	// TODO: there's no automounter in LinuxKit, so we probably want to use
 	// mountpoint=legacy and just call mount.zfs
 	args := []string{"create", "-o", "mountpoint=legacy", pool + "/" + filesystem}
-	cmd := exec.Command(ZFS, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("zfs create failed (%v): %s", err, output)
-	}
-	return nil
+	_, err := runChecked(z.runner, ZFS_BIN, args...)
+	return err
+}
+
+func calculateMountpoint(pool, fs string) string {
+	// See main.go's env vars for how this is calculated
+	// (MOUNT_PREFIX + "/dmfs")
+	return "/var/dotmesh/mnt/dmfs/" + fs
+}
+
+func filesystemMounted(path string) (bool, error) {
+	// is filesystem mounted?
+	return mounter.Mounted(path)
 }
 
 func makeDirectoryIfNotExists(directory string) error {
 	if _, err := os.Stat(directory); err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(directory, 0700); err != nil {
-				log.Printf("[makeDirectoryIfNotExists] error creating %s: %+v", directory, err)
+				logger.Errorf("[makeDirectoryIfNotExists] error creating %s: %+v", directory, err)
 				return err
 			}
 		} else {
-			log.Printf("[makeDirectoryIfNotExists] error statting %s: %+v", directory, err)
+			logger.Errorf("[makeDirectoryIfNotExists] error statting %s: %+v", directory, err)
 			return err
 		}
 	}
@@ -110,13 +249,9 @@ func mountFilesystem(pool, filesystem, mountpoint string) error {
 	if err != nil {
 		return err
 	}
-	args := []string{pool + "/" + filesystem, mountpoint}
-	cmd := exec.Command(MOUNT_ZFS, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mount.zfs failed (%v): %s", err, output)
-	}
-	return nil
+	return mounter.MountZFS(pool+"/"+filesystem, mountpoint, mount.Options{
+		Propagation: mountPropagation,
+	})
 }
 
 func bindMountFilesystem(from, to string) error {
@@ -124,39 +259,28 @@ func bindMountFilesystem(from, to string) error {
 	if err != nil {
 		return err
 	}
-	args := []string{"--bind", from, to}
-	cmd := exec.Command(MOUNT, args...)
-	output, err := cmd.CombinedOutput()
+	return mounter.Bind(from, to, mount.Options{
+		Propagation: mountPropagation,
+	})
+}
+
+// bindMountFilesystemReadOnly bind mounts from onto to with MS_RDONLY.
+func bindMountFilesystemReadOnly(from, to string) error {
+	err := makeDirectoryIfNotExists(to)
 	if err != nil {
-		return fmt.Errorf("mount (bind) failed (%v): %s", err, output)
+		return err
 	}
-	return nil
+	return mounter.Bind(from, to, mount.Options{
+		ReadOnly:    true,
+		Propagation: mountPropagation,
+	})
 }
 
-func returnCode(name string, arg ...string) (int, error) {
-	// Run a command and either get the returncode or an error if the command
-	// failed to execute, based on
-	// http://stackoverflow.com/questions/10385551/get-exit-code-go
-	cmd := exec.Command(name, arg...)
-	if err := cmd.Start(); err != nil {
-		return -1, err
-	}
-	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			// The program has exited with an exit code != 0
-			// This works on both Unix and Windows. Although package
-			// syscall is generally platform dependent, WaitStatus is
-			// defined for both Unix and Windows and in both cases has
-			// an ExitStatus() method with the same signature.
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				return status.ExitStatus(), nil
-			}
-		} else {
-			return -1, err
-		}
-	}
-	// got here, so err == nil
-	return 0, nil
+// calculateSnapshotMountpoint returns where the given commit of a dot, whose
+// filesystem is mounted at dotMountpoint, can be found read-only, via the
+// .zfs/snapshot directory. dotmesh names the ZFS snapshot after the commit ID.
+func calculateSnapshotMountpoint(dotMountpoint, commit string) string {
+	return dotMountpoint + "/.zfs/snapshot/" + commit
 }
 
 func tryUntilSucceedsN(f func() error, desc string, retries int) error {
@@ -167,7 +291,7 @@ func tryUntilSucceedsN(f func() error, desc string, retries int) error {
 			if attempt > retries {
 				return err
 			} else {
-				fmt.Printf("Error %s: %v, pausing and trying again...\n", desc, err)
+				logger.Warnf("Error %s: %v, pausing and trying again...", desc, err)
 				time.Sleep(time.Duration(attempt) * time.Second)
 			}
 		} else {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fakeZFS is an in-memory ZFS for tests. Pools and filesystems only exist in
+// its maps, and errors can be injected per operation.
+type fakeZFS struct {
+	mu          sync.Mutex
+	pools       map[string][]string          // pool -> devices
+	filesystems map[string]bool              // "pool/filesystem"
+	health      map[string]string            // pool -> health, ONLINE if unset
+	scan        map[string]string            // pool -> zpool status scan line
+	expandSize  map[string]uint64            // pool -> bytes its devices have grown by
+	grown       map[string]uint64            // pool -> bytes it's been expanded by
+	properties  map[string]map[string]string // dataset -> property -> value
+	calls       []string
+
+	// errors maps an operation name (e.g. "CreatePool") to the error it should
+	// return. Injected errors stick until removed.
+	errors map[string]error
+}
+
+func newFakeZFS() *fakeZFS {
+	return &fakeZFS{
+		pools:       map[string][]string{},
+		filesystems: map[string]bool{},
+		health:      map[string]string{},
+		scan:        map[string]string{},
+		expandSize:  map[string]uint64{},
+		grown:       map[string]uint64{},
+		properties:  map[string]map[string]string{},
+		errors:      map[string]error{},
+	}
+}
+
+// record notes a call and returns any error injected for it.
+func (f *fakeZFS) record(op string, args ...string) error {
+	f.calls = append(f.calls, strings.TrimSpace(op+" "+strings.Join(args, " ")))
+	return f.errors[op]
+}
+
+// FAKE_POOL_SIZE is how big each device of a fake pool claims to be.
+const FAKE_POOL_SIZE = 1 << 30
+
+func (f *fakeZFS) poolInfo(pool string) PoolInfo {
+	health := f.health[pool]
+	if health == "" {
+		health = "ONLINE"
+	}
+	size := uint64(FAKE_POOL_SIZE*len(f.pools[pool])) + f.grown[pool]
+	return PoolInfo{
+		Name:          pool,
+		Size:          size,
+		Free:          size,
+		Fragmentation: 0,
+		Capacity:      0,
+		Health:        health,
+		GUID:          uint64(len(pool)),
+	}
+}
+
+func (f *fakeZFS) Pool(pool string) (PoolInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("Pool", pool); err != nil {
+		return PoolInfo{}, err
+	}
+	if _, ok := f.pools[pool]; !ok {
+		return PoolInfo{}, errNoSuchPool
+	}
+	return f.poolInfo(pool), nil
+}
+
+func (f *fakeZFS) PoolStatus(pool string) (PoolStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("PoolStatus", pool); err != nil {
+		return PoolStatus{}, err
+	}
+	devices, ok := f.pools[pool]
+	if !ok {
+		return PoolStatus{}, fmt.Errorf("cannot open '%s': no such pool", pool)
+	}
+	info := f.poolInfo(pool)
+	status := PoolStatus{
+		Name:   pool,
+		State:  info.Health,
+		Scan:   f.scan[pool],
+		Errors: "No known data errors",
+		Config: []VdevStatus{{Name: pool, State: info.Health}},
+	}
+	for _, d := range devices {
+		status.Config = append(status.Config, VdevStatus{Name: d, Depth: 1, State: info.Health})
+	}
+	return status, nil
+}
+
+func (f *fakeZFS) PoolProperties(pool string, names ...string) ([]Property, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("PoolProperties", append([]string{pool}, names...)...); err != nil {
+		return nil, err
+	}
+	if _, ok := f.pools[pool]; !ok {
+		return nil, fmt.Errorf("cannot open '%s': no such pool", pool)
+	}
+	var properties []Property
+	for _, name := range names {
+		value := "-"
+		if name == "expandsize" && f.expandSize[pool] > 0 {
+			value = fmt.Sprintf("%d", f.expandSize[pool])
+		}
+		properties = append(properties, Property{Name: pool, Property: name, Value: value, Source: "-"})
+	}
+	return properties, nil
+}
+
+func (f *fakeZFS) CreatePool(pool string, devices []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("CreatePool", append([]string{pool}, devices...)...); err != nil {
+		return err
+	}
+	if _, ok := f.pools[pool]; ok {
+		return fmt.Errorf("zpool create failed: pool '%s' already exists", pool)
+	}
+	f.pools[pool] = devices
+	return nil
+}
+
+func (f *fakeZFS) Scrub(pool string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("Scrub", pool); err != nil {
+		return err
+	}
+	if _, ok := f.pools[pool]; !ok {
+		return fmt.Errorf("cannot open '%s': no such pool", pool)
+	}
+	f.scan[pool] = "scrub in progress since Sun Jul  1 00:00:01 2018"
+	return nil
+}
+
+func (f *fakeZFS) ExpandVdev(pool, vdev string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("ExpandVdev", pool, vdev); err != nil {
+		return err
+	}
+	f.grown[pool] += f.expandSize[pool]
+	f.expandSize[pool] = 0
+	return nil
+}
+
+func (f *fakeZFS) AddDevices(pool string, devices []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("AddDevices", append([]string{pool}, devices...)...); err != nil {
+		return err
+	}
+	if _, ok := f.pools[pool]; !ok {
+		return fmt.Errorf("cannot open '%s': no such pool", pool)
+	}
+	f.pools[pool] = append(f.pools[pool], devices...)
+	return nil
+}
+
+func (f *fakeZFS) Datasets(root string) ([]DatasetInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("Datasets", root); err != nil {
+		return nil, err
+	}
+	var datasets []DatasetInfo
+	if _, ok := f.pools[root]; ok {
+		datasets = append(datasets, DatasetInfo{Name: root, Available: FAKE_POOL_SIZE})
+	}
+	for name := range f.filesystems {
+		if name == root || strings.HasPrefix(name, root+"/") {
+			datasets = append(datasets, DatasetInfo{
+				Name: name, Available: FAKE_POOL_SIZE, Mountpoint: "legacy",
+			})
+		}
+	}
+	if len(datasets) == 0 {
+		return nil, fmt.Errorf("cannot open '%s': dataset does not exist", root)
+	}
+	return datasets, nil
+}
+
+func (f *fakeZFS) DatasetProperties(dataset string, names ...string) ([]Property, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("DatasetProperties", append([]string{dataset}, names...)...); err != nil {
+		return nil, err
+	}
+	if !f.filesystems[dataset] {
+		return nil, fmt.Errorf("cannot open '%s': dataset does not exist", dataset)
+	}
+	var properties []Property
+	for _, name := range names {
+		value, source := f.properties[dataset][name], "local"
+		if value == "" {
+			value, source = "-", "-"
+		}
+		properties = append(properties, Property{Name: dataset, Property: name, Value: value, Source: source})
+	}
+	return properties, nil
+}
+
+func (f *fakeZFS) Snapshot(dataset, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("Snapshot", dataset+"@"+name); err != nil {
+		return err
+	}
+	if !f.filesystems[dataset] {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", dataset)
+	}
+	return nil
+}
+
+func (f *fakeZFS) SetProperty(dataset, name, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("SetProperty", dataset, name+"="+value); err != nil {
+		return err
+	}
+	if !f.filesystems[dataset] {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", dataset)
+	}
+	if f.properties[dataset] == nil {
+		f.properties[dataset] = map[string]string{}
+	}
+	f.properties[dataset][name] = value
+	return nil
+}
+
+func (f *fakeZFS) FilesystemExists(pool, filesystem string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("FilesystemExists", pool+"/"+filesystem); err != nil {
+		return false, err
+	}
+	return f.filesystems[pool+"/"+filesystem], nil
+}
+
+func (f *fakeZFS) CreateFilesystem(pool, filesystem string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("CreateFilesystem", pool+"/"+filesystem); err != nil {
+		return err
+	}
+	if _, ok := f.pools[pool]; !ok {
+		return fmt.Errorf("zfs create failed: no such pool '%s'", pool)
+	}
+	if f.filesystems[pool+"/"+filesystem] {
+		return fmt.Errorf("zfs create failed: '%s/%s' already exists", pool, filesystem)
+	}
+	f.filesystems[pool+"/"+filesystem] = true
+	return nil
+}
+
+func (f *fakeZFS) callsTo(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == op || strings.HasPrefix(c, op+" ") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,355 @@
+package main
+
+// Parsers for zpool and zfs output. Wherever the commands support it we run
+// them with -H (no headers, tab separated) and -p (exact, unitless numbers),
+// so the only free text we parse is zpool status.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// POOL_LIST_FIELDS are the columns we ask zpool list for, in the order
+// parsePoolList expects them.
+var POOL_LIST_FIELDS = []string{
+	"name", "size", "allocated", "free", "fragmentation", "capacity", "health", "guid",
+}
+
+// DATASET_LIST_FIELDS are the columns we ask zfs list for, in the order
+// parseDatasetList expects them.
+var DATASET_LIST_FIELDS = []string{
+	"name", "used", "available", "referenced", "mountpoint",
+}
+
+// PoolInfo is a line of zpool list.
+type PoolInfo struct {
+	Name          string
+	Size          uint64 // bytes
+	Allocated     uint64 // bytes
+	Free          uint64 // bytes
+	Fragmentation int    // percent, -1 if unknown
+	Capacity      int    // percent used
+	Health        string // ONLINE, DEGRADED, FAULTED, OFFLINE, UNAVAIL, REMOVED or SUSPENDED
+	GUID          uint64
+}
+
+// Id formats the pool's GUID the way dotmesh does.
+func (p PoolInfo) Id() string {
+	return fmt.Sprintf("%x", p.GUID)
+}
+
+// DatasetInfo is a line of zfs list.
+type DatasetInfo struct {
+	Name       string
+	Used       uint64 // bytes
+	Available  uint64 // bytes
+	Referenced uint64 // bytes
+	Mountpoint string
+}
+
+// Property is a line of zpool get or zfs get.
+type Property struct {
+	Name     string // pool or dataset
+	Property string
+	Value    string
+	Source   string // e.g. "default", "local", "-"
+}
+
+// VdevStatus is a line of the config section of zpool status.
+type VdevStatus struct {
+	Name     string
+	Depth    int // 0 for the pool itself, 1 for its top-level vdevs, ...
+	State    string
+	Read     uint64
+	Write    uint64
+	Checksum uint64
+	Message  string // anything after the counters, e.g. "was /dev/sdb"
+}
+
+// PoolStatus is one pool's section of zpool status.
+type PoolStatus struct {
+	Name   string
+	State  string
+	Status string
+	Action string
+	Scan   string
+	Errors string
+	Config []VdevStatus
+}
+
+// splitTabbedLines splits -H output into rows of exactly width fields.
+func splitTabbedLines(output string, width int) ([][]string, error) {
+	var rows [][]string
+	for i, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != width {
+			return nil, fmt.Errorf(
+				"line %d: expected %d tab separated fields, got %d in %q",
+				i+1, width, len(fields), line,
+			)
+		}
+		rows = append(rows, fields)
+	}
+	return rows, nil
+}
+
+// parseBytes parses a -p byte count. "-" (not applicable) parses as 0.
+func parseBytes(field, value string) (uint64, error) {
+	if value == "-" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %v", field, value, err)
+	}
+	return n, nil
+}
+
+// parsePercent parses a percentage, with or without a trailing %. "-" parses
+// as -1.
+func parsePercent(field, value string) (int, error) {
+	if value == "-" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %v", field, value, err)
+	}
+	return n, nil
+}
+
+// parsePoolList parses `zpool list -H -p -o <POOL_LIST_FIELDS>`.
+func parsePoolList(output string) ([]PoolInfo, error) {
+	rows, err := splitTabbedLines(output, len(POOL_LIST_FIELDS))
+	if err != nil {
+		return nil, err
+	}
+	pools := []PoolInfo{}
+	for _, row := range rows {
+		p := PoolInfo{Name: row[0], Health: row[6]}
+		if p.Size, err = parseBytes("size", row[1]); err != nil {
+			return nil, err
+		}
+		if p.Allocated, err = parseBytes("allocated", row[2]); err != nil {
+			return nil, err
+		}
+		if p.Free, err = parseBytes("free", row[3]); err != nil {
+			return nil, err
+		}
+		if p.Fragmentation, err = parsePercent("fragmentation", row[4]); err != nil {
+			return nil, err
+		}
+		if p.Capacity, err = parsePercent("capacity", row[5]); err != nil {
+			return nil, err
+		}
+		if p.GUID, err = strconv.ParseUint(row[7], 10, 64); err != nil {
+			return nil, fmt.Errorf("bad guid %q: %v", row[7], err)
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// parseDatasetList parses `zfs list -H -p -o <DATASET_LIST_FIELDS>`.
+func parseDatasetList(output string) ([]DatasetInfo, error) {
+	rows, err := splitTabbedLines(output, len(DATASET_LIST_FIELDS))
+	if err != nil {
+		return nil, err
+	}
+	datasets := []DatasetInfo{}
+	for _, row := range rows {
+		d := DatasetInfo{Name: row[0], Mountpoint: row[4]}
+		if d.Used, err = parseBytes("used", row[1]); err != nil {
+			return nil, err
+		}
+		if d.Available, err = parseBytes("available", row[2]); err != nil {
+			return nil, err
+		}
+		if d.Referenced, err = parseBytes("referenced", row[3]); err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, d)
+	}
+	return datasets, nil
+}
+
+// parseProperties parses `zpool get -H -p` or `zfs get -H -p`, which both
+// print name, property, value and source.
+func parseProperties(output string) ([]Property, error) {
+	rows, err := splitTabbedLines(output, 4)
+	if err != nil {
+		return nil, err
+	}
+	properties := []Property{}
+	for _, row := range rows {
+		properties = append(properties, Property{
+			Name: row[0], Property: row[1], Value: row[2], Source: row[3],
+		})
+	}
+	return properties, nil
+}
+
+// parsePoolStatus parses the human readable output of `zpool status`, which
+// has no -H. It looks like:
+//
+//	  pool: pool
+//	 state: ONLINE
+//	  scan: scrub repaired 0B in 0h0m with 0 errors on Sun Jul  1 00:00:01 2018
+//	config:
+//
+//		NAME        STATE     READ WRITE CKSUM
+//		pool        ONLINE       0     0     0
+//		  sda       ONLINE       0     0     0
+//
+//	errors: No known data errors
+func parsePoolStatus(output string) ([]PoolStatus, error) {
+	var pools []PoolStatus
+	var current *PoolStatus
+	// The key of the last "key: value" line, as status, action and scan can
+	// continue onto following indented lines.
+	lastKey := ""
+	inConfig := false
+	configIndent := -1
+
+	for i, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if key, value, ok := statusKeyValue(line); ok {
+			inConfig = false
+			lastKey = key
+			if key == "pool" {
+				pools = append(pools, PoolStatus{Name: value})
+				current = &pools[len(pools)-1]
+				continue
+			}
+			if current == nil {
+				return nil, fmt.Errorf("line %d: %q before any pool", i+1, line)
+			}
+			switch key {
+			case "state":
+				current.State = value
+			case "status":
+				current.Status = value
+			case "action":
+				current.Action = value
+			case "scan":
+				current.Scan = value
+			case "errors":
+				current.Errors = value
+			case "config":
+				inConfig = true
+				configIndent = -1
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		if inConfig {
+			fields := strings.Fields(trimmed)
+			if fields[0] == "NAME" {
+				// Header; the pool line is indented the same amount.
+				configIndent = indentation(line)
+				continue
+			}
+			if configIndent < 0 {
+				continue
+			}
+			vdev := VdevStatus{
+				Name:  fields[0],
+				Depth: (indentation(line) - configIndent) / 2,
+			}
+			if len(fields) > 1 {
+				vdev.State = fields[1]
+			}
+			// Spares and caches have no counters.
+			if len(fields) >= 5 {
+				var err error
+				if vdev.Read, err = parseErrorCount(fields[2]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				if vdev.Write, err = parseErrorCount(fields[3]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				if vdev.Checksum, err = parseErrorCount(fields[4]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				vdev.Message = strings.Join(fields[5:], " ")
+			}
+			current.Config = append(current.Config, vdev)
+			continue
+		}
+
+		// A continuation of a multi-line status, action or scan.
+		switch lastKey {
+		case "status":
+			current.Status += " " + trimmed
+		case "action":
+			current.Action += " " + trimmed
+		case "scan":
+			current.Scan += " " + trimmed
+		}
+	}
+	return pools, nil
+}
+
+// statusKeyValue recognises the "  key: value" lines of zpool status.
+func statusKeyValue(line string) (string, string, bool) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+	key := strings.TrimSpace(line[:colon])
+	switch key {
+	case "pool", "id", "state", "status", "action", "see", "scan", "config", "errors":
+		return key, strings.TrimSpace(line[colon+1:]), true
+	}
+	return "", "", false
+}
+
+func indentation(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 8
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// parseErrorCount parses a READ, WRITE or CKSUM column. Without -p these can
+// be abbreviated (e.g. "1.2K"), so handle that too.
+func parseErrorCount(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1000 * 1000
+	}
+	if multiplier != 1 {
+		f, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad error count %q", value)
+		}
+		return uint64(f * float64(multiplier)), nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad error count %q", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const degradedStatus = `  pool: tank
+ state: DEGRADED
+status: One or more devices could not be used because the label is missing or
+	invalid.  Sufficient replicas exist for the pool to continue
+	functioning in a degraded state.
+action: Replace the device using 'zpool replace'.
+   see: http://zfsonlinux.org/msg/ZFS-8000-4J
+  scan: scrub repaired 0B in 0h0m with 0 errors on Sun Jul  1 00:00:01 2018
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        DEGRADED     0     0     0
+	  mirror-0  DEGRADED     0     0     0
+	    sda     ONLINE       0     0     3
+	    sdb     UNAVAIL      0     0     0  was /dev/sdb1
+
+errors: No known data errors
+`
+
+func TestParsePoolStatus(t *testing.T) {
+	pools, err := parsePoolStatus(degradedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PoolStatus{{
+		Name:  "tank",
+		State: "DEGRADED",
+		Status: "One or more devices could not be used because the label is missing or " +
+			"invalid.  Sufficient replicas exist for the pool to continue " +
+			"functioning in a degraded state.",
+		Action: "Replace the device using 'zpool replace'.",
+		Scan:   "scrub repaired 0B in 0h0m with 0 errors on Sun Jul  1 00:00:01 2018",
+		Errors: "No known data errors",
+		Config: []VdevStatus{
+			{Name: "tank", Depth: 0, State: "DEGRADED"},
+			{Name: "mirror-0", Depth: 1, State: "DEGRADED"},
+			{Name: "sda", Depth: 2, State: "ONLINE", Checksum: 3},
+			{Name: "sdb", Depth: 2, State: "UNAVAIL", Message: "was /dev/sdb1"},
+		},
+	}}
+	if !reflect.DeepEqual(pools, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, pools)
+	}
+}
+
+func TestParseDatasetList(t *testing.T) {
+	datasets, err := parseDatasetList(
+		"pool\t1179648\t10467934208\t98304\tnone\n" +
+			"pool/dotmesh-etcd\t262144\t10467934208\t262144\tlegacy\n",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DatasetInfo{
+		{Name: "pool", Used: 1179648, Available: 10467934208, Referenced: 98304, Mountpoint: "none"},
+		{Name: "pool/dotmesh-etcd", Used: 262144, Available: 10467934208, Referenced: 262144, Mountpoint: "legacy"},
+	}
+	if !reflect.DeepEqual(datasets, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, datasets)
+	}
+
+	_, err = parseDatasetList("pool\t1179648\n")
+	if err == nil {
+		t.Errorf("expected an error for a short line")
+	}
+}
+
+func TestParseProperties(t *testing.T) {
+	properties, err := parseProperties("pool\tautoexpand\toff\tdefault\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Property{{Name: "pool", Property: "autoexpand", Value: "off", Source: "default"}}
+	if !reflect.DeepEqual(properties, expected) {
+		t.Errorf("expected %+v, got %+v", expected, properties)
+	}
+}
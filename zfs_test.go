@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// fakeRunner returns a canned result for every command, recording what it was
+// asked to run.
+type fakeRunner struct {
+	result CommandResult
+	err    error
+	ran    []string
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	r.ran = append(r.ran, name+" "+strings.Join(args, " "))
+	return r.result, r.err
+}
+
+func TestFilesystemExists(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		result    CommandResult
+		err       error
+		exists    bool
+		expectErr bool
+	}{
+		{
+			name:   "exists",
+			result: CommandResult{Stdout: "pool/fs\t24K\t9.6G\t24K\tlegacy\n"},
+			exists: true,
+		},
+		{
+			name: "missing dataset",
+			result: CommandResult{
+				Stderr:   "cannot open 'pool/fs': dataset does not exist\n",
+				ExitCode: 1,
+			},
+			exists: false,
+		},
+		{
+			name: "permission denied",
+			result: CommandResult{
+				Stderr:   "Unable to open /dev/zfs: Permission denied.\n",
+				ExitCode: 1,
+			},
+			expectErr: true,
+		},
+		{
+			name:      "binary not found",
+			err:       &CommandNotFoundError{Name: ZFS_BIN},
+			expectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{result: tc.result, err: tc.err}
+			exists, err := execZFS{runner: runner}.FilesystemExists("pool", "fs")
+			if tc.expectErr && err == nil {
+				t.Fatalf("expected an error, got exists=%v", exists)
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if exists != tc.exists {
+				t.Errorf("expected exists=%v, got %v", tc.exists, exists)
+			}
+			if len(runner.ran) != 1 || runner.ran[0] != "zfs list -H pool/fs" {
+				t.Errorf("unexpected commands: %v", runner.ran)
+			}
+		})
+	}
+}
+
+func TestPool(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result CommandResult
+		err    error
+		pool   PoolInfo
+		// expectErr, if set, must be exactly the error returned. anyErr
+		// accepts any error except errNoSuchPool.
+		expectErr error
+		anyErr    bool
+	}{
+		{
+			name: "exists",
+			result: CommandResult{
+				Stdout: "pool\t10468982784\t1048576\t10467934208\t3\t0\tONLINE\t1311768467294899695\n",
+			},
+			pool: PoolInfo{
+				Name: "pool", Size: 10468982784, Allocated: 1048576, Free: 10467934208,
+				Fragmentation: 3, Capacity: 0, Health: "ONLINE", GUID: 1311768467294899695,
+			},
+		},
+		{
+			name: "missing pool",
+			result: CommandResult{
+				Stderr:   "cannot open 'pool': no such pool\n",
+				ExitCode: 1,
+			},
+			expectErr: errNoSuchPool,
+		},
+		{
+			name: "permission denied",
+			result: CommandResult{
+				Stderr:   "Unable to open /dev/zfs: Permission denied.\n",
+				ExitCode: 1,
+			},
+			anyErr: true,
+		},
+		{
+			name:   "binary not found",
+			err:    &CommandNotFoundError{Name: ZPOOL_BIN},
+			anyErr: true,
+		},
+		{
+			name:   "unexpected output",
+			result: CommandResult{Stdout: "pool\tONLINE\n"},
+			anyErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{result: tc.result, err: tc.err}
+			pool, err := execZFS{runner: runner}.Pool("pool")
+			switch {
+			case tc.expectErr != nil:
+				if err != tc.expectErr {
+					t.Fatalf("expected %v, got %v", tc.expectErr, err)
+				}
+			case tc.anyErr:
+				if err == nil || err == errNoSuchPool {
+					t.Fatalf("expected an error other than errNoSuchPool, got %v", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if pool != tc.pool {
+					t.Errorf("expected %+v, got %+v", tc.pool, pool)
+				}
+				if pool.Id() != "1234567890abcdef" {
+					t.Errorf("wrong pool id %s", pool.Id())
+				}
+			}
+		})
+	}
+}
+
+func TestSetupZFSDoesntCreatePoolOnUnknownError(t *testing.T) {
+	runner := &fakeRunner{err: &CommandNotFoundError{Name: ZPOOL_BIN}}
+	err := setupZFS(execZFS{runner: runner}, "pool", []string{"/dev/sda"}, poolOptions{})
+	if _, ok := err.(*CommandNotFoundError); !ok {
+		t.Fatalf("expected a *CommandNotFoundError, got %#v", err)
+	}
+	if len(runner.ran) != 1 {
+		t.Errorf("expected only the zpool list, ran: %v", runner.ran)
+	}
+}
+
+func TestExecRunner(t *testing.T) {
+	runner := newExecRunner()
+
+	_, err := runner.Run(context.Background(), "dm-linuxkit-no-such-binary")
+	if _, ok := err.(*CommandNotFoundError); !ok {
+		t.Errorf("expected a *CommandNotFoundError, got %#v", err)
+	}
+
+	result, err := runner.Run(context.Background(), "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "out\n" || result.Stderr != "err\n" || result.ExitCode != 3 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = runner.Run(ctx, "sleep", "10")
+	if err == nil {
+		t.Errorf("expected a cancelled command to return an error")
+	}
+}